@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/mongodb/mongo-go-driver/mongo/mongoopt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// employeeAccount is a document in the accounts collection. Timestamps are
+// Unix seconds because the vendored driver cannot decode BSON datetimes into
+// time.Time.
+type employeeAccount struct {
+	EmployeeID        string  `bson:"employeeId"`
+	Balance           float64 `bson:"balance"`
+	PINHash           string  `bson:"pinHash"`
+	PINSalt           string  `bson:"pinSalt"`
+	PINFailedAttempts int     `bson:"pinFailedAttempts"`
+	PINLockedUntil    int64   `bson:"pinLockedUntil"`
+
+	Team        string          `bson:"team"`
+	PolicyGroup string          `bson:"policyGroup"`
+	Policy      policyOverrides `bson:"policy"`
+
+	// Usage in the current day, ISO week and month (see spendingPeriods).
+	UsageDay       string  `bson:"usageDay"`
+	SpentToday     float64 `bson:"spentToday"`
+	DrinksToday    int     `bson:"drinksToday"`
+	UsageWeek      string  `bson:"usageWeek"`
+	SpentThisWeek  float64 `bson:"spentThisWeek"`
+	AllowanceMonth string  `bson:"allowanceMonth"`
+	AllowanceUsed  float64 `bson:"allowanceUsed"`
+
+	Stamps int `bson:"stamps"`
+
+	// Email is where statements are sent; see statementAddress.
+	// StatementMonth is the last month a statement was emailed for.
+	Email          string `bson:"email,omitempty"`
+	StatementMonth string `bson:"statementMonth,omitempty"`
+
+	// Version is incremented by every charge; see chargeAccount.
+	Version int64 `bson:"version"`
+}
+
+func (a *employeeAccount) pinLocked() bool {
+	return a.PINLockedUntil > time.Now().Unix()
+}
+
+var errAccountNotFound = fmt.Errorf("Unknown employee ID")
+
+func (cs *coffeeserver) getAccount(ctx context.Context, employeeID string) (*employeeAccount, error) {
+	var account employeeAccount
+	err := cs.withCollection(ctx, cs.config.AccountsCollectionName, "find_account", func(ctx context.Context, accounts *mongo.Collection) error {
+		err := accounts.FindOne(ctx, bson.NewDocument(bson.EC.String("employeeId", employeeID))).Decode(&account)
+		if err == mongo.ErrNoDocuments {
+			return errAccountNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+const pinIterations = 10000
+
+var pinFormat = regexp.MustCompile(`^[0-9]{4}$`)
+
+func hashPIN(pin string, salt []byte) string {
+	return base64.StdEncoding.EncodeToString(pbkdf2.Key([]byte(pin), salt, pinIterations, 32, sha256.New))
+}
+
+// verifyPIN checks pin against the account's salted hash. Repeated failures
+// lock the PIN for the configured lockout period. The returned error is
+// suitable for reading back to the user.
+func (cs *coffeeserver) verifyPIN(ctx context.Context, employeeID, pin string) error {
+	account, err := cs.getAccount(ctx, employeeID)
+	if err != nil {
+		return err
+	}
+	if account.PINHash == "" {
+		return fmt.Errorf("No PIN is set for account %s", employeeID)
+	}
+	if account.pinLocked() {
+		return fmt.Errorf("Too many incorrect PIN attempts, please try again later")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(account.PINSalt)
+	if err != nil {
+		return fmt.Errorf("Unable to verify PIN")
+	}
+	if subtle.ConstantTimeCompare([]byte(hashPIN(pin, salt)), []byte(account.PINHash)) == 1 {
+		if account.PINFailedAttempts > 0 {
+			cs.updateAccount(ctx, employeeID, "reset_pin_attempts", bson.NewDocument(
+				bson.EC.SubDocumentFromElements("$set", bson.EC.Int32("pinFailedAttempts", 0)),
+			))
+		}
+		cs.audit(ctx, auditPINVerified, employeeID, nil)
+		return nil
+	}
+
+	var updated employeeAccount
+	err = cs.withCollection(ctx, cs.config.AccountsCollectionName, "record_pin_failure", func(ctx context.Context, accounts *mongo.Collection) error {
+		return accounts.FindOneAndUpdate(ctx,
+			bson.NewDocument(bson.EC.String("employeeId", employeeID)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Int32("pinFailedAttempts", 1))),
+			findopt.ReturnDocument(mongoopt.After),
+		).Decode(&updated)
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to record PIN failure: ", err)
+		return fmt.Errorf("Incorrect PIN")
+	}
+
+	cs.audit(ctx, auditPINFailed, employeeID, map[string]interface{}{"attempts": updated.PINFailedAttempts})
+	if updated.PINFailedAttempts >= cs.config.PINMaxAttempts {
+		lockedUntil := time.Now().Add(cs.config.PINLockout)
+		cs.updateAccount(ctx, employeeID, "lock_pin", bson.NewDocument(
+			bson.EC.SubDocumentFromElements("$set",
+				bson.EC.Int64("pinLockedUntil", lockedUntil.Unix()),
+				bson.EC.Int32("pinFailedAttempts", 0),
+			),
+		))
+		cs.audit(ctx, auditPINLocked, employeeID, map[string]interface{}{"lockedUntil": lockedUntil.Unix()})
+		return fmt.Errorf("Too many incorrect PIN attempts, please try again later")
+	}
+
+	return fmt.Errorf("Incorrect PIN")
+}
+
+// updateAccount applies update to the employee's account, logging failures.
+func (cs *coffeeserver) updateAccount(ctx context.Context, employeeID, operation string, update *bson.Document) error {
+	err := cs.withCollection(ctx, cs.config.AccountsCollectionName, operation, func(ctx context.Context, accounts *mongo.Collection) error {
+		res, err := accounts.UpdateOne(ctx, bson.NewDocument(bson.EC.String("employeeId", employeeID)), update)
+		if err == nil && res.MatchedCount == 0 {
+			return errAccountNotFound
+		}
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).WithField("employeeID", employeeID).Error("Unable to update account: ", err)
+	}
+	return err
+}
+
+// authorizeAccount checks that the caller may manage the employee's account:
+// the employee themselves, authenticated, or a caller whose roles allow them
+// to manage all accounts. Anonymous callers could otherwise read any balance
+// or set a PIN on an account that has none and order against it.
+func (cs *coffeeserver) authorizeAccount(w http.ResponseWriter, r *http.Request, employeeID string) bool {
+	p := principalFromContext(r.Context())
+	switch {
+	case p.can(permManageAccounts):
+	case p.EmployeeID == "":
+		http.Error(w, "Sign in to manage your account", http.StatusUnauthorized)
+		return false
+	case p.EmployeeID != employeeID:
+		http.Error(w, "You can only manage your own account", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (cs *coffeeserver) accountHandler(w http.ResponseWriter, r *http.Request) {
+	employeeID := mux.Vars(r)["employeeId"]
+	if !cs.authorizeAccount(w, r, employeeID) {
+		return
+	}
+
+	account, err := cs.getAccount(r.Context(), employeeID)
+	if err == errAccountNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		cs.logger(r.Context()).Error("Unable to get account: ", err)
+		http.Error(w, "Unable to get account", http.StatusInternalServerError)
+		return
+	}
+	policy, err := cs.accountPolicy(r.Context(), account)
+	if err != nil {
+		cs.logger(r.Context()).Error("Unable to get spending policy: ", err)
+	}
+
+	resp := map[string]interface{}{
+		"employeeId":  account.EmployeeID,
+		"balance":     account.Balance,
+		"currency":    cs.config.Currency,
+		"pinSet":      account.PINHash != "",
+		"pinLocked":   account.pinLocked(),
+		"team":        account.Team,
+		"policyGroup": account.PolicyGroup,
+		"policy":      policy,
+		"usage":       account.usage(cs.periods(time.Now())),
+	}
+	if cs.loyaltyEnabled() {
+		resp["stamps"] = account.Stamps
+		resp["stampsToGo"] = cs.stampsPerReward() - account.Stamps
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type pinRequest struct {
+	PIN        string `json:"pin"`
+	CurrentPIN string `json:"currentPin"`
+}
+
+// pinHandler sets (PUT) or clears (DELETE) an account's PIN. Callers that are
+// not authenticated as the employee must supply the current PIN if one is set.
+func (cs *coffeeserver) pinHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID := mux.Vars(r)["employeeId"]
+	if !cs.authorizeAccount(w, r, employeeID) {
+		return
+	}
+
+	var req pinRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	account, err := cs.getAccount(ctx, employeeID)
+	if err == errAccountNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		cs.logger(ctx).Error("Unable to get account: ", err)
+		http.Error(w, "Unable to get account", http.StatusInternalServerError)
+		return
+	}
+
+	if _, authed := authenticatedEmployee(ctx); !authed && account.PINHash != "" {
+		if err := cs.verifyPIN(ctx, employeeID, req.CurrentPIN); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if r.Method == http.MethodDelete {
+		err := cs.updateAccount(ctx, employeeID, "clear_pin", bson.NewDocument(
+			bson.EC.SubDocumentFromElements("$unset",
+				bson.EC.String("pinHash", ""),
+				bson.EC.String("pinSalt", ""),
+				bson.EC.String("pinFailedAttempts", ""),
+				bson.EC.String("pinLockedUntil", ""),
+			),
+		))
+		if err != nil {
+			http.Error(w, "Unable to clear PIN", http.StatusInternalServerError)
+			return
+		}
+		cs.audit(ctx, auditPINCleared, employeeID, nil)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !pinFormat.MatchString(req.PIN) {
+		http.Error(w, "PIN must be 4 digits", http.StatusBadRequest)
+		return
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		http.Error(w, "Unable to set PIN", http.StatusInternalServerError)
+		return
+	}
+	err = cs.updateAccount(ctx, employeeID, "set_pin", bson.NewDocument(
+		bson.EC.SubDocumentFromElements("$set",
+			bson.EC.String("pinHash", hashPIN(req.PIN, salt)),
+			bson.EC.String("pinSalt", base64.StdEncoding.EncodeToString(salt)),
+			bson.EC.Int32("pinFailedAttempts", 0),
+			bson.EC.Int64("pinLockedUntil", 0),
+		),
+	))
+	if err != nil {
+		http.Error(w, "Unable to set PIN", http.StatusInternalServerError)
+		return
+	}
+	cs.audit(ctx, auditPINChanged, employeeID, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
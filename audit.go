@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+// Audit event types.
+const (
+	auditPINVerified = "pin_verified"
+	auditPINFailed   = "pin_failed"
+	auditPINLocked   = "pin_locked"
+	auditPINChanged  = "pin_changed"
+	auditPINCleared  = "pin_cleared"
+
+	auditRolesChanged  = "roles_changed"
+	auditAPIKeyCreated = "apikey_created"
+	auditAPIKeyRevoked = "apikey_revoked"
+
+	auditBadgeTap        = "badge_tap"
+	auditBadgeUnknown    = "badge_unknown"
+	auditBadgeRegistered = "badge_registered"
+	auditBadgeRemoved    = "badge_removed"
+
+	auditPolicyChanged      = "policy_changed"
+	auditCostCentreChanged  = "cost_centre_changed"
+	auditSubsidyRuleChanged = "subsidy_rule_changed"
+	auditPricingChanged     = "pricing_changed"
+	auditOrderRefunded      = "order_refunded"
+	auditInventoryChanged   = "inventory_changed"
+	auditSiteChanged        = "site_changed"
+
+	auditStandingOrderChanged = "standing_order_changed"
+	auditStandingOrderFailed  = "standing_order_failed"
+
+	auditGroupCreated   = "group_created"
+	auditGroupSubmitted = "group_submitted"
+	auditGroupCancelled = "group_cancelled"
+)
+
+// audit records a security-relevant event for employeeID in the audit
+// collection and the log. Failures to store the event are logged but do not
+// fail the caller.
+func (cs *coffeeserver) audit(ctx context.Context, event, employeeID string, detail map[string]interface{}) {
+	fields := logrus.Fields{"auditEvent": event, "employeeID": employeeID}
+	doc := bson.NewDocument(
+		bson.EC.String("event", event),
+		bson.EC.String("employeeId", employeeID),
+		bson.EC.Int64("time", time.Now().Unix()),
+	)
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		doc.Append(bson.EC.String("requestId", id))
+	}
+	if p := principalFromContext(ctx); p.Kind != principalAnonymous {
+		actor := p.String()
+		doc.Append(bson.EC.String("actor", actor))
+		fields["actor"] = actor
+	}
+	if len(detail) > 0 {
+		details := bson.NewDocument()
+		for k, v := range detail {
+			details.Append(bson.EC.Interface(k, v))
+			fields[k] = v
+		}
+		doc.Append(bson.EC.SubDocument("detail", details))
+	}
+
+	log := cs.logger(ctx).WithFields(fields)
+	log.Info("Audit event")
+
+	err := cs.withCollection(ctx, cs.config.AuditCollectionName, "insert_audit_event", func(ctx context.Context, events *mongo.Collection) error {
+		_, err := events.InsertOne(ctx, doc)
+		return err
+	})
+	if err != nil {
+		log.Error("Unable to store audit event: ", err)
+	}
+}
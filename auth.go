@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type employeeKey struct{}
+
+// authenticatedEmployee returns the employee ID bound to the request by
+// authHandler, if any.
+func authenticatedEmployee(ctx context.Context) (string, bool) {
+	employeeID, ok := ctx.Value(employeeKey{}).(string)
+	return employeeID, ok && employeeID != ""
+}
+
+// authHandler identifies the caller and checks that they hold the permission
+// routePermissions requires for the matched route. Devices authenticate with
+// an X-API-Key header. When auth.mode is "jwt" employees authenticate with a
+// bearer JWT; otherwise unauthenticated callers get auth.anonymous_roles.
+func (cs *coffeeserver) authHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		p := &principal{Kind: principalAnonymous}
+		if cs.config.AuthMode != "jwt" {
+			p.Roles = splitList(cs.config.AuthAnonymousRoles)
+		}
+
+		if key := r.Header.Get(apiKeyHeader); key != "" {
+			k, err := cs.findAPIKey(ctx, key)
+			if err != nil {
+				cs.logger(ctx).Warn("Rejected API key: ", err)
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+			p = &principal{Kind: principalAPIKey, Name: k.Name, KeyID: k.ID.Hex(), Site: k.Site, Roles: k.Roles}
+		} else if auth := r.Header.Get("Authorization"); cs.config.AuthMode == "jwt" && strings.HasPrefix(auth, "Bearer ") {
+			claims, err := cs.jwks.verify(strings.TrimPrefix(auth, "Bearer "), cs.config.AuthIssuer, cs.config.AuthAudience)
+			if err != nil {
+				cs.logger(ctx).Warn("Rejected bearer token: ", err)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="coffee", error="invalid_token"`)
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			employeeID, _ := claims[cs.config.AuthEmployeeClaim].(string)
+			if employeeID == "" {
+				http.Error(w, "Token has no employee ID", http.StatusForbidden)
+				return
+			}
+			p = &principal{Kind: principalEmployee, EmployeeID: employeeID, Roles: cs.employeeRoles(ctx, employeeID)}
+			ctx = context.WithValue(ctx, employeeKey{}, employeeID)
+			ctx = context.WithValue(ctx, logEntryKey{}, cs.logger(ctx).WithField("authEmployeeID", employeeID))
+		}
+
+		ctx, err := cs.withBadgeSession(ctx, r, p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		ctx = context.WithValue(ctx, principalKey{}, p)
+		if site := cs.requestSite(r, p); site != "" {
+			ctx = context.WithValue(ctx, siteKey{}, site)
+			ctx = context.WithValue(ctx, logEntryKey{}, cs.logger(ctx).WithField("site", site))
+		}
+		if permission, ok := routePermissions[routeName(r)]; !ok || !p.can(permission) {
+			if p.Kind == principalAnonymous {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="coffee"`)
+				http.Error(w, "Authentication required", http.StatusUnauthorized)
+				return
+			}
+			cs.logger(ctx).WithField("principal", p.String()).Warn("Permission denied for route ", routeName(r))
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// dialogflowSessionID returns the Dialogflow session to use for the request.
+// Identified employees get their own session, derived from a hash of their
+// employee ID, so that conversations are not shared between users.
+func (cs *coffeeserver) dialogflowSessionID(ctx context.Context) string {
+	employeeID, ok := identifiedEmployee(ctx)
+	if !ok {
+		return cs.config.DialogflowSessionID
+	}
+	sum := sha256.Sum256([]byte(cs.config.DialogflowSessionID + "/" + employeeID))
+	return fmt.Sprintf("%x", sum[:16])
+}
+
+// resolveEmployeeID reconciles the employee ID captured by Dialogflow with the
+// authenticated or badge-identified employee: a missing ID is filled in, a
+// different one is rejected. Spoken IDs are compared ignoring case, which
+// transcription does not reliably capture.
+func resolveEmployeeID(ctx context.Context, spokenID string) (string, error) {
+	employeeID, ok := identifiedEmployee(ctx)
+	if !ok {
+		return spokenID, nil
+	}
+	if spokenID != "" && !strings.EqualFold(spokenID, employeeID) {
+		return "", fmt.Errorf("You can only charge orders to your own account")
+	}
+	return employeeID, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwksCache fetches and caches the identity provider's signing keys.
+type jwksCache struct {
+	url string
+	ttl time.Duration
+
+	// static keys are trusted without fetching, e.g. the local test issuer's.
+	static map[string]*rsa.PublicKey
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time
+	lastFetch time.Time
+}
+
+func newJWKSCache(url string, ttl time.Duration) *jwksCache {
+	return &jwksCache{url: url, ttl: ttl, static: map[string]*rsa.PublicKey{}}
+}
+
+// key returns the public key with the given ID, refreshing the cache when it
+// is stale or the key is unknown (at most once a minute, to allow for key
+// rotation without letting bad tokens hammer the provider).
+func (c *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	if key, ok := c.static[kid]; ok {
+		return key, nil
+	}
+	if c.url == "" {
+		return nil, fmt.Errorf("Unknown signing key %q", kid)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, ok := c.keys[kid]
+	stale := time.Since(c.fetched) > c.ttl
+	if ok && !stale {
+		return key, nil
+	}
+	if stale || time.Since(c.lastFetch) > time.Minute {
+		if err := c.refresh(); err != nil && !ok {
+			return nil, err
+		}
+		key, ok = c.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("Unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (c *jwksCache) refresh() error {
+	c.lastFetch = time.Now()
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(c.url)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch JWKS: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("Unable to decode JWKS: %s", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	c.keys = keys
+	c.fetched = time.Now()
+	return nil
+}
+
+// verify checks an RS256 JWT's signature, issuer, audience and validity
+// period and returns its claims.
+func (c *jwksCache) verify(token, issuer, audience string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("Unsupported signing algorithm %q", header.Alg)
+	}
+
+	key, err := c.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("Invalid token signature")
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); issuer != "" && iss != issuer {
+		return nil, fmt.Errorf("Unexpected issuer %q", iss)
+	}
+	if audience != "" && !hasAudience(claims["aud"], audience) {
+		return nil, fmt.Errorf("Token not issued for audience %q", audience)
+	}
+
+	const leeway = time.Minute
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return nil, fmt.Errorf("Token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("Token not yet valid")
+	}
+
+	return claims, nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("Malformed token segment")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("Malformed token segment")
+	}
+	return nil
+}
+
+// testIssuer is a local identity provider for development. It signs tokens
+// for any employee ID with a key generated at startup.
+type testIssuer struct {
+	issuer   string
+	audience string
+	claim    string
+	key      *rsa.PrivateKey
+	kid      string
+}
+
+const (
+	testIssuerJWKSPath  = "/auth/test/jwks.json"
+	testIssuerTokenPath = "/auth/test/token"
+)
+
+func newTestIssuer(cfg *config) (*testIssuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate test issuer key: %s", err)
+	}
+	return &testIssuer{
+		issuer:   cfg.AuthIssuer,
+		audience: cfg.AuthAudience,
+		claim:    cfg.AuthEmployeeClaim,
+		key:      key,
+		kid:      fmt.Sprintf("test-%d", time.Now().Unix()),
+	}, nil
+}
+
+func (ti *testIssuer) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+		Kty: "RSA",
+		Kid: ti.kid,
+		Alg: "RS256",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(ti.key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(ti.key.E)).Bytes()),
+	}}})
+}
+
+// tokenHandler mints a one hour token for the employeeId query parameter.
+func (ti *testIssuer) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	employeeID := r.FormValue("employeeId")
+	if employeeID == "" {
+		http.Error(w, "employeeId is required", http.StatusBadRequest)
+		return
+	}
+
+	token, err := ti.sign(map[string]interface{}{
+		"iss":    ti.issuer,
+		"aud":    ti.audience,
+		"sub":    employeeID,
+		ti.claim: employeeID,
+		"iat":    time.Now().Unix(),
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, token)
+}
+
+func (ti *testIssuer) sign(claims map[string]interface{}) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": ti.kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ti.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+	dialogflowpb "google.golang.org/genproto/googleapis/cloud/dialogflow/v2"
+)
+
+const badgeSessionHeader = "X-Badge-Session"
+
+// badgeContextName is the Dialogflow input context set while a badge session
+// is open. The agent can default its employeeId parameter to
+// #badge-identified.employeeId so that the ID does not need to be spoken.
+const badgeContextName = "badge-identified"
+
+// badge is a document in the badges collection mapping a card UID to an
+// employee.
+type badge struct {
+	CardUID    string `bson:"cardUid" json:"cardUid"`
+	EmployeeID string `bson:"employeeId" json:"employeeId"`
+	CreatedAt  int64  `bson:"createdAt" json:"createdAt"`
+}
+
+var cardUIDFormat = regexp.MustCompile(`^[0-9A-F]{8,20}$`)
+
+// normalizeCardUID accepts UIDs as readers report them, e.g. "04:a2:5b:1c" or
+// "04A25B1C", and returns the upper case hex form.
+func normalizeCardUID(uid string) (string, error) {
+	uid = strings.ToUpper(strings.NewReplacer(":", "", "-", "", " ", "").Replace(uid))
+	if !cardUIDFormat.MatchString(uid) {
+		return "", fmt.Errorf("Invalid card UID")
+	}
+	return uid, nil
+}
+
+type badgeSession struct {
+	employeeID string
+	device     string // the ID of the device's API key
+	expires    time.Time
+}
+
+// badgeSessions holds the sessions opened by badge taps. A session can only be
+// used by the device that opened it and lasts until it expires, is ended by
+// the device or an order is placed.
+type badgeSessions struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]badgeSession
+}
+
+func newBadgeSessions(ttl time.Duration) *badgeSessions {
+	return &badgeSessions{ttl: ttl, sessions: map[string]badgeSession{}}
+}
+
+func (s *badgeSessions) open(employeeID, device string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for t, session := range s.sessions {
+		if now.After(session.expires) || session.device == device {
+			delete(s.sessions, t)
+		}
+	}
+	s.sessions[token] = badgeSession{employeeID: employeeID, device: device, expires: now.Add(s.ttl)}
+	return token, nil
+}
+
+func (s *badgeSessions) lookup(token, device string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[token]
+	if !ok || session.device != device || time.Now().After(session.expires) {
+		return "", false
+	}
+	return session.employeeID, true
+}
+
+func (s *badgeSessions) end(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+type badgeEmployeeKey struct{}
+
+type badgeTokenKey struct{}
+
+// badgeEmployee returns the employee identified by the request's badge
+// session, if any. A badge only identifies the employee; it is not treated as
+// authentication, so PINs are still required when pin.required is set.
+func badgeEmployee(ctx context.Context) (string, bool) {
+	employeeID, ok := ctx.Value(badgeEmployeeKey{}).(string)
+	return employeeID, ok && employeeID != ""
+}
+
+// identifiedEmployee returns the authenticated employee, or failing that the
+// employee identified by a badge tap.
+func identifiedEmployee(ctx context.Context) (string, bool) {
+	if employeeID, ok := authenticatedEmployee(ctx); ok {
+		return employeeID, true
+	}
+	return badgeEmployee(ctx)
+}
+
+// withBadgeSession binds the badge session named in the request, if any, to
+// ctx. Badge sessions are only accepted from the device that opened them.
+func (cs *coffeeserver) withBadgeSession(ctx context.Context, r *http.Request, p *principal) (context.Context, error) {
+	token := r.Header.Get(badgeSessionHeader)
+	if token == "" {
+		return ctx, nil
+	}
+	if p.Kind != principalAPIKey {
+		return nil, fmt.Errorf("Badge sessions can only be used by devices")
+	}
+	employeeID, ok := cs.badgeSessions.lookup(token, p.KeyID)
+	if !ok {
+		return nil, fmt.Errorf("Badge session has expired, please tap your badge again")
+	}
+	ctx = context.WithValue(ctx, badgeEmployeeKey{}, employeeID)
+	ctx = context.WithValue(ctx, badgeTokenKey{}, token)
+	return context.WithValue(ctx, logEntryKey{}, cs.logger(ctx).WithField("badgeEmployeeID", employeeID)), nil
+}
+
+// endBadgeSession ends the request's badge session, if any, so that the next
+// person at the kiosk has to tap their own badge.
+func (cs *coffeeserver) endBadgeSession(ctx context.Context) {
+	if token, ok := ctx.Value(badgeTokenKey{}).(string); ok {
+		cs.badgeSessions.end(token)
+	}
+}
+
+// dialogflowQueryParams returns the query parameters for a DetectIntent call,
+// passing the badge employee to the agent as an input context.
+func (cs *coffeeserver) dialogflowQueryParams(ctx context.Context, sessionPath string) *dialogflowpb.QueryParameters {
+	employeeID, ok := badgeEmployee(ctx)
+	if !ok {
+		return nil
+	}
+	return &dialogflowpb.QueryParameters{
+		Contexts: []*dialogflowpb.Context{{
+			Name:          sessionPath + "/contexts/" + badgeContextName,
+			LifespanCount: 5,
+			Parameters: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"employeeId": {Kind: &structpb.Value_StringValue{StringValue: employeeID}},
+			}},
+		}},
+	}
+}
+
+type badgeTapRequest struct {
+	CardUID string `json:"cardUid"`
+}
+
+// badgeTapHandler opens a badge session for the employee whose card was
+// tapped on the calling device's reader.
+func (cs *coffeeserver) badgeTapHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	p := principalFromContext(ctx)
+	if p.Kind != principalAPIKey {
+		http.Error(w, "Badge taps must come from a device", http.StatusForbidden)
+		return
+	}
+
+	var req badgeTapRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	uid, err := normalizeCardUID(req.CardUID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var b badge
+	err = cs.withCollection(ctx, cs.config.BadgesCollectionName, "find_badge", func(ctx context.Context, badges *mongo.Collection) error {
+		return badges.FindOne(ctx, bson.NewDocument(bson.EC.String("cardUid", uid))).Decode(&b)
+	})
+	if err == mongo.ErrNoDocuments {
+		cs.audit(ctx, auditBadgeUnknown, "", map[string]interface{}{"cardUid": uid})
+		http.Error(w, "Unknown badge", http.StatusNotFound)
+		return
+	} else if err != nil {
+		cs.logger(ctx).Error("Unable to look up badge: ", err)
+		http.Error(w, "Unable to look up badge", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := cs.badgeSessions.open(b.EmployeeID, p.KeyID)
+	if err != nil {
+		http.Error(w, "Unable to open badge session", http.StatusInternalServerError)
+		return
+	}
+	cs.audit(ctx, auditBadgeTap, b.EmployeeID, nil)
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"sessionToken": token,
+		"employeeId":   b.EmployeeID,
+		"expiresIn":    int(cs.config.BadgeSessionTTL.Seconds()),
+	})
+}
+
+// badgeSessionHandler ends the badge session named in the request.
+func (cs *coffeeserver) badgeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	cs.endBadgeSession(r.Context())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type badgeRequest struct {
+	EmployeeID string `json:"employeeId"`
+}
+
+// badgesHandler registers (PUT) or removes (DELETE) a badge.
+func (cs *coffeeserver) badgesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid, err := normalizeCardUID(mux.Vars(r)["cardUid"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		var deleted int64
+		err := cs.withCollection(ctx, cs.config.BadgesCollectionName, "delete_badge", func(ctx context.Context, badges *mongo.Collection) error {
+			res, err := badges.DeleteOne(ctx, bson.NewDocument(bson.EC.String("cardUid", uid)))
+			if err == nil {
+				deleted = res.DeletedCount
+			}
+			return err
+		})
+		if err != nil {
+			cs.logger(ctx).Error("Unable to remove badge: ", err)
+			http.Error(w, "Unable to remove badge", http.StatusInternalServerError)
+			return
+		}
+		if deleted == 0 {
+			http.Error(w, "Unknown badge", http.StatusNotFound)
+			return
+		}
+		cs.audit(ctx, auditBadgeRemoved, "", map[string]interface{}{"cardUid": uid})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req badgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.EmployeeID == "" {
+		http.Error(w, "An employeeId is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := cs.getAccount(ctx, req.EmployeeID); err == errAccountNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		cs.logger(ctx).Error("Unable to get account: ", err)
+		http.Error(w, "Unable to get account", http.StatusInternalServerError)
+		return
+	}
+
+	b := badge{CardUID: uid, EmployeeID: req.EmployeeID, CreatedAt: time.Now().Unix()}
+	err = cs.withCollection(ctx, cs.config.BadgesCollectionName, "set_badge", func(ctx context.Context, badges *mongo.Collection) error {
+		_, err := badges.UpdateOne(ctx,
+			bson.NewDocument(bson.EC.String("cardUid", uid)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set",
+				bson.EC.String("employeeId", b.EmployeeID),
+				bson.EC.Int64("createdAt", b.CreatedAt),
+			)),
+			updateopt.Upsert(true),
+		)
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to register badge: ", err)
+		http.Error(w, "Unable to register badge", http.StatusInternalServerError)
+		return
+	}
+	cs.audit(ctx, auditBadgeRegistered, req.EmployeeID, map[string]interface{}{"cardUid": uid})
+
+	writeJSON(w, http.StatusOK, b)
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const envPrefix = "COFFEE_"
+
+// config holds all runtime settings. Values are layered, lowest precedence
+// first: built-in defaults, the config file, COFFEE_* environment variables
+// and finally command line flags that were set explicitly.
+//
+// The config tag gives the key used in the config file ("section.key") and,
+// upper-cased with dots and dashes replaced by underscores and prefixed with
+// COFFEE_, the environment variable. The flag tag names the command line flag
+// bound to the field in init. Fields tagged secret are redacted by
+// "config print".
+type config struct {
+	ConfigFile string `config:"config" flag:"config"`
+	Verbose    bool   `config:"verbose" flag:"verbose"`
+	LogFormat  string `config:"log_format" flag:"log-format"`
+
+	ListenAddr      string        `config:"server.addr" flag:"addr"`
+	TLS             bool          `config:"server.tls" flag:"tls"`
+	CertFile        string        `config:"server.cert" flag:"cert"`
+	CertKeyFile     string        `config:"server.certkey" flag:"certkey"`
+	ShutdownTimeout time.Duration `config:"server.shutdown_timeout" flag:"shutdown-timeout"`
+
+	MongoURI                     string        `config:"mongo.uri" flag:"mongo" secret:"true"`
+	DBName                       string        `config:"mongo.database"`
+	OrdersCollectionName         string        `config:"mongo.orders_collection"`
+	AccountsCollectionName       string        `config:"mongo.accounts_collection"`
+	AuditCollectionName          string        `config:"mongo.audit_collection"`
+	RolesCollectionName          string        `config:"mongo.roles_collection"`
+	APIKeysCollectionName        string        `config:"mongo.apikeys_collection"`
+	BadgesCollectionName         string        `config:"mongo.badges_collection"`
+	PoliciesCollectionName       string        `config:"mongo.policies_collection"`
+	CostCentresCollectionName    string        `config:"mongo.cost_centres_collection"`
+	SubsidyRulesCollectionName   string        `config:"mongo.subsidy_rules_collection"`
+	PromotionsCollectionName     string        `config:"mongo.promotions_collection"`
+	CouponsCollectionName        string        `config:"mongo.coupons_collection"`
+	IngredientsCollectionName    string        `config:"mongo.ingredients_collection"`
+	RecipesCollectionName        string        `config:"mongo.recipes_collection"`
+	StandingOrdersCollectionName string        `config:"mongo.standing_orders_collection"`
+	FavouritesCollectionName     string        `config:"mongo.favourites_collection"`
+	GroupOrdersCollectionName    string        `config:"mongo.group_orders_collection"`
+	PickupCountersCollectionName string        `config:"mongo.pickup_counters_collection"`
+	ConversationsCollectionName  string        `config:"mongo.conversations_collection"`
+	SitesCollectionName          string        `config:"mongo.sites_collection"`
+	DBTimeout                    time.Duration `config:"mongo.timeout"`
+
+	DialogflowProjectID    string `config:"dialogflow.project_id"`
+	DialogflowSessionID    string `config:"dialogflow.session_id"`
+	DialogflowLanguageCode string `config:"dialogflow.language_code"`
+	DialogflowKeyFile      string `config:"dialogflow.key_file"`
+
+	// Intent display names for ordering a drink, for Dialogflow not
+	// understanding, and for the requests handled besides ordering a drink.
+	DialogflowOrderIntent               string `config:"dialogflow.order_intent"`
+	DialogflowFallbackIntent            string `config:"dialogflow.fallback_intent"`
+	DialogflowStandingOrderIntent       string `config:"dialogflow.standing_order_intent"`
+	DialogflowCancelStandingOrderIntent string `config:"dialogflow.cancel_standing_order_intent"`
+	DialogflowUsualOrderIntent          string `config:"dialogflow.usual_order_intent"`
+	DialogflowJoinGroupIntent           string `config:"dialogflow.join_group_intent"`
+
+	// Intents matched with less confidence than DialogflowMinConfidence, or
+	// than their own threshold in DialogflowIntentConfidence
+	// ("intent=0.7,other-intent=0.6"), are asked for again.
+	DialogflowMinConfidence    float64 `config:"dialogflow.min_confidence"`
+	DialogflowIntentConfidence string  `config:"dialogflow.intent_confidence"`
+
+	AuthMode           string        `config:"auth.mode" flag:"auth"`
+	AuthIssuer         string        `config:"auth.issuer"`
+	AuthAudience       string        `config:"auth.audience"`
+	AuthJWKSURL        string        `config:"auth.jwks_url"`
+	AuthJWKSCacheTTL   time.Duration `config:"auth.jwks_cache_ttl"`
+	AuthEmployeeClaim  string        `config:"auth.employee_claim"`
+	AuthTestIssuer     bool          `config:"auth.test_issuer"`
+	AuthAdmins         string        `config:"auth.admins"`
+	AuthAnonymousRoles string        `config:"auth.anonymous_roles"`
+
+	PINRequired    bool          `config:"pin.required"`
+	PINMaxAttempts int           `config:"pin.max_attempts"`
+	PINLockout     time.Duration `config:"pin.lockout"`
+
+	BadgeSessionTTL time.Duration `config:"badge.session_ttl"`
+
+	LoyaltyFreeDrinkEvery int `config:"loyalty.free_drink_every"`
+
+	InventoryAlertWebhook string `config:"inventory.alert_webhook"`
+
+	// SMTP server for emailing statements. Leave SMTPAddress empty to not
+	// send email.
+	SMTPAddress  string `config:"smtp.address"`
+	SMTPFrom     string `config:"smtp.from"`
+	SMTPUsername string `config:"smtp.username"`
+	SMTPPassword string `config:"smtp.password" secret:"true"`
+
+	// StatementsEmailDomain is used for employees without an email address:
+	// their statements go to <employee ID>@<domain>.
+	StatementsEmailDomain string `config:"statements.email_domain"`
+
+	// PrinterAddress is the host:port of the ESC/POS ticket printer for sites
+	// without a printer of their own. Leave it empty to not print tickets.
+	PrinterAddress string        `config:"printer.address"`
+	PrinterTimeout time.Duration `config:"printer.timeout"`
+
+	// DefaultSite is the site for requests that do not name one. Leave it
+	// empty for a single coffee bar without site records.
+	DefaultSite string `config:"site.default"`
+
+	// OrdersOutsideHours is what happens to orders placed while the site is
+	// closed: "reject" them or "schedule" them for when it opens.
+	OrdersOutsideHours     string        `config:"orders.outside_hours"`
+	OrdersScheduleLead     time.Duration `config:"orders.schedule_lead"`
+	OrdersMaxScheduleAhead time.Duration `config:"orders.max_schedule_ahead"`
+
+	// An order is for between OrdersMinQuantity and OrdersMaxQuantity drinks.
+	OrdersMinQuantity int `config:"orders.min_quantity"`
+	OrdersMaxQuantity int `config:"orders.max_quantity"`
+
+	// Spoken employee IDs are put in EmployeeIDCase ("upper", "lower" or ""
+	// to leave them as heard) and, if EmployeeIDPattern is set, must match it
+	// in full.
+	EmployeeIDCase    string `config:"employees.id_case"`
+	EmployeeIDPattern string `config:"employees.id_pattern"`
+
+	// StandingOrderAdvance is how long before pickup standing orders are
+	// placed, and charged.
+	StandingOrderAdvance time.Duration `config:"standing.advance"`
+
+	SchedulerInterval time.Duration `config:"scheduler.interval"`
+
+	// FavouritesHistory is how many recent orders the usual is inferred from.
+	FavouritesHistory int `config:"favourites.history"`
+
+	// Wait time estimates are learned from how long orders took over the last
+	// WaitTimeHistory, relearned every WaitTimeRefresh. Until there is any
+	// history a drink takes WaitTimeDefaultPrep and WaitTimeBaristas tickets
+	// are made at once.
+	WaitTimeHistory     time.Duration `config:"waittime.history"`
+	WaitTimeRefresh     time.Duration `config:"waittime.refresh"`
+	WaitTimeDefaultPrep time.Duration `config:"waittime.default_prep"`
+	WaitTimeBaristas    int           `config:"waittime.baristas"`
+
+	// Conversation turns are kept for ConversationsRetention. Their audio is
+	// only kept if ConversationsAudioRetention is set, and for that long.
+	ConversationsRetention      time.Duration `config:"conversations.retention"`
+	ConversationsAudioRetention time.Duration `config:"conversations.audio_retention"`
+
+	// GroupWindow is how long a group order stays open for others to join
+	// unless the organiser says otherwise.
+	GroupWindow time.Duration `config:"groups.window"`
+
+	// Default spending policy; see spendingPolicy.
+	PolicyDailyCap         float64 `config:"policy.daily_cap"`
+	PolicyWeeklyCap        float64 `config:"policy.weekly_cap"`
+	PolicyMaxDrinksPerDay  int     `config:"policy.max_drinks_per_day"`
+	PolicyOverdraftLimit   float64 `config:"policy.overdraft_limit"`
+	PolicyMonthlyAllowance float64 `config:"policy.monthly_allowance"`
+
+	Currency string `config:"store.currency"`
+	Timezone string `config:"store.timezone"`
+	Holidays string `config:"store.holidays"`
+
+	TraceExporter    string  `config:"trace.exporter" flag:"trace-exporter"`
+	TracePropagation string  `config:"trace.propagation" flag:"trace-propagation"`
+	TraceSampleRate  float64 `config:"trace.sample_rate" flag:"trace-sample-rate"`
+
+	// The Stackdriver project and credentials spans are uploaded with, if
+	// not Dialogflow's.
+	TraceStackdriverProject string `config:"trace.stackdriver_project"`
+	TraceStackdriverKeyFile string `config:"trace.stackdriver_key_file"`
+
+	location          *time.Location
+	intentConfidence  map[string]float64
+	employeeIDPattern *regexp.Regexp
+}
+
+func defaultConfig() config {
+	return config{
+		LogFormat: "text",
+
+		ListenAddr:      ":5000",
+		ShutdownTimeout: 20 * time.Second,
+
+		MongoURI:                     "mongodb://localhost:27017",
+		DBName:                       "coffee-demo",
+		OrdersCollectionName:         "orders",
+		AccountsCollectionName:       "employeeAccounts",
+		AuditCollectionName:          "auditEvents",
+		RolesCollectionName:          "roleAssignments",
+		APIKeysCollectionName:        "apiKeys",
+		BadgesCollectionName:         "badges",
+		PoliciesCollectionName:       "spendingPolicies",
+		CostCentresCollectionName:    "costCentres",
+		SubsidyRulesCollectionName:   "subsidyRules",
+		PromotionsCollectionName:     "promotions",
+		CouponsCollectionName:        "coupons",
+		IngredientsCollectionName:    "ingredients",
+		RecipesCollectionName:        "recipes",
+		StandingOrdersCollectionName: "standingOrders",
+		FavouritesCollectionName:     "favourites",
+		GroupOrdersCollectionName:    "groupOrders",
+		PickupCountersCollectionName: "pickupCounters",
+		ConversationsCollectionName:  "conversations",
+		SitesCollectionName:          "sites",
+		DBTimeout:                    5 * time.Second,
+
+		DialogflowProjectID:    "test1-61c87",
+		DialogflowSessionID:    "24e636f5-c721-5517-3538-fcf612ca9b33",
+		DialogflowLanguageCode: "en",
+		DialogflowKeyFile:      "keys/dialogflowclient-key.json",
+
+		DialogflowOrderIntent:               "order-coffee",
+		DialogflowFallbackIntent:            "Default Fallback Intent",
+		DialogflowStandingOrderIntent:       "standing-order",
+		DialogflowCancelStandingOrderIntent: "cancel-standing-order",
+		DialogflowUsualOrderIntent:          "usual-order",
+		DialogflowJoinGroupIntent:           "join-group",
+		DialogflowMinConfidence:             0.5,
+
+		AuthMode:           "none",
+		AuthIssuer:         "coffee-demo-test-issuer",
+		AuthAudience:       "coffee-demo-app",
+		AuthJWKSCacheTTL:   time.Hour,
+		AuthEmployeeClaim:  "employee_id",
+		AuthAnonymousRoles: roleEmployee,
+
+		PINMaxAttempts: 3,
+		PINLockout:     15 * time.Minute,
+
+		BadgeSessionTTL: 2 * time.Minute,
+
+		OrdersOutsideHours:     "reject",
+		OrdersScheduleLead:     10 * time.Minute,
+		OrdersMaxScheduleAhead: 24 * time.Hour,
+		OrdersMinQuantity:      1,
+		OrdersMaxQuantity:      10,
+
+		StandingOrderAdvance: time.Hour,
+
+		SchedulerInterval: time.Minute,
+
+		FavouritesHistory: 20,
+
+		GroupWindow: 15 * time.Minute,
+
+		PrinterTimeout: 5 * time.Second,
+
+		ConversationsRetention: 30 * 24 * time.Hour,
+
+		WaitTimeHistory:     7 * 24 * time.Hour,
+		WaitTimeRefresh:     10 * time.Minute,
+		WaitTimeDefaultPrep: 90 * time.Second,
+		WaitTimeBaristas:    1,
+
+		LoyaltyFreeDrinkEvery: 10,
+
+		Currency: "AUD",
+		Timezone: "Australia/Sydney",
+
+		TraceExporter:    "none",
+		TracePropagation: "w3c,b3",
+		TraceSampleRate:  0.1,
+	}
+}
+
+// flagConfig receives the command line flags registered in init.
+var flagConfig = defaultConfig()
+
+// loadConfig builds the effective configuration from defaults, the config
+// file, the environment and explicitly set flags, then validates it.
+func loadConfig() (*config, error) {
+	cfg := defaultConfig()
+
+	configFile := flagConfig.ConfigFile
+	if !flagWasSet("config") {
+		configFile = os.Getenv(envName("config"))
+	}
+	if configFile != "" {
+		f, err := os.Open(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open config file: %s", err)
+		}
+		values, err := parseConfigFile(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse config file %s: %s", configFile, err)
+		}
+		for key, value := range values {
+			if err := cfg.set(key, value); err != nil {
+				return nil, fmt.Errorf("%s: %s", configFile, err)
+			}
+		}
+	}
+
+	for _, key := range cfg.keys() {
+		if value, ok := os.LookupEnv(envName(key)); ok {
+			if err := cfg.set(key, value); err != nil {
+				return nil, fmt.Errorf("%s: %s", envName(key), err)
+			}
+		}
+	}
+
+	flagged := reflect.ValueOf(&flagConfig).Elem()
+	target := reflect.ValueOf(&cfg).Elem()
+	for i := 0; i < flagged.NumField(); i++ {
+		name := flagged.Type().Field(i).Tag.Get("flag")
+		if name != "" && flagWasSet(name) {
+			target.Field(i).Set(flagged.Field(i))
+		}
+	}
+	cfg.ConfigFile = configFile
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+func (cfg *config) validate() error {
+	var problems []string
+
+	required := map[string]string{
+		"server.addr":                      cfg.ListenAddr,
+		"mongo.database":                   cfg.DBName,
+		"mongo.orders_collection":          cfg.OrdersCollectionName,
+		"mongo.accounts_collection":        cfg.AccountsCollectionName,
+		"mongo.audit_collection":           cfg.AuditCollectionName,
+		"mongo.roles_collection":           cfg.RolesCollectionName,
+		"mongo.apikeys_collection":         cfg.APIKeysCollectionName,
+		"mongo.badges_collection":          cfg.BadgesCollectionName,
+		"mongo.policies_collection":        cfg.PoliciesCollectionName,
+		"mongo.cost_centres_collection":    cfg.CostCentresCollectionName,
+		"mongo.subsidy_rules_collection":   cfg.SubsidyRulesCollectionName,
+		"mongo.promotions_collection":      cfg.PromotionsCollectionName,
+		"mongo.coupons_collection":         cfg.CouponsCollectionName,
+		"mongo.ingredients_collection":     cfg.IngredientsCollectionName,
+		"mongo.recipes_collection":         cfg.RecipesCollectionName,
+		"mongo.standing_orders_collection": cfg.StandingOrdersCollectionName,
+		"mongo.favourites_collection":      cfg.FavouritesCollectionName,
+		"mongo.group_orders_collection":    cfg.GroupOrdersCollectionName,
+		"mongo.pickup_counters_collection": cfg.PickupCountersCollectionName,
+		"mongo.conversations_collection":   cfg.ConversationsCollectionName,
+		"mongo.sites_collection":           cfg.SitesCollectionName,
+		"dialogflow.project_id":            cfg.DialogflowProjectID,
+		"dialogflow.session_id":            cfg.DialogflowSessionID,
+		"dialogflow.language_code":         cfg.DialogflowLanguageCode,
+		"dialogflow.key_file":              cfg.DialogflowKeyFile,
+		"dialogflow.order_intent":          cfg.DialogflowOrderIntent,
+	}
+	for _, key := range cfg.keys() {
+		if value, ok := required[key]; ok && value == "" {
+			problems = append(problems, key+" must be set")
+		}
+	}
+
+	if cfg.DialogflowMinConfidence < 0 || cfg.DialogflowMinConfidence > 1 {
+		problems = append(problems, "dialogflow.min_confidence must be between 0 and 1")
+	}
+	intentConfidence, err := parseIntentConfidence(cfg.DialogflowIntentConfidence)
+	if err != nil {
+		problems = append(problems, "dialogflow.intent_confidence: "+err.Error())
+	}
+	cfg.intentConfidence = intentConfidence
+
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		problems = append(problems, fmt.Sprintf("log_format %q must be text or json", cfg.LogFormat))
+	}
+	if cfg.TLS && (cfg.CertFile == "" || cfg.CertKeyFile == "") {
+		problems = append(problems, "server.cert and server.certkey are required when server.tls is enabled")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		problems = append(problems, "server.shutdown_timeout must not be negative")
+	}
+	if cfg.DBTimeout <= 0 {
+		problems = append(problems, "mongo.timeout must be positive")
+	}
+	if cfg.MongoURI != "" && !strings.HasPrefix(cfg.MongoURI, "mongodb://") && !strings.HasPrefix(cfg.MongoURI, "mongodb+srv://") {
+		problems = append(problems, "mongo.uri must be a mongodb:// or mongodb+srv:// connection string")
+	}
+	switch cfg.AuthMode {
+	case "none":
+	case "jwt":
+		if cfg.AuthJWKSURL == "" && !cfg.AuthTestIssuer {
+			problems = append(problems, "auth.jwks_url or auth.test_issuer is required when auth.mode is jwt")
+		}
+		if cfg.AuthEmployeeClaim == "" {
+			problems = append(problems, "auth.employee_claim must be set")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("auth.mode %q must be none or jwt", cfg.AuthMode))
+	}
+	for _, role := range splitList(cfg.AuthAnonymousRoles) {
+		if !validRole(role) {
+			problems = append(problems, fmt.Sprintf("auth.anonymous_roles: unknown role %q", role))
+		}
+	}
+	if cfg.PINMaxAttempts < 1 {
+		problems = append(problems, "pin.max_attempts must be at least 1")
+	}
+	if cfg.PINLockout <= 0 {
+		problems = append(problems, "pin.lockout must be positive")
+	}
+	if cfg.BadgeSessionTTL <= 0 {
+		problems = append(problems, "badge.session_ttl must be positive")
+	}
+	if cfg.InventoryAlertWebhook != "" && !strings.HasPrefix(cfg.InventoryAlertWebhook, "https://") && !strings.HasPrefix(cfg.InventoryAlertWebhook, "http://") {
+		problems = append(problems, "inventory.alert_webhook must be an http:// or https:// URL")
+	}
+	if cfg.OrdersOutsideHours != "reject" && cfg.OrdersOutsideHours != "schedule" {
+		problems = append(problems, fmt.Sprintf("orders.outside_hours %q must be reject or schedule", cfg.OrdersOutsideHours))
+	}
+	if cfg.OrdersScheduleLead < 0 || cfg.OrdersMaxScheduleAhead <= 0 {
+		problems = append(problems, "orders.schedule_lead must not be negative and orders.max_schedule_ahead must be positive")
+	}
+	if cfg.StandingOrderAdvance <= cfg.OrdersScheduleLead || cfg.StandingOrderAdvance > cfg.OrdersMaxScheduleAhead {
+		problems = append(problems, "standing.advance must be longer than orders.schedule_lead and no longer than orders.max_schedule_ahead")
+	}
+	if cfg.OrdersMinQuantity < 1 || cfg.OrdersMaxQuantity < cfg.OrdersMinQuantity {
+		problems = append(problems, "orders.min_quantity must be at least 1 and orders.max_quantity no less")
+	}
+	if cfg.EmployeeIDCase != "" && cfg.EmployeeIDCase != "upper" && cfg.EmployeeIDCase != "lower" {
+		problems = append(problems, fmt.Sprintf("employees.id_case %q must be upper, lower or empty", cfg.EmployeeIDCase))
+	}
+	if cfg.EmployeeIDPattern != "" {
+		pattern, err := regexp.Compile("^(?:" + cfg.EmployeeIDPattern + ")$")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("employees.id_pattern: %s", err))
+		}
+		cfg.employeeIDPattern = pattern
+	}
+	if cfg.FavouritesHistory < 1 {
+		problems = append(problems, "favourites.history must be at least 1")
+	}
+	if cfg.SMTPAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.SMTPAddress); err != nil {
+			problems = append(problems, fmt.Sprintf("smtp.address %q must be host:port", cfg.SMTPAddress))
+		}
+		if cfg.SMTPFrom == "" {
+			problems = append(problems, "smtp.from is required to send email")
+		}
+	}
+	if cfg.PrinterAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.PrinterAddress); err != nil {
+			problems = append(problems, fmt.Sprintf("printer.address %q must be host:port", cfg.PrinterAddress))
+		}
+	}
+	if cfg.PrinterTimeout <= 0 {
+		problems = append(problems, "printer.timeout must be positive")
+	}
+	if cfg.WaitTimeHistory <= 0 || cfg.WaitTimeRefresh <= 0 || cfg.WaitTimeDefaultPrep <= 0 {
+		problems = append(problems, "waittime.history, waittime.refresh and waittime.default_prep must be positive")
+	}
+	if cfg.WaitTimeBaristas < 1 {
+		problems = append(problems, "waittime.baristas must be at least 1")
+	}
+	if cfg.ConversationsRetention <= 0 || cfg.ConversationsAudioRetention < 0 || cfg.ConversationsAudioRetention > cfg.ConversationsRetention {
+		problems = append(problems, "conversations.retention must be positive and conversations.audio_retention no longer")
+	}
+	if cfg.GroupWindow <= 0 {
+		problems = append(problems, "groups.window must be positive")
+	}
+	if cfg.SchedulerInterval <= 0 {
+		problems = append(problems, "scheduler.interval must be positive")
+	}
+	for _, date := range splitList(cfg.Holidays) {
+		if !dateFormat.MatchString(date) {
+			problems = append(problems, fmt.Sprintf("store.holidays: %q is not a YYYY-MM-DD date", date))
+		}
+	}
+	if cfg.LoyaltyFreeDrinkEvery < 0 || cfg.LoyaltyFreeDrinkEvery == 1 {
+		problems = append(problems, "loyalty.free_drink_every must be 0 (disabled) or at least 2")
+	}
+	if cfg.PolicyDailyCap < 0 || cfg.PolicyWeeklyCap < 0 || cfg.PolicyMaxDrinksPerDay < 0 || cfg.PolicyOverdraftLimit < 0 || cfg.PolicyMonthlyAllowance < 0 {
+		problems = append(problems, "policy limits must not be negative")
+	}
+	if !currencyCode.MatchString(cfg.Currency) {
+		problems = append(problems, fmt.Sprintf("store.currency %q is not an ISO 4217 currency code", cfg.Currency))
+	}
+	location, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("store.timezone %q is not a known time zone", cfg.Timezone))
+	}
+	cfg.location = location
+	if _, err := propagationFormat(cfg.TracePropagation); err != nil {
+		problems = append(problems, "trace.propagation: "+err.Error())
+	}
+	if cfg.TraceExporter != "none" && cfg.TraceExporter != "log" && cfg.TraceExporter != "stackdriver" {
+		problems = append(problems, fmt.Sprintf("trace.exporter %q must be none, log or stackdriver", cfg.TraceExporter))
+	}
+	if cfg.TraceSampleRate < 0 || cfg.TraceSampleRate > 1 {
+		problems = append(problems, "trace.sample_rate must be between 0 and 1")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// keys returns the config keys in declaration order.
+func (cfg *config) keys() []string {
+	t := reflect.TypeOf(*cfg)
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("config"); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (cfg *config) field(key string) (reflect.Value, reflect.StructField, bool) {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("config") == key {
+			return v.Field(i), v.Type().Field(i), true
+		}
+	}
+	return reflect.Value{}, reflect.StructField{}, false
+}
+
+func (cfg *config) set(key, value string) error {
+	f, _, ok := cfg.field(key)
+	if !ok {
+		return fmt.Errorf("Unknown config key %q", key)
+	}
+
+	switch f.Interface().(type) {
+	case string:
+		f.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid boolean %q", key, value)
+		}
+		f.SetBool(b)
+	case float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s: invalid number %q", key, value)
+		}
+		f.SetFloat(n)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid integer %q", key, value)
+		}
+		f.SetInt(int64(n))
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid duration %q", key, value)
+		}
+		f.SetInt(int64(d))
+	default:
+		return fmt.Errorf("%s: unsupported config type %s", key, f.Type())
+	}
+	return nil
+}
+
+// print writes the effective configuration in config file format, with
+// secrets redacted.
+func (cfg *config) print(w io.Writer) {
+	section := ""
+	for _, key := range cfg.keys() {
+		f, sf, _ := cfg.field(key)
+
+		value := fmt.Sprint(f.Interface())
+		if sf.Tag.Get("secret") == "true" {
+			value = redact(value)
+		}
+
+		name := key
+		if dot := strings.Index(key, "."); dot >= 0 {
+			if key[:dot] != section {
+				section = key[:dot]
+				fmt.Fprintf(w, "\n[%s]\n", section)
+			}
+			name = key[dot+1:]
+		}
+
+		if f.Kind() == reflect.String || f.Type() == reflect.TypeOf(time.Duration(0)) {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(w, "%s = %s\n", name, value)
+	}
+}
+
+// redact hides the password in connection strings and any other secret value.
+func redact(value string) string {
+	if value == "" {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" {
+		return "REDACTED"
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	return u.String()
+}
+
+// parseConfigFile reads the subset of TOML used by our config files: [section]
+// headers and key = value lines, where values are quoted strings, numbers or
+// booleans. Keys inside a section are returned as "section.key".
+func parseConfigFile(r io.Reader) (map[string]string, error) {
+	values := map[string]string{}
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: malformed section header", lineNo)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key := strings.TrimSpace(line[:eq])
+		raw := strings.TrimSpace(line[eq+1:])
+
+		var value string
+		if strings.HasPrefix(raw, `"`) {
+			end := strings.LastIndex(raw, `"`)
+			unquoted, err := strconv.Unquote(raw[:end+1])
+			if end == 0 || err != nil {
+				return nil, fmt.Errorf("line %d: malformed string", lineNo)
+			}
+			value = unquoted
+		} else {
+			if hash := strings.Index(raw, "#"); hash >= 0 {
+				raw = strings.TrimSpace(raw[:hash])
+			}
+			value = raw
+		}
+
+		if section != "" {
+			key = section + "." + key
+		}
+		values[key] = value
+	}
+
+	return values, scanner.Err()
+}
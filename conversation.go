@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	dialogflowpb "google.golang.org/genproto/googleapis/cloud/dialogflow/v2"
+)
+
+// conversationTurn is a document in the conversations collection: one
+// request to /order, what Dialogflow made of it and what we replied. Turns
+// are kept for conversations.retention and their audio, if kept at all, for
+// conversations.audio_retention.
+type conversationTurn struct {
+	ID         objectid.ObjectID      `bson:"_id" json:"-"`
+	IDHex      string                 `bson:"-" json:"id"`
+	Session    string                 `bson:"session" json:"session"`
+	Time       int64                  `bson:"time" json:"time"`
+	EmployeeID string                 `bson:"employeeId,omitempty" json:"employeeId,omitempty"`
+	Site       string                 `bson:"site,omitempty" json:"site,omitempty"`
+	Input      string                 `bson:"input" json:"input"` // text or audio
+	QueryText  string                 `bson:"queryText" json:"queryText"`
+	Intent     string                 `bson:"intent,omitempty" json:"intent,omitempty"`
+	Confidence float32                `bson:"confidence" json:"confidence"`
+	Parameters map[string]interface{} `bson:"parameters,omitempty" json:"parameters,omitempty"`
+	// FulfillmentText is Dialogflow's reply; Reply is ours.
+	FulfillmentText string `bson:"fulfillmentText,omitempty" json:"fulfillmentText,omitempty"`
+	Reply           string `bson:"reply" json:"reply"`
+	Status          int    `bson:"status" json:"status"`
+	Order           string `bson:"order,omitempty" json:"order,omitempty"`
+	Audio           []byte `bson:"audio,omitempty" json:"-"`
+	HasAudio        bool   `bson:"-" json:"hasAudio,omitempty"`
+	// PINRedacted marks a turn in which a PIN was spoken; its query text and
+	// audio are not kept.
+	PINRedacted bool `bson:"pinRedacted,omitempty" json:"pinRedacted,omitempty"`
+}
+
+type turnKey struct{}
+
+// turnFromContext returns the conversation turn being recorded for the
+// request, if any.
+func turnFromContext(ctx context.Context) *conversationTurn {
+	turn, _ := ctx.Value(turnKey{}).(*conversationTurn)
+	return turn
+}
+
+// recordTurnOrder notes the order a conversation turn resulted in.
+func recordTurnOrder(ctx context.Context, order *coffeeOrder) {
+	if turn := turnFromContext(ctx); turn != nil {
+		turn.Order = order.ID.Hex()
+	}
+}
+
+// replyRecorder keeps a copy of the reply to a turn.
+type replyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *replyRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *replyRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// startTurn begins recording a conversation turn for an /order request. The
+// returned request and writer must be used for the rest of the request, and
+// the returned function called at the end to store the turn.
+func (cs *coffeeserver) startTurn(w http.ResponseWriter, r *http.Request, input string) (http.ResponseWriter, *http.Request, func()) {
+	ctx := r.Context()
+	employeeID, _ := identifiedEmployee(ctx)
+	turn := &conversationTurn{
+		ID:         objectid.New(),
+		Session:    cs.dialogflowSessionID(ctx),
+		Time:       time.Now().Unix(),
+		EmployeeID: employeeID,
+		Site:       siteFromContext(ctx),
+		Input:      input,
+	}
+	rr := &replyRecorder{ResponseWriter: w}
+	r = r.WithContext(context.WithValue(ctx, turnKey{}, turn))
+	return rr, r, func() {
+		turn.Reply, turn.Status = rr.body.String(), rr.status
+		if cs.config.ConversationsAudioRetention <= 0 {
+			turn.Audio = nil
+		}
+		err := cs.withCollection(r.Context(), cs.config.ConversationsCollectionName, "insert_conversation", func(ctx context.Context, conversations *mongo.Collection) error {
+			_, err := conversations.InsertOne(ctx, turn)
+			return err
+		})
+		if err != nil {
+			cs.logger(r.Context()).Error("Unable to store conversation: ", err)
+		}
+	}
+}
+
+// recordQueryResult notes what Dialogflow made of a turn. A spoken PIN is in
+// the query text and audio as well as its parameter, so none of them are kept
+// for a turn that carried one.
+func (turn *conversationTurn) recordQueryResult(result *dialogflowpb.QueryResult) {
+	turn.QueryText = result.GetQueryText()
+	turn.Intent = result.GetIntent().GetDisplayName()
+	turn.Confidence = result.GetIntentDetectionConfidence()
+	turn.Parameters = withoutPIN(result.GetParameters())
+	turn.FulfillmentText = result.GetFulfillmentText()
+	if pinParameter(result.GetParameters().GetFields()["pin"]) != "" {
+		turn.QueryText, turn.Audio, turn.PINRedacted = "", nil, true
+	}
+}
+
+// structToMap converts Dialogflow parameters to plain values for storing.
+func structToMap(s *structpb.Struct) map[string]interface{} {
+	if s == nil || len(s.Fields) == 0 {
+		return nil
+	}
+	m := map[string]interface{}{}
+	for k, v := range s.Fields {
+		m[k] = plainValue(v)
+	}
+	return m
+}
+
+func plainValue(v *structpb.Value) interface{} {
+	switch kind := v.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return kind.StringValue
+	case *structpb.Value_NumberValue:
+		return kind.NumberValue
+	case *structpb.Value_BoolValue:
+		return kind.BoolValue
+	case *structpb.Value_StructValue:
+		return structToMap(kind.StructValue)
+	case *structpb.Value_ListValue:
+		list := []interface{}{}
+		for _, item := range kind.ListValue.GetValues() {
+			list = append(list, plainValue(item))
+		}
+		return list
+	}
+	return nil
+}
+
+// purgeConversations deletes turns older than conversations.retention and
+// audio older than conversations.audio_retention.
+func (cs *coffeeserver) purgeConversations(ctx context.Context) {
+	now := time.Now()
+	err := cs.withCollection(ctx, cs.config.ConversationsCollectionName, "purge_conversations", func(ctx context.Context, conversations *mongo.Collection) error {
+		_, err := conversations.DeleteMany(ctx, bson.NewDocument(
+			bson.EC.SubDocumentFromElements("time", bson.EC.Int64("$lt", now.Add(-cs.config.ConversationsRetention).Unix())),
+		))
+		if err != nil {
+			return err
+		}
+		audioCutoff := now.Add(-cs.config.ConversationsAudioRetention).Unix()
+		_, err = conversations.UpdateMany(ctx,
+			bson.NewDocument(
+				bson.EC.SubDocumentFromElements("audio", bson.EC.Boolean("$exists", true)),
+				bson.EC.SubDocumentFromElements("time", bson.EC.Int64("$lt", audioCutoff)),
+			),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$unset", bson.EC.String("audio", ""))),
+		)
+		return err
+	})
+	if err != nil {
+		cs.log.Error("Unable to purge conversations: ", err)
+	}
+}
+
+// conversationsHandler searches conversation turns, newest first, by session,
+// employee, intent, text in the query or reply (q) and the optional from and
+// to dates (YYYY-MM-DD, store time, inclusive). Turns of one session are
+// listed oldest first so they read as a conversation.
+func (cs *coffeeserver) conversationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	filter := bson.NewDocument()
+	for param, field := range map[string]string{"session": "session", "employee": "employeeId", "intent": "intent", "site": "site"} {
+		if v := query.Get(param); v != "" {
+			filter.Append(bson.EC.String(field, v))
+		}
+	}
+	if q := query.Get("q"); q != "" {
+		pattern := regexp.QuoteMeta(q)
+		filter.Append(bson.EC.ArrayFromElements("$or",
+			bson.VC.DocumentFromElements(bson.EC.Regex("queryText", pattern, "i")),
+			bson.VC.DocumentFromElements(bson.EC.Regex("reply", pattern, "i")),
+		))
+	}
+	if query.Get("orders") == "failed" {
+		// Turns Dialogflow passed on to us that did not end in an order.
+		filter.Append(
+			bson.EC.SubDocumentFromElements("order", bson.EC.Boolean("$exists", false)),
+			bson.EC.SubDocumentFromElements("fulfillmentText", bson.EC.Boolean("$exists", false)),
+		)
+	}
+	timeRange, err := cs.reportTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if timeRange != nil {
+		filter.Append(timeRange)
+	}
+
+	limit, page := defaultHistoryLimit, 1
+	if n, err := strconv.Atoi(query.Get("limit")); err == nil && n >= 1 && n <= maxHistoryLimit {
+		limit = n
+	}
+	if n, err := strconv.Atoi(query.Get("page")); err == nil && n >= 1 {
+		page = n
+	}
+	order := int32(-1)
+	if query.Get("session") != "" {
+		order = 1
+	}
+
+	turns := []conversationTurn{}
+	err = cs.withCollection(ctx, cs.config.ConversationsCollectionName, "list_conversations", func(ctx context.Context, conversations *mongo.Collection) error {
+		cur, err := conversations.Find(ctx, filter,
+			findopt.Sort(bson.NewDocument(bson.EC.Int32("time", order))),
+			findopt.Skip(int64((page-1)*limit)),
+			findopt.Limit(int64(limit+1)),
+			// The audio is fetched separately.
+			findopt.Projection(bson.NewDocument(bson.EC.Int32("audio", 0))),
+		)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var turn conversationTurn
+			if err := cur.Decode(&turn); err != nil {
+				return err
+			}
+			turn.IDHex = turn.ID.Hex()
+			turns = append(turns, turn)
+		}
+		return cur.Err()
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to list conversations: ", err)
+		http.Error(w, "Unable to list conversations", http.StatusInternalServerError)
+		return
+	}
+	more := len(turns) > limit
+	if more {
+		turns = turns[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"turns": turns, "page": page, "limit": limit, "more": more})
+}
+
+func (cs *coffeeserver) getConversationTurn(ctx context.Context, id string) (*conversationTurn, error) {
+	oid, err := objectid.FromHex(id)
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	var turn conversationTurn
+	err = cs.withCollection(ctx, cs.config.ConversationsCollectionName, "find_conversation", func(ctx context.Context, conversations *mongo.Collection) error {
+		return conversations.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&turn)
+	})
+	if err != nil {
+		return nil, err
+	}
+	turn.IDHex, turn.HasAudio = turn.ID.Hex(), len(turn.Audio) > 0
+	return &turn, nil
+}
+
+// conversationHandler shows one turn.
+func (cs *coffeeserver) conversationHandler(w http.ResponseWriter, r *http.Request) {
+	turn, ok := cs.conversationTurn(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, turn)
+}
+
+// conversationTurn looks up the turn named in the URL. If it returns false it
+// has already replied.
+func (cs *coffeeserver) conversationTurn(w http.ResponseWriter, r *http.Request) (*conversationTurn, bool) {
+	turn, err := cs.getConversationTurn(r.Context(), mux.Vars(r)["id"])
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Unknown conversation", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		cs.logger(r.Context()).Error("Unable to find conversation: ", err)
+		http.Error(w, "Unable to find conversation", http.StatusInternalServerError)
+		return nil, false
+	}
+	return turn, true
+}
+
+// conversationAudioHandler plays back the audio of a turn while it is kept.
+func (cs *coffeeserver) conversationAudioHandler(w http.ResponseWriter, r *http.Request) {
+	turn, ok := cs.conversationTurn(w, r)
+	if !ok {
+		return
+	}
+	if len(turn.Audio) == 0 {
+		http.Error(w, "No audio was kept for this conversation", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Write(turn.Audio)
+}
+
+// replayResult is what Dialogflow made of a turn, originally or on replay.
+type replayResult struct {
+	QueryText       string                 `json:"queryText"`
+	Intent          string                 `json:"intent,omitempty"`
+	Confidence      float32                `json:"confidence"`
+	Parameters      map[string]interface{} `json:"parameters,omitempty"`
+	FulfillmentText string                 `json:"fulfillmentText,omitempty"`
+}
+
+// replayConversationHandler sends a turn to Dialogflow again, as audio if it
+// was kept and otherwise as its query text, and shows what it makes of it
+// now next to what it made of it then. Replays use their own session and
+// never place orders.
+func (cs *coffeeserver) replayConversationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	turn, ok := cs.conversationTurn(w, r)
+	if !ok {
+		return
+	}
+	if turn.QueryText == "" && len(turn.Audio) == 0 {
+		http.Error(w, "Nothing to replay", http.StatusConflict)
+		return
+	}
+
+	sessionPath := fmt.Sprintf("projects/%s/agent/sessions/replay-%s", cs.config.DialogflowProjectID, turn.IDHex)
+	request := dialogflowpb.DetectIntentRequest{Session: sessionPath}
+	if len(turn.Audio) > 0 {
+		audioConfig := dialogflowpb.InputAudioConfig{AudioEncoding: dialogflowpb.AudioEncoding_AUDIO_ENCODING_LINEAR_16, LanguageCode: cs.config.DialogflowLanguageCode}
+		request.QueryInput = &dialogflowpb.QueryInput{Input: &dialogflowpb.QueryInput_AudioConfig{AudioConfig: &audioConfig}}
+		request.InputAudio = turn.Audio
+	} else {
+		textInput := dialogflowpb.TextInput{Text: turn.QueryText, LanguageCode: cs.config.DialogflowLanguageCode}
+		request.QueryInput = &dialogflowpb.QueryInput{Input: &dialogflowpb.QueryInput_Text{Text: &textInput}}
+	}
+
+	sessionClient, err := cs.getDialogFlowSessionsClient()
+	if err != nil {
+		http.Error(w, "Couldn't get dialogflow sessionClient object", http.StatusInternalServerError)
+		return
+	}
+	start := time.Now()
+	response, err := sessionClient.DetectIntent(ctx, &request)
+	recordDialogflowCall(start, err)
+	if err != nil {
+		cs.logger(ctx).Error("Error calling dialogflow service: ", err)
+		http.Error(w, "Error calling dialogflow service", http.StatusBadGateway)
+		return
+	}
+
+	var replay conversationTurn
+	replay.recordQueryResult(response.GetQueryResult())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"original": replayResult{turn.QueryText, turn.Intent, turn.Confidence, turn.Parameters, turn.FulfillmentText},
+		"replay":   replayResult{replay.QueryText, replay.Intent, replay.Confidence, replay.Parameters, replay.FulfillmentText},
+	})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/mongodb/mongo-go-driver/mongo/replaceopt"
+)
+
+// Favourite names with a special meaning. A saved favourite called "usual"
+// overrides the usual inferred from order history.
+const (
+	favouriteUsual     = "usual"
+	favouriteLast      = "last"
+	favouriteYesterday = "yesterday"
+)
+
+// favourite is a document in the favourites collection: a named order an
+// employee can repeat with "my <name>". Favourites inferred from order
+// history are not stored.
+type favourite struct {
+	EmployeeID string `bson:"employeeId" json:"-"`
+	Name       string `bson:"name" json:"name"`
+	CoffeeType string `bson:"coffeetype" json:"coffeetype"`
+	CoffeeQty  int    `bson:"coffeeqty" json:"coffeeqty"`
+	Inferred   bool   `bson:"-" json:"inferred,omitempty"`
+}
+
+func (f *favourite) describe() string {
+	return fmt.Sprintf("%d %s", f.CoffeeQty, f.CoffeeType)
+}
+
+func normalizeFavouriteName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.TrimPrefix(name, "my ")
+	name = strings.TrimPrefix(name, "the ")
+	switch name {
+	case "", "usual order", "regular", "the usual":
+		return favouriteUsual
+	case "same as yesterday", "yesterday's":
+		return favouriteYesterday
+	case "same again", "last order", "again":
+		return favouriteLast
+	}
+	return name
+}
+
+func (cs *coffeeserver) listFavourites(ctx context.Context, employeeID string) ([]favourite, error) {
+	favourites := []favourite{}
+	err := cs.withCollection(ctx, cs.config.FavouritesCollectionName, "list_favourites", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, bson.NewDocument(bson.EC.String("employeeId", employeeID)))
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var f favourite
+			if err := cur.Decode(&f); err != nil {
+				return err
+			}
+			favourites = append(favourites, f)
+		}
+		return cur.Err()
+	})
+	sort.Slice(favourites, func(i, j int) bool { return favourites[i].Name < favourites[j].Name })
+	return favourites, err
+}
+
+// recentOrders returns the employee's most recent orders that were not
+// refunded, newest first.
+func (cs *coffeeserver) recentOrders(ctx context.Context, employeeID string, limit int64) ([]coffeeOrder, error) {
+	var orders []coffeeOrder
+	err := cs.withCollection(ctx, cs.config.OrdersCollectionName, "recent_orders", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx,
+			bson.NewDocument(
+				bson.EC.String("employeeId", employeeID),
+				bson.EC.SubDocumentFromElements("refunded", bson.EC.Boolean("$ne", true)),
+			),
+			findopt.Sort(bson.NewDocument(bson.EC.Int32("time", -1))),
+			findopt.Limit(limit),
+		)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var order coffeeOrder
+			if err := cur.Decode(&order); err != nil {
+				return err
+			}
+			orders = append(orders, order)
+		}
+		return cur.Err()
+	})
+	return orders, err
+}
+
+// inferUsual returns the order the employee has placed most often among
+// their last favourites.history orders, if they have placed it at least
+// twice. Ties go to the most recent.
+func inferUsual(orders []coffeeOrder) *favourite {
+	counts := map[string]int{}
+	var usual *favourite
+	best := 1
+	for _, order := range orders {
+		key := fmt.Sprintf("%d %s", order.CoffeeQty, order.CoffeeType)
+		counts[key]++
+		if counts[key] > best {
+			best = counts[key]
+			usual = &favourite{Name: favouriteUsual, CoffeeType: order.CoffeeType, CoffeeQty: order.CoffeeQty, Inferred: true}
+		}
+	}
+	return usual
+}
+
+// resolveFavourite turns a favourite name into a concrete order: a saved
+// favourite, "usual" (saved or inferred from history), "last" (the most recent
+// order) or "yesterday" (the last order placed yesterday).
+func (cs *coffeeserver) resolveFavourite(ctx context.Context, employeeID, name string) (*favourite, error) {
+	name = normalizeFavouriteName(name)
+
+	if name != favouriteLast && name != favouriteYesterday {
+		var f favourite
+		err := cs.withCollection(ctx, cs.config.FavouritesCollectionName, "find_favourite", func(ctx context.Context, favourites *mongo.Collection) error {
+			return favourites.FindOne(ctx, bson.NewDocument(
+				bson.EC.String("employeeId", employeeID),
+				bson.EC.String("name", name),
+			)).Decode(&f)
+		})
+		if err == nil {
+			return &f, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+		if name != favouriteUsual {
+			return nil, fmt.Errorf("Sorry, you don't have a favourite called %s", name)
+		}
+	}
+
+	orders, err := cs.recentOrders(ctx, employeeID, int64(cs.config.FavouritesHistory))
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case favouriteUsual:
+		if usual := inferUsual(orders); usual != nil {
+			return usual, nil
+		}
+		return nil, fmt.Errorf("Sorry, I don't know your usual yet")
+	case favouriteYesterday:
+		yesterday := cs.storeTime(time.Now()).AddDate(0, 0, -1).Format("2006-01-02")
+		for _, order := range orders {
+			if cs.storeTime(time.Unix(order.Time, 0)).Format("2006-01-02") == yesterday {
+				return &favourite{Name: name, CoffeeType: order.CoffeeType, CoffeeQty: order.CoffeeQty, Inferred: true}, nil
+			}
+		}
+		return nil, fmt.Errorf("Sorry, you didn't order anything yesterday")
+	}
+	if len(orders) == 0 {
+		return nil, fmt.Errorf("Sorry, you haven't ordered anything yet")
+	}
+	return &favourite{Name: name, CoffeeType: orders[0].CoffeeType, CoffeeQty: orders[0].CoffeeQty, Inferred: true}, nil
+}
+
+// meEmployee returns the employee making the request, for the /me routes. If
+// it returns false it has already replied.
+func meEmployee(w http.ResponseWriter, r *http.Request) (string, bool) {
+	employeeID, ok := identifiedEmployee(r.Context())
+	if !ok {
+		http.Error(w, "Sign in or tap your badge first", http.StatusUnauthorized)
+	}
+	return employeeID, ok
+}
+
+// favouritesHandler lists the employee's saved favourites, with their usual
+// and last orders.
+func (cs *coffeeserver) favouritesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID, ok := meEmployee(w, r)
+	if !ok {
+		return
+	}
+
+	favourites, err := cs.listFavourites(ctx, employeeID)
+	if err != nil {
+		cs.logger(ctx).Error("Unable to list favourites: ", err)
+		http.Error(w, "Unable to list favourites", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]interface{}{"favourites": favourites}
+	for _, name := range []string{favouriteUsual, favouriteLast} {
+		if f, err := cs.resolveFavourite(ctx, employeeID, name); err == nil {
+			resp[name] = f
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// favouriteHandler saves (PUT) or removes (DELETE) a named favourite.
+func (cs *coffeeserver) favouriteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID, ok := meEmployee(w, r)
+	if !ok {
+		return
+	}
+	name := normalizeFavouriteName(mux.Vars(r)["name"])
+	if name == favouriteLast || name == favouriteYesterday {
+		http.Error(w, fmt.Sprintf("%q is reserved", name), http.StatusBadRequest)
+		return
+	}
+	filter := bson.NewDocument(bson.EC.String("employeeId", employeeID), bson.EC.String("name", name))
+
+	if r.Method == http.MethodDelete {
+		var deleted int64
+		err := cs.withCollection(ctx, cs.config.FavouritesCollectionName, "delete_favourite", func(ctx context.Context, favourites *mongo.Collection) error {
+			res, err := favourites.DeleteOne(ctx, filter)
+			if err == nil {
+				deleted = res.DeletedCount
+			}
+			return err
+		})
+		if err != nil {
+			cs.logger(ctx).Error("Unable to delete favourite: ", err)
+			http.Error(w, "Unable to delete favourite", http.StatusInternalServerError)
+			return
+		}
+		if deleted == 0 {
+			http.Error(w, "Unknown favourite", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var f favourite
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	f.EmployeeID, f.Name, f.Inferred = employeeID, name, false
+	if f.CoffeeQty < 1 {
+		http.Error(w, "coffeeqty must be at least 1", http.StatusBadRequest)
+		return
+	}
+	if known, err := cs.knownDrink(ctx, f.CoffeeType); err != nil {
+		cs.logger(ctx).Error("Unable to list sites: ", err)
+		http.Error(w, "Unable to save favourite", http.StatusInternalServerError)
+		return
+	} else if !known {
+		http.Error(w, "Unknown coffee type", http.StatusBadRequest)
+		return
+	}
+
+	err := cs.withCollection(ctx, cs.config.FavouritesCollectionName, "set_favourite", func(ctx context.Context, favourites *mongo.Collection) error {
+		_, err := favourites.ReplaceOne(ctx, filter, &f, replaceopt.Upsert(true))
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to save favourite: ", err)
+		http.Error(w, "Unable to save favourite", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+type reorderRequest struct {
+	PIN string `json:"pin"`
+}
+
+// reorderHandler places a favourite (or "usual", "last" or "yesterday") as an
+// order at the caller's site, for one-tap reordering from the web UI. The
+// reply is the same text a voice order gets.
+func (cs *coffeeserver) reorderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID, ok := meEmployee(w, r)
+	if !ok {
+		return
+	}
+	if _, authed := authenticatedEmployee(ctx); cs.config.PINRequired && !authed {
+		var req reorderRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PIN == "" {
+			http.Error(w, "Your PIN is required", http.StatusUnauthorized)
+			return
+		}
+		if err := cs.verifyPIN(ctx, employeeID, req.PIN); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	f, err := cs.resolveFavourite(ctx, employeeID, mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	cs.placeOrder(w, r, orderRequest{
+		Site:       siteFromContext(ctx),
+		CoffeeType: f.CoffeeType,
+		CoffeeQty:  f.CoffeeQty,
+		EmployeeID: employeeID,
+	})
+}
+
+// usualOrderIntent places the favourite named by the favourite parameter, or
+// the employee's usual if there is none.
+func (cs *coffeeserver) usualOrderIntent(w http.ResponseWriter, r *http.Request, employeeID string, parameters *structpb.Struct) {
+	f, err := cs.resolveFavourite(r.Context(), employeeID, parameters.Fields["favourite"].GetStringValue())
+	if err != nil {
+		fmt.Fprintf(w, "Error processing order: %s", err)
+		return
+	}
+	cs.placeOrder(w, r, orderRequest{
+		Site:       siteFromContext(r.Context()),
+		CoffeeType: f.CoffeeType,
+		CoffeeQty:  f.CoffeeQty,
+		EmployeeID: employeeID,
+	})
+}
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/mongodb/mongo-go-driver/mongo/mongoopt"
+)
+
+// How a group order is paid for.
+const (
+	billingIndividual = "individual" // each participant pays for their own drinks
+	billingOrganiser  = "organiser"  // the organiser pays for everyone's
+	billingCostCentre = "cost_centre"
+)
+
+// Group order statuses.
+const (
+	groupOpen      = "open"
+	groupSubmitted = "submitted"
+	groupCancelled = "cancelled"
+)
+
+// groupOrder is a document in the group orders collection. Employees join an
+// open group with its short code until it closes; each drink is saved as an
+// order held with the group's code, and when the group is submitted the
+// orders go to the barista together as one ticket.
+type groupOrder struct {
+	Code       string `bson:"code" json:"code"`
+	Name       string `bson:"name" json:"name"`
+	Organiser  string `bson:"organiser" json:"organiser"`
+	Site       string `bson:"site,omitempty" json:"site,omitempty"`
+	Billing    string `bson:"billing" json:"billing"`
+	CostCentre string `bson:"costCentre,omitempty" json:"costCentre,omitempty"`
+	ClosesAt   int64  `bson:"closesAt" json:"closesAt"`
+	PickupAt   int64  `bson:"pickupAt,omitempty" json:"pickupAt,omitempty"`
+	Status     string `bson:"status" json:"status"`
+	CreatedAt  int64  `bson:"createdAt" json:"createdAt"`
+	// PickupCode is shared by all the group's orders, which are collected
+	// together.
+	PickupCode string `bson:"pickupCode,omitempty" json:"pickupCode,omitempty"`
+}
+
+// groupCodeAlphabet leaves out letters and digits that are easily confused
+// when read out or typed.
+const groupCodeAlphabet = "ACDEFGHJKMNPQRTVWXY34679"
+
+const groupCodeLength = 4
+
+func newGroupCode() (string, error) {
+	b := make([]byte, groupCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = groupCodeAlphabet[int(b[i])%len(groupCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+func normalizeGroupCode(code string) string {
+	return strings.ToUpper(strings.Replace(code, " ", "", -1))
+}
+
+// findGroup returns the most recent group with the given code.
+func (cs *coffeeserver) findGroup(ctx context.Context, code string) (*groupOrder, error) {
+	var g groupOrder
+	err := cs.withCollection(ctx, cs.config.GroupOrdersCollectionName, "find_group", func(ctx context.Context, groups *mongo.Collection) error {
+		return groups.FindOne(ctx,
+			bson.NewDocument(bson.EC.String("code", normalizeGroupCode(code))),
+			findopt.Sort(bson.NewDocument(bson.EC.Int32("createdAt", -1))),
+		).Decode(&g)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("Sorry, there is no group order %s", code)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// openGroup returns the open group with the given code, if it has not closed.
+func (cs *coffeeserver) openGroup(ctx context.Context, code string) (*groupOrder, error) {
+	g, err := cs.findGroup(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if g.Status != groupOpen || time.Now().Unix() >= g.ClosesAt {
+		return nil, fmt.Errorf("Sorry, group order %s has closed", g.Code)
+	}
+	return g, nil
+}
+
+// groupFilter matches the orders in g. Codes are reused once a group has
+// closed, so orders placed before g was created belong to an earlier group.
+func groupFilter(g *groupOrder, extra ...*bson.Element) *bson.Document {
+	filter := bson.NewDocument(
+		bson.EC.String("group", g.Code),
+		bson.EC.SubDocumentFromElements("time", bson.EC.Int64("$gte", g.CreatedAt)),
+	)
+	return filter.Append(extra...)
+}
+
+// groupOrders returns the orders in a group that have not been refunded.
+func (cs *coffeeserver) groupOrders(ctx context.Context, g *groupOrder, extra ...*bson.Element) ([]coffeeOrder, error) {
+	filter := groupFilter(g, append(extra, bson.EC.SubDocumentFromElements("refunded", bson.EC.Boolean("$ne", true)))...)
+
+	var orders []coffeeOrder
+	err := cs.withCollection(ctx, cs.config.OrdersCollectionName, "list_group_orders", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, filter)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var order coffeeOrder
+			if err := cur.Decode(&order); err != nil {
+				return err
+			}
+			orders = append(orders, order)
+		}
+		return cur.Err()
+	})
+	return orders, err
+}
+
+// setGroupStatus moves an open group to status, returning false if it was no
+// longer open.
+func (cs *coffeeserver) setGroupStatus(ctx context.Context, g *groupOrder, status string) (bool, error) {
+	var updated groupOrder
+	err := cs.withCollection(ctx, cs.config.GroupOrdersCollectionName, "set_group_status", func(ctx context.Context, groups *mongo.Collection) error {
+		return groups.FindOneAndUpdate(ctx,
+			bson.NewDocument(
+				bson.EC.String("code", g.Code),
+				bson.EC.Int64("createdAt", g.CreatedAt),
+				bson.EC.String("status", groupOpen),
+			),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("status", status))),
+			findopt.ReturnDocument(mongoopt.After),
+		).Decode(&updated)
+	})
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	g.Status = status
+	return true, nil
+}
+
+// submitGroup closes a group and sends its orders to the barista: into the
+// queue, or scheduled if the group has a pickup time that is still a while
+// away. Orders of participants who left are refunded and stay held.
+func (cs *coffeeserver) submitGroup(ctx context.Context, g *groupOrder) error {
+	ok, err := cs.setGroupStatus(ctx, g, groupSubmitted)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Group order %s is no longer open", g.Code)
+	}
+	cs.audit(ctx, auditGroupSubmitted, g.Organiser, map[string]interface{}{"group": g.Code})
+
+	now := time.Now().Unix()
+	err = cs.withCollection(ctx, cs.config.OrdersCollectionName, "submit_group", func(ctx context.Context, orders *mongo.Collection) error {
+		_, err := orders.UpdateMany(ctx,
+			groupFilter(g,
+				bson.EC.String("status", statusHeld),
+				bson.EC.SubDocumentFromElements("refunded", bson.EC.Boolean("$ne", true)),
+				bson.EC.SubDocumentFromElements("releaseAt", bson.EC.Int64("$gt", now)),
+			),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("status", statusScheduled))),
+		)
+		if err != nil {
+			return err
+		}
+		_, err = orders.UpdateMany(ctx,
+			groupFilter(g,
+				bson.EC.String("status", statusHeld),
+				bson.EC.SubDocumentFromElements("refunded", bson.EC.Boolean("$ne", true)),
+			),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("status", statusQueued))),
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	queued, err := cs.groupOrders(ctx, g, bson.EC.String("status", statusQueued))
+	if err != nil || len(queued) == 0 {
+		return err
+	}
+	s, err := cs.getSite(ctx, g.Site)
+	if err != nil {
+		return err
+	}
+	cs.printTicket(s, cs.groupTicket(s, g, queued))
+	return nil
+}
+
+// refundGroupOrders refunds the held orders in a group, or only those for one
+// participant if forEmployee is set, and returns how many were refunded.
+func (cs *coffeeserver) refundGroupOrders(ctx context.Context, g *groupOrder, forEmployee string) (int, error) {
+	extra := []*bson.Element{bson.EC.String("status", statusHeld)}
+	if forEmployee != "" {
+		extra = append(extra, bson.EC.String("for", forEmployee))
+	}
+	orders, err := cs.groupOrders(ctx, g, extra...)
+	if err != nil {
+		return 0, err
+	}
+	refunded := 0
+	for _, order := range orders {
+		if _, _, err := cs.refundOrder(ctx, order.ID); err != nil {
+			cs.logger(ctx).WithField("order", order.ID.Hex()).Error("Unable to refund group order: ", err)
+			continue
+		}
+		refunded++
+	}
+	return refunded, nil
+}
+
+// joinGroup adds a participant's drinks to an open group, charging them as
+// the group's billing says.
+func (cs *coffeeserver) joinGroup(ctx context.Context, code, employeeID, coffeeType string, qty int) (*groupOrder, *coffeeOrder, error) {
+	g, err := cs.openGroup(ctx, code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := orderRequest{
+		Site:       g.Site,
+		CoffeeType: coffeeType,
+		CoffeeQty:  qty,
+		EmployeeID: employeeID,
+		Group:      g.Code,
+		PickupCode: g.PickupCode,
+		For:        employeeID,
+	}
+	if g.PickupAt != 0 {
+		req.PickupAt = time.Unix(g.PickupAt, 0)
+	}
+	switch g.Billing {
+	case billingOrganiser:
+		req.EmployeeID = g.Organiser
+	case billingCostCentre:
+		req.EmployeeID = g.Organiser
+		req.CostCentre = g.CostCentre
+	}
+	order, err := cs.saveOrder(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The group may have been submitted or cancelled while the order was
+	// being saved; if so the order would be held forever.
+	if current, err := cs.findGroup(ctx, g.Code); err != nil || current.Status != groupOpen {
+		cs.refundOrder(ctx, order.ID)
+		return nil, nil, fmt.Errorf("Sorry, group order %s has closed", g.Code)
+	}
+	return g, order, nil
+}
+
+type groupRequest struct {
+	Name       string `json:"name"`
+	Billing    string `json:"billing"`
+	CostCentre string `json:"costCentre"`
+	Minutes    int    `json:"minutes"`  // how long the group stays open
+	PickupAt   string `json:"pickupAt"` // optional, RFC 3339 or HH:MM:SS
+}
+
+// groupsHandler creates a group order organised by the caller.
+func (cs *coffeeserver) groupsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	organiser, ok := meEmployee(w, r)
+	if !ok {
+		return
+	}
+	var req groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	g := groupOrder{
+		Name:      req.Name,
+		Organiser: organiser,
+		Site:      siteFromContext(ctx),
+		Billing:   req.Billing,
+		ClosesAt:  now.Add(cs.config.GroupWindow).Unix(),
+		Status:    groupOpen,
+		CreatedAt: now.Unix(),
+	}
+	if req.Minutes > 0 {
+		g.ClosesAt = now.Add(time.Duration(req.Minutes) * time.Minute).Unix()
+	}
+	switch g.Billing {
+	case "":
+		g.Billing = billingIndividual
+	case billingIndividual, billingOrganiser:
+	case billingCostCentre:
+		p := principalFromContext(ctx)
+		if !p.can(permManageSubsidy) {
+			http.Error(w, "You can't charge group orders to a cost centre", http.StatusForbidden)
+			return
+		}
+		if _, err := cs.getCostCentre(ctx, req.CostCentre); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		g.CostCentre = req.CostCentre
+	default:
+		http.Error(w, fmt.Sprintf("billing must be %s, %s or %s", billingIndividual, billingOrganiser, billingCostCentre), http.StatusBadRequest)
+		return
+	}
+	if req.PickupAt != "" {
+		pickup, err := parsePickupTime(req.PickupAt, cs.storeTime(now))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if pickup.Unix() < g.ClosesAt {
+			http.Error(w, "pickupAt must be after the group closes", http.StatusBadRequest)
+			return
+		}
+		g.PickupAt = pickup.Unix()
+	}
+
+	pickupDay := cs.storeTime(now)
+	if g.PickupAt != 0 {
+		pickupDay = cs.storeTime(time.Unix(g.PickupAt, 0))
+	}
+	var err error
+	if g.PickupCode, err = cs.nextPickupCode(ctx, g.Site, pickupDay); err != nil {
+		cs.logger(ctx).Error("Unable to allocate pickup code: ", err)
+	}
+
+	// Codes only need to be unique among open groups.
+	for attempt := 0; ; attempt++ {
+		code, err := newGroupCode()
+		if err != nil || attempt == 5 {
+			http.Error(w, "Unable to create group order", http.StatusInternalServerError)
+			return
+		}
+		if existing, err := cs.findGroup(ctx, code); err == nil && existing.Status == groupOpen {
+			continue
+		}
+		g.Code = code
+		break
+	}
+
+	err = cs.withCollection(ctx, cs.config.GroupOrdersCollectionName, "insert_group", func(ctx context.Context, groups *mongo.Collection) error {
+		_, err := groups.InsertOne(ctx, &g)
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to create group order: ", err)
+		http.Error(w, "Unable to create group order", http.StatusInternalServerError)
+		return
+	}
+	cs.audit(ctx, auditGroupCreated, organiser, map[string]interface{}{"group": g.Code, "billing": g.Billing, "costCentre": g.CostCentre})
+	writeJSON(w, http.StatusCreated, g)
+}
+
+// groupItem is one participant's drinks as shown in a group order.
+type groupItem struct {
+	Order      string `json:"order"`
+	For        string `json:"for"`
+	CoffeeType string `json:"coffeetype"`
+	CoffeeQty  int    `json:"coffeeqty"`
+	Status     string `json:"status"`
+}
+
+// groupHandler shows (GET) or cancels (DELETE) a group order. Cancelling
+// refunds everyone and is only allowed for the organiser while the group is
+// open.
+func (cs *coffeeserver) groupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	g, err := cs.findGroup(ctx, mux.Vars(r)["code"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if !cs.authorizeOrganiser(w, r, g) {
+			return
+		}
+		ok, err := cs.setGroupStatus(ctx, g, groupCancelled)
+		if err != nil {
+			cs.logger(ctx).Error("Unable to cancel group order: ", err)
+			http.Error(w, "Unable to cancel group order", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Group order is no longer open", http.StatusConflict)
+			return
+		}
+		cs.audit(ctx, auditGroupCancelled, g.Organiser, map[string]interface{}{"group": g.Code})
+		refunded, err := cs.refundGroupOrders(ctx, g, "")
+		if err != nil {
+			cs.logger(ctx).Error("Unable to refund group order: ", err)
+			http.Error(w, "Group order cancelled but its orders could not be refunded", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"code": g.Code, "status": g.Status, "refunded": refunded})
+		return
+	}
+
+	orders, err := cs.groupOrders(ctx, g)
+	if err != nil {
+		cs.logger(ctx).Error("Unable to list group orders: ", err)
+		http.Error(w, "Unable to list group orders", http.StatusInternalServerError)
+		return
+	}
+	items := []groupItem{}
+	drinks := 0
+	for _, order := range orders {
+		items = append(items, groupItem{Order: order.ID.Hex(), For: order.For, CoffeeType: order.CoffeeType, CoffeeQty: order.CoffeeQty, Status: order.Status})
+		drinks += order.CoffeeQty
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"group": g, "items": items, "drinks": drinks})
+}
+
+// authorizeOrganiser checks that the caller organised the group or may manage
+// accounts.
+func (cs *coffeeserver) authorizeOrganiser(w http.ResponseWriter, r *http.Request, g *groupOrder) bool {
+	p := principalFromContext(r.Context())
+	if employeeID, _ := identifiedEmployee(r.Context()); employeeID != g.Organiser && !p.can(permManageAccounts) {
+		http.Error(w, "Only the organiser can do that", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+type joinGroupRequest struct {
+	CoffeeType string `json:"coffeetype"`
+	CoffeeQty  int    `json:"coffeeqty"`
+	PIN        string `json:"pin"`
+}
+
+// groupItemsHandler adds the caller's drinks to an open group (POST) or takes
+// them out again, refunding them (DELETE).
+func (cs *coffeeserver) groupItemsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID, ok := meEmployee(w, r)
+	if !ok {
+		return
+	}
+	code := mux.Vars(r)["code"]
+
+	if r.Method == http.MethodDelete {
+		g, err := cs.openGroup(ctx, code)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		refunded, err := cs.refundGroupOrders(ctx, g, employeeID)
+		if err != nil {
+			cs.logger(ctx).Error("Unable to refund group order: ", err)
+			http.Error(w, "Unable to leave group order", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"code": g.Code, "refunded": refunded})
+		return
+	}
+
+	var req joinGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.CoffeeQty < 1 {
+		req.CoffeeQty = 1
+	}
+	if _, authed := authenticatedEmployee(ctx); cs.config.PINRequired && !authed {
+		if err := cs.verifyPIN(ctx, employeeID, req.PIN); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	g, order, err := cs.joinGroup(ctx, code, employeeID, req.CoffeeType, req.CoffeeQty)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"code":       g.Code,
+		"order":      order.ID.Hex(),
+		"pickupCode": order.PickupCode,
+		"amount":     order.EmployeeAmount,
+		"currency":   cs.config.Currency,
+	})
+}
+
+// submitGroupHandler lets the organiser send a group to the barista before it
+// closes.
+func (cs *coffeeserver) submitGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	g, err := cs.findGroup(ctx, mux.Vars(r)["code"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !cs.authorizeOrganiser(w, r, g) {
+		return
+	}
+	if err := cs.submitGroup(ctx, g); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, g)
+}
+
+// groupStatusHandler moves all of a group's orders on to a later status, for
+// baristas working from the group's single ticket.
+func (cs *coffeeserver) groupStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	g, err := cs.findGroup(ctx, mux.Vars(r)["code"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var req orderStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	earlier, err := earlierStatuses(req.Status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var modified int64
+	err = cs.withCollection(ctx, cs.config.OrdersCollectionName, "set_group_status", func(ctx context.Context, orders *mongo.Collection) error {
+		res, err := orders.UpdateMany(ctx,
+			groupFilter(g, bson.EC.SubDocumentFromElements("status", bson.EC.Array("$in", earlier))),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set",
+				bson.EC.String("status", req.Status),
+				bson.EC.Int64(req.Status+"At", time.Now().Unix()),
+			)),
+		)
+		if err == nil {
+			modified = res.ModifiedCount
+		}
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to set group status: ", err)
+		http.Error(w, "Unable to set group status", http.StatusInternalServerError)
+		return
+	}
+	if modified == 0 {
+		http.Error(w, "Group is already "+req.Status, http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"group": g.Code, "status": req.Status, "orders": modified})
+}
+
+// joinGroupIntent adds drinks to a group order by voice, from the groupCode,
+// coffee and quantity parameters.
+func (cs *coffeeserver) joinGroupIntent(w http.ResponseWriter, r *http.Request, employeeID string, parameters *structpb.Struct) {
+	ctx := r.Context()
+	g, err := cs.findGroup(ctx, parameters.Fields["groupCode"].GetStringValue())
+	if err != nil {
+		fmt.Fprintf(w, "Error joining group order: %s", err)
+		return
+	}
+	coffeeType, err := cs.drinkParameter(ctx, g.Site, parameters.Fields["coffee"])
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	qty, err := cs.quantityParameter(parameters.Fields["quantity"])
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	g, order, err := cs.joinGroup(ctx, g.Code, employeeID, coffeeType, qty)
+	if err != nil {
+		fmt.Fprintf(w, "Error joining group order: %s", err)
+		return
+	}
+	recordTurnOrder(r.Context(), order)
+	cs.endBadgeSession(r.Context())
+	fmt.Fprintf(w, "OK, adding %d %s to %s", qty, coffeeType, g.Name)
+	if order.EmployeeAmount > 0 {
+		fmt.Fprintf(w, ", charging account %s %s", order.EmployeeID, cs.formatMoney(order.EmployeeAmount))
+	}
+}
+
+// closeExpiredGroups submits open groups whose time is up, or cancels them if
+// nobody joined.
+func (cs *coffeeserver) closeExpiredGroups(ctx context.Context) {
+	var expired []groupOrder
+	err := cs.withCollection(ctx, cs.config.GroupOrdersCollectionName, "list_expired_groups", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, bson.NewDocument(
+			bson.EC.String("status", groupOpen),
+			bson.EC.SubDocumentFromElements("closesAt", bson.EC.Int64("$lte", time.Now().Unix())),
+		))
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var g groupOrder
+			if err := cur.Decode(&g); err != nil {
+				return err
+			}
+			expired = append(expired, g)
+		}
+		return cur.Err()
+	})
+	if err != nil {
+		cs.log.Error("Unable to list expired group orders: ", err)
+		return
+	}
+
+	for i := range expired {
+		g := &expired[i]
+		log := cs.log.WithField("group", g.Code)
+		orders, err := cs.groupOrders(ctx, g)
+		if err != nil {
+			log.Error("Unable to list group orders: ", err)
+			continue
+		}
+		if len(orders) == 0 {
+			if _, err := cs.setGroupStatus(ctx, g, groupCancelled); err != nil {
+				log.Error("Unable to cancel empty group order: ", err)
+			}
+			continue
+		}
+		if err := cs.submitGroup(ctx, g); err != nil {
+			log.Warn("Unable to submit group order: ", err)
+			continue
+		}
+		log.WithField("orders", len(orders)).Info("Submitted group order")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+)
+
+// healthzHandler reports that the process is alive and serving requests.
+func (cs *coffeeserver) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+// readyzHandler reports whether the server can take orders: MongoDB must
+// answer a ping and the Dialogflow credentials must be loaded.
+func (cs *coffeeserver) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := cs.pingMongo(r.Context()); err != nil {
+		cs.log.Warn("Readiness check failed: ", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if _, err := cs.getDialogFlowSessionsClient(); err != nil {
+		cs.log.Warn("Readiness check failed: ", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprint(w, "ok")
+}
+
+func (cs *coffeeserver) pingMongo(ctx context.Context) error {
+	if cs.mongo == nil {
+		return fmt.Errorf("No mongodb connection configured")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cs.config.DBTimeout)
+	defer cancel()
+
+	if _, err := cs.mongo.Database(cs.config.DBName).RunCommand(ctx, bson.NewDocument(bson.EC.Int32("ping", 1))); err != nil {
+		return fmt.Errorf("Unable to ping mongodb: %s", err)
+	}
+	return nil
+}
+
+// close releases the Dialogflow and MongoDB clients.
+func (cs *coffeeserver) close(ctx context.Context) {
+	cs.dialogflowMu.Lock()
+	if cs.dialogflowSessionsClient != nil {
+		if err := cs.dialogflowSessionsClient.Close(); err != nil {
+			cs.log.Error("Error closing dialogflow sessionClient: ", err)
+		}
+		cs.dialogflowSessionsClient = nil
+	}
+	cs.dialogflowMu.Unlock()
+
+	if cs.mongo != nil {
+		ctx, cancel := context.WithTimeout(ctx, cs.config.DBTimeout)
+		defer cancel()
+
+		if err := cs.mongo.Disconnect(ctx); err != nil {
+			cs.log.Error("Error closing mongodb connection: ", err)
+		}
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// Order history page sizes.
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// orderSummary is one order in an employee's order history.
+type orderSummary struct {
+	ID         string  `json:"id"`
+	Time       int64   `json:"time"`
+	Site       string  `json:"site,omitempty"`
+	CoffeeType string  `json:"coffeetype"`
+	CoffeeQty  int     `json:"coffeeqty"`
+	Charged    float64 `json:"charged"`
+	Status     string  `json:"status,omitempty"`
+	PickupCode string  `json:"pickupCode,omitempty"`
+	Refunded   bool    `json:"refunded,omitempty"`
+}
+
+func summarizeOrder(order *coffeeOrder) orderSummary {
+	return orderSummary{
+		ID:         order.ID.Hex(),
+		Time:       order.Time,
+		Site:       order.Site,
+		CoffeeType: order.CoffeeType,
+		CoffeeQty:  order.CoffeeQty,
+		Charged:    order.EmployeeAmount,
+		Status:     order.Status,
+		PickupCode: order.PickupCode,
+		Refunded:   order.Refunded,
+	}
+}
+
+// findOrders returns the orders charged to an employee that match the extra
+// filter elements, newest first.
+func (cs *coffeeserver) findOrders(ctx context.Context, employeeID string, extra []*bson.Element, opts ...findopt.Find) ([]coffeeOrder, error) {
+	filter := bson.NewDocument(bson.EC.String("employeeId", employeeID))
+	filter.Append(extra...)
+	opts = append([]findopt.Find{findopt.Sort(bson.NewDocument(bson.EC.Int32("time", -1)))}, opts...)
+
+	var orders []coffeeOrder
+	err := cs.withCollection(ctx, cs.config.OrdersCollectionName, "list_employee_orders", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, filter, opts...)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var order coffeeOrder
+			if err := cur.Decode(&order); err != nil {
+				return err
+			}
+			orders = append(orders, order)
+		}
+		return cur.Err()
+	})
+	return orders, err
+}
+
+// myOrdersHandler lists the caller's orders, newest first, a page at a time
+// (limit and page parameters) between the optional from and to dates
+// (YYYY-MM-DD, store time, inclusive).
+func (cs *coffeeserver) myOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID, ok := meEmployee(w, r)
+	if !ok {
+		return
+	}
+
+	limit, page := defaultHistoryLimit, 1
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "page must be at least 1", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+	var extra []*bson.Element
+	timeRange, err := cs.reportTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if timeRange != nil {
+		extra = append(extra, timeRange)
+	}
+
+	// One more than a page is read to tell whether there is another page.
+	orders, err := cs.findOrders(ctx, employeeID, extra,
+		findopt.Skip(int64((page-1)*limit)),
+		findopt.Limit(int64(limit+1)),
+	)
+	if err != nil {
+		cs.logger(ctx).Error("Unable to list orders: ", err)
+		http.Error(w, "Unable to list orders", http.StatusInternalServerError)
+		return
+	}
+	more := len(orders) > limit
+	if more {
+		orders = orders[:limit]
+	}
+	summaries := []orderSummary{}
+	for i := range orders {
+		summaries = append(summaries, summarizeOrder(&orders[i]))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"orders": summaries,
+		"page":   page,
+		"limit":  limit,
+		"more":   more,
+	})
+}
+
+// receiptLine is one line of a receipt.
+type receiptLine struct {
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+// receipt is what an employee was charged for an order and how it was paid.
+type receipt struct {
+	Order      string          `json:"order"`
+	Time       int64           `json:"time"`
+	Site       string          `json:"site,omitempty"`
+	PickupCode string          `json:"pickupCode,omitempty"`
+	Items      []receiptLine   `json:"items"`
+	Discounts  []orderDiscount `json:"discounts,omitempty"`
+	Total      float64         `json:"total"`
+	Subsidy    *orderSubsidy   `json:"subsidy,omitempty"`
+	Charged    float64         `json:"charged"`
+	Charge     *accountCharge  `json:"payment,omitempty"`
+	Refunded   bool            `json:"refunded,omitempty"`
+	RefundedAt int64           `json:"refundedAt,omitempty"`
+	Currency   string          `json:"currency"`
+}
+
+func (cs *coffeeserver) orderReceipt(order *coffeeOrder) *receipt {
+	item := fmt.Sprintf("%d x %s", order.CoffeeQty, order.CoffeeType)
+	if order.UnitPrice > 0 {
+		item += " @ " + cs.formatMoney(order.UnitPrice)
+	}
+	return &receipt{
+		Order:      order.ID.Hex(),
+		Time:       order.Time,
+		Site:       order.Site,
+		PickupCode: order.PickupCode,
+		Items:      []receiptLine{{Description: item, Amount: order.Subtotal}},
+		Discounts:  order.Discounts,
+		Total:      float64(order.Amount),
+		Subsidy:    order.Subsidy,
+		Charged:    order.EmployeeAmount,
+		Charge:     order.Charge,
+		Refunded:   order.Refunded,
+		RefundedAt: order.RefundedAt,
+		Currency:   cs.config.Currency,
+	}
+}
+
+// text renders the receipt for download.
+func (rc *receipt) text(cs *coffeeserver) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Receipt for order %s\n", rc.Order)
+	fmt.Fprintf(&b, "%s", cs.storeTime(time.Unix(rc.Time, 0)).Format("2006-01-02 15:04"))
+	if rc.Site != "" {
+		fmt.Fprintf(&b, " at %s", rc.Site)
+	}
+	fmt.Fprintln(&b)
+	if rc.PickupCode != "" {
+		fmt.Fprintf(&b, "Pickup #%s\n", rc.PickupCode)
+	}
+	fmt.Fprintln(&b)
+	for _, item := range rc.Items {
+		fmt.Fprintf(&b, "%-30s %12s\n", item.Description, cs.formatMoney(item.Amount))
+	}
+	for _, d := range rc.Discounts {
+		fmt.Fprintf(&b, "%-30s %12s\n", d.Name, cs.formatMoney(-d.Amount))
+	}
+	fmt.Fprintf(&b, "%-30s %12s\n", "Total", cs.formatMoney(rc.Total))
+	if rc.Subsidy != nil {
+		fmt.Fprintf(&b, "%-30s %12s\n", "Paid by "+rc.Subsidy.CostCentre, cs.formatMoney(-rc.Subsidy.Amount))
+	}
+	fmt.Fprintf(&b, "%-30s %12s\n", "Charged to you", cs.formatMoney(rc.Charged))
+	if rc.Charge != nil {
+		if rc.Charge.FromAllowance > 0 {
+			fmt.Fprintf(&b, "%-30s %12s\n", "  from allowance", cs.formatMoney(rc.Charge.FromAllowance))
+		}
+		fmt.Fprintf(&b, "%-30s %12s\n", "Balance before", cs.formatMoney(rc.Charge.BalanceBefore))
+		fmt.Fprintf(&b, "%-30s %12s\n", "Balance after", cs.formatMoney(rc.Charge.BalanceAfter))
+	}
+	if rc.Refunded {
+		fmt.Fprintf(&b, "\nRefunded %s\n", cs.storeTime(time.Unix(rc.RefundedAt, 0)).Format("2006-01-02 15:04"))
+	}
+	return b.String()
+}
+
+// myOrderHandler shows the receipt for one of the caller's orders, as JSON or,
+// with format=text, as a plain text download.
+func (cs *coffeeserver) myOrderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID, ok := meEmployee(w, r)
+	if !ok {
+		return
+	}
+	id, err := objectid.FromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Unknown order", http.StatusNotFound)
+		return
+	}
+	orders, err := cs.findOrders(ctx, employeeID, []*bson.Element{bson.EC.ObjectID("_id", id)})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to find order: ", err)
+		http.Error(w, "Unable to find order", http.StatusInternalServerError)
+		return
+	}
+	if len(orders) == 0 {
+		http.Error(w, "Unknown order", http.StatusNotFound)
+		return
+	}
+
+	rc := cs.orderReceipt(&orders[0])
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"receipt-%s.txt\"", rc.Order))
+		fmt.Fprint(w, rc.text(cs))
+		return
+	}
+	writeJSON(w, http.StatusOK, rc)
+}
+
+// statement is an employee's orders and refunds for a calendar month.
+type statement struct {
+	EmployeeID string         `json:"employeeId"`
+	Month      string         `json:"month"`
+	Orders     []orderSummary `json:"orders"`
+	Charged    float64        `json:"charged"`
+	Refunded   float64        `json:"refunded"`
+	Opening    *float64       `json:"openingBalance,omitempty"`
+	Closing    *float64       `json:"closingBalance,omitempty"`
+	Currency   string         `json:"currency"`
+}
+
+// monthRange returns the start and end of a YYYY-MM month in store time.
+func (cs *coffeeserver) monthRange(month string) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01", month, cs.config.location)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("month must be YYYY-MM")
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// monthlyStatement builds an employee's statement for a YYYY-MM month. The
+// opening and closing balances come from the first and last orders charged
+// to the account that month, so they are left out for months without any.
+func (cs *coffeeserver) monthlyStatement(ctx context.Context, employeeID, month string) (*statement, error) {
+	start, end, err := cs.monthRange(month)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := cs.findOrders(ctx, employeeID, []*bson.Element{
+		bson.EC.SubDocumentFromElements("time",
+			bson.EC.Int64("$gte", start.Unix()),
+			bson.EC.Int64("$lt", end.Unix()),
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st := &statement{EmployeeID: employeeID, Month: month, Orders: []orderSummary{}, Currency: cs.config.Currency}
+	// Statements list orders oldest first.
+	for i := len(orders) - 1; i >= 0; i-- {
+		order := &orders[i]
+		st.Orders = append(st.Orders, summarizeOrder(order))
+		st.Charged += order.EmployeeAmount
+		if order.Refunded {
+			st.Refunded += order.EmployeeAmount
+		}
+		if order.Charge != nil {
+			if st.Opening == nil {
+				st.Opening = &order.Charge.BalanceBefore
+			}
+			st.Closing = &order.Charge.BalanceAfter
+		}
+	}
+	return st, nil
+}
+
+// text renders the statement for download or email.
+func (st *statement) text(cs *coffeeserver) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Coffee statement for %s, %s\n\n", st.EmployeeID, st.Month)
+	if st.Opening != nil {
+		fmt.Fprintf(&b, "%-30s %12s\n\n", "Opening balance", cs.formatMoney(*st.Opening))
+	}
+	if len(st.Orders) == 0 {
+		fmt.Fprintln(&b, "No orders this month.")
+	}
+	for _, o := range st.Orders {
+		line := fmt.Sprintf("%s %d x %s", cs.storeTime(time.Unix(o.Time, 0)).Format("02 Jan 15:04"), o.CoffeeQty, o.CoffeeType)
+		if o.Refunded {
+			line += " (refunded)"
+		}
+		fmt.Fprintf(&b, "%-30s %12s\n", line, cs.formatMoney(o.Charged))
+	}
+	fmt.Fprintln(&b)
+	fmt.Fprintf(&b, "%-30s %12s\n", "Charged", cs.formatMoney(st.Charged))
+	fmt.Fprintf(&b, "%-30s %12s\n", "Refunded", cs.formatMoney(-st.Refunded))
+	fmt.Fprintf(&b, "%-30s %12s\n", "Net", cs.formatMoney(st.Charged-st.Refunded))
+	if st.Closing != nil {
+		fmt.Fprintf(&b, "\n%-30s %12s\n", "Balance after last order", cs.formatMoney(*st.Closing))
+	}
+	return b.String()
+}
+
+// statementHandler shows the caller's statement for a month, as JSON or, with
+// format=text, as a plain text download.
+func (cs *coffeeserver) statementHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID, ok := meEmployee(w, r)
+	if !ok {
+		return
+	}
+	st, err := cs.monthlyStatement(ctx, employeeID, mux.Vars(r)["month"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"statement-%s.txt\"", st.Month))
+		fmt.Fprint(w, st.text(cs))
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// emailStatementHandler emails the caller their statement for a month.
+func (cs *coffeeserver) emailStatementHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID, ok := meEmployee(w, r)
+	if !ok {
+		return
+	}
+	if cs.config.SMTPAddress == "" {
+		http.Error(w, "Email is not set up", http.StatusNotImplemented)
+		return
+	}
+	account, err := cs.getAccount(ctx, employeeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	to := cs.statementAddress(account)
+	if to == "" {
+		http.Error(w, "There is no email address for your account", http.StatusConflict)
+		return
+	}
+	st, err := cs.monthlyStatement(ctx, employeeID, mux.Vars(r)["month"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := cs.sendStatement(to, st); err != nil {
+		cs.logger(ctx).Error("Unable to email statement: ", err)
+		http.Error(w, "Unable to email statement", http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"month": st.Month, "sentTo": to})
+}
+
+// statementAddress returns where an account's statements are emailed: its
+// email address, or the employee ID at statements.email_domain.
+func (cs *coffeeserver) statementAddress(account *employeeAccount) string {
+	if account.Email != "" {
+		return account.Email
+	}
+	if cs.config.StatementsEmailDomain != "" {
+		return account.EmployeeID + "@" + cs.config.StatementsEmailDomain
+	}
+	return ""
+}
+
+func (cs *coffeeserver) sendStatement(to string, st *statement) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cs.config.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: Your coffee statement for %s\r\n", st.Month)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(st.text(cs), "\n", "\r\n", -1))
+
+	var auth smtp.Auth
+	if cs.config.SMTPUsername != "" {
+		host := cs.config.SMTPAddress
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", cs.config.SMTPUsername, cs.config.SMTPPassword, host)
+	}
+	return smtp.SendMail(cs.config.SMTPAddress, auth, cs.config.SMTPFrom, []string{to}, msg.Bytes())
+}
+
+// sendMonthlyStatements emails last month's statement to each employee who
+// ordered anything, once. Accounts are claimed by setting statementMonth, so
+// only one instance sends each statement, and released again if it could not
+// be sent so that it is tried again next time.
+func (cs *coffeeserver) sendMonthlyStatements(ctx context.Context) {
+	if cs.config.SMTPAddress == "" {
+		return
+	}
+	now := cs.storeTime(time.Now())
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, -1, 0).Format("2006-01")
+
+	var accounts []employeeAccount
+	err := cs.withCollection(ctx, cs.config.AccountsCollectionName, "list_statement_accounts", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, bson.NewDocument(
+			bson.EC.SubDocumentFromElements("statementMonth", bson.EC.String("$ne", month)),
+		))
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var account employeeAccount
+			if err := cur.Decode(&account); err != nil {
+				return err
+			}
+			accounts = append(accounts, account)
+		}
+		return cur.Err()
+	})
+	if err != nil {
+		cs.log.Error("Unable to list accounts for statements: ", err)
+		return
+	}
+
+	for i := range accounts {
+		account := &accounts[i]
+		log := cs.log.WithField("employeeID", account.EmployeeID)
+		var claimed int64
+		err := cs.withCollection(ctx, cs.config.AccountsCollectionName, "claim_statement", func(ctx context.Context, coll *mongo.Collection) error {
+			res, err := coll.UpdateOne(ctx,
+				bson.NewDocument(
+					bson.EC.String("employeeId", account.EmployeeID),
+					bson.EC.SubDocumentFromElements("statementMonth", bson.EC.String("$ne", month)),
+				),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("statementMonth", month))),
+			)
+			if err == nil {
+				claimed = res.ModifiedCount
+			}
+			return err
+		})
+		if err != nil || claimed == 0 {
+			continue
+		}
+
+		to := cs.statementAddress(account)
+		if to == "" {
+			continue
+		}
+		st, err := cs.monthlyStatement(ctx, account.EmployeeID, month)
+		if err != nil {
+			log.Error("Unable to build statement: ", err)
+			cs.releaseStatement(ctx, account, month)
+			continue
+		}
+		if len(st.Orders) == 0 {
+			continue
+		}
+		if err := cs.sendStatement(to, st); err != nil {
+			log.Error("Unable to email statement: ", err)
+			cs.releaseStatement(ctx, account, month)
+			continue
+		}
+		log.WithField("month", month).Info("Emailed statement")
+	}
+}
+
+// releaseStatement undoes sendMonthlyStatements' claim on an account's
+// statement for month, putting back the month it was last sent for.
+func (cs *coffeeserver) releaseStatement(ctx context.Context, account *employeeAccount, month string) {
+	update := bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("statementMonth", account.StatementMonth)))
+	if account.StatementMonth == "" {
+		update = bson.NewDocument(bson.EC.SubDocumentFromElements("$unset", bson.EC.String("statementMonth", "")))
+	}
+	err := cs.withCollection(ctx, cs.config.AccountsCollectionName, "release_statement", func(ctx context.Context, coll *mongo.Collection) error {
+		_, err := coll.UpdateOne(ctx,
+			bson.NewDocument(
+				bson.EC.String("employeeId", account.EmployeeID),
+				bson.EC.String("statementMonth", month),
+			),
+			update,
+		)
+		return err
+	})
+	if err != nil {
+		cs.log.WithField("employeeID", account.EmployeeID).Error("Unable to release statement: ", err)
+	}
+}
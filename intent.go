@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dialogflowpb "google.golang.org/genproto/googleapis/cloud/dialogflow/v2"
+)
+
+// parseIntentConfidence parses per-intent confidence thresholds given as
+// "intent=0.7,other-intent=0.6".
+func parseIntentConfidence(s string) (map[string]float64, error) {
+	thresholds := map[string]float64{}
+	for _, item := range splitList(s) {
+		eq := strings.LastIndex(item, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("%q must be intent=threshold", item)
+		}
+		intent := strings.TrimSpace(item[:eq])
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(item[eq+1:]), 64)
+		if intent == "" || err != nil || threshold < 0 || threshold > 1 {
+			return nil, fmt.Errorf("%q must be intent=threshold with a threshold between 0 and 1", item)
+		}
+		thresholds[intent] = threshold
+	}
+	return thresholds, nil
+}
+
+// intentThreshold returns the confidence below which a match of intent is
+// not trusted.
+func (cs *coffeeserver) intentThreshold(intent string) float64 {
+	if threshold, ok := cs.config.intentConfidence[intent]; ok {
+		return threshold
+	}
+	return cs.config.DialogflowMinConfidence
+}
+
+func (cs *coffeeserver) isFallbackIntent(intent *dialogflowpb.Intent) bool {
+	return intent.GetIsFallback() || (cs.config.DialogflowFallbackIntent != "" && intent.GetDisplayName() == cs.config.DialogflowFallbackIntent)
+}
+
+// checkIntent decides whether what Dialogflow made of a request can be acted
+// on. It re-prompts when Dialogflow did not understand or was not confident
+// enough, and refuses requests matching an intent we have no handler for
+// that Dialogflow has not answered itself. If it returns false it has
+// already replied.
+func (cs *coffeeserver) checkIntent(w http.ResponseWriter, r *http.Request, result *dialogflowpb.QueryResult) bool {
+	log := cs.logger(r.Context())
+	intent := result.GetIntent().GetDisplayName()
+	confidence := float64(result.GetIntentDetectionConfidence())
+
+	switch {
+	case result.GetIntent() == nil || cs.isFallbackIntent(result.GetIntent()):
+		log.Info("Dialogflow did not understand: ", result.GetQueryText())
+		recordIntent(intent, "fallback")
+		if text := result.GetFulfillmentText(); text != "" {
+			fmt.Fprint(w, text)
+		} else {
+			fmt.Fprint(w, "Sorry, I didn't understand that. You can say something like \"two lattes please\"")
+		}
+		return false
+
+	case confidence < cs.intentThreshold(intent):
+		log.WithField("intent", intent).Info("Intent matched with low confidence: ", confidence)
+		recordIntent(intent, "low_confidence")
+		if text := result.GetQueryText(); text != "" {
+			fmt.Fprintf(w, "Sorry, I'm not sure I understood %q. Could you say that again?", text)
+		} else {
+			fmt.Fprint(w, "Sorry, I'm not sure I understood. Could you say that again?")
+		}
+		return false
+
+	case result.GetFulfillmentText() == "" && result.AllRequiredParamsPresent && !cs.handlesIntent(intent):
+		log.WithField("intent", intent).Warn("No handler for intent")
+		recordIntent(intent, "unhandled")
+		fmt.Fprint(w, "Sorry, I can't help with that here")
+		return false
+	}
+	recordIntent(intent, "accepted")
+	return true
+}
+
+// handlesIntent reports whether we act on intent once Dialogflow has all its
+// parameters: ordering a drink or one of intentHandlers.
+func (cs *coffeeserver) handlesIntent(intent string) bool {
+	if intent == cs.config.DialogflowOrderIntent {
+		return true
+	}
+	_, ok := cs.intentHandlers()[intent]
+	return ok
+}
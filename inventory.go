@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/mongodb/mongo-go-driver/mongo/mongoopt"
+	"github.com/mongodb/mongo-go-driver/mongo/replaceopt"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+)
+
+// ingredient is a document in the ingredients collection.
+type ingredient struct {
+	Name              string  `bson:"name" json:"name"`
+	Unit              string  `bson:"unit" json:"unit"`
+	Stock             float64 `bson:"stock" json:"stock"`
+	LowStockThreshold float64 `bson:"lowStockThreshold" json:"lowStockThreshold"`
+}
+
+func (i *ingredient) low() bool {
+	return i.Stock < i.LowStockThreshold
+}
+
+type recipeItem struct {
+	Ingredient string  `bson:"ingredient" json:"ingredient"`
+	Quantity   float64 `bson:"quantity" json:"quantity"`
+}
+
+// recipe is a document in the recipes collection listing the ingredients
+// used to make one drink. Drinks without a recipe are not stock tracked.
+type recipe struct {
+	Drink       string       `bson:"drink" json:"drink"`
+	Ingredients []recipeItem `bson:"ingredients" json:"ingredients"`
+}
+
+// unavailableError is returned when a drink cannot be made. Its message can
+// be read back to the employee.
+type unavailableError struct {
+	drink, ingredient string
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("Sorry, we have run out of %s so we can't make %s right now", e.ingredient, e.drink)
+}
+
+func (cs *coffeeserver) getRecipe(ctx context.Context, drink string) (*recipe, error) {
+	var r recipe
+	err := cs.withCollection(ctx, cs.config.RecipesCollectionName, "find_recipe", func(ctx context.Context, recipes *mongo.Collection) error {
+		return recipes.FindOne(ctx, bson.NewDocument(bson.EC.String("drink", drink))).Decode(&r)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (cs *coffeeserver) listIngredients(ctx context.Context) ([]ingredient, error) {
+	var ingredients []ingredient
+	err := cs.withCollection(ctx, cs.config.IngredientsCollectionName, "list_ingredients", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, bson.NewDocument())
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var i ingredient
+			if err := cur.Decode(&i); err != nil {
+				return err
+			}
+			ingredients = append(ingredients, i)
+		}
+		return cur.Err()
+	})
+	return ingredients, err
+}
+
+// reserveStock deducts the ingredients for qty drinks from stock. Each
+// deduction is conditional on there being enough stock, and if any ingredient
+// runs short the deductions already made are restored and an
+// unavailableError is returned. The caller must restore the returned items if
+// the order later fails.
+func (cs *coffeeserver) reserveStock(ctx context.Context, drink string, qty int) ([]recipeItem, error) {
+	r, err := cs.getRecipe(ctx, drink)
+	if err != nil || r == nil {
+		return nil, err
+	}
+
+	var reserved []recipeItem
+	for _, item := range r.Ingredients {
+		need := item.Quantity * float64(qty)
+		var updated ingredient
+		err := cs.withCollection(ctx, cs.config.IngredientsCollectionName, "deduct_stock", func(ctx context.Context, ingredients *mongo.Collection) error {
+			return ingredients.FindOneAndUpdate(ctx,
+				bson.NewDocument(
+					bson.EC.String("name", item.Ingredient),
+					bson.EC.SubDocumentFromElements("stock", bson.EC.Double("$gte", need)),
+				),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Double("stock", -need))),
+				findopt.ReturnDocument(mongoopt.After),
+			).Decode(&updated)
+		})
+		if err != nil {
+			cs.restoreStock(ctx, reserved)
+			if err == mongo.ErrNoDocuments {
+				return nil, &unavailableError{drink: drink, ingredient: item.Ingredient}
+			}
+			return nil, err
+		}
+		reserved = append(reserved, recipeItem{Ingredient: item.Ingredient, Quantity: need})
+
+		recordIngredientStock(updated.Name, updated.Stock)
+		if updated.low() && updated.Stock+need >= updated.LowStockThreshold {
+			cs.lowStockAlert(ctx, &updated)
+		}
+	}
+	return reserved, nil
+}
+
+// restoreStock puts back stock reserved for an order that failed.
+func (cs *coffeeserver) restoreStock(ctx context.Context, items []recipeItem) {
+	for _, item := range items {
+		err := cs.withCollection(ctx, cs.config.IngredientsCollectionName, "restore_stock", func(ctx context.Context, ingredients *mongo.Collection) error {
+			_, err := ingredients.UpdateOne(ctx,
+				bson.NewDocument(bson.EC.String("name", item.Ingredient)),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Double("stock", item.Quantity))),
+			)
+			return err
+		})
+		if err != nil {
+			cs.logger(ctx).WithField("ingredient", item.Ingredient).Error("Unable to restore stock: ", err)
+		}
+	}
+}
+
+// lowStockAlert reports an ingredient that has just dropped below its low
+// stock threshold, in the log and, if configured, to the alert webhook as a
+// Slack-style {"text": ...} message.
+func (cs *coffeeserver) lowStockAlert(ctx context.Context, i *ingredient) {
+	text := fmt.Sprintf("Low stock: %s is down to %g %s", i.Name, i.Stock, i.Unit)
+	cs.logger(ctx).WithFields(logrus.Fields{"ingredient": i.Name, "stock": i.Stock}).Warn(text)
+
+	if cs.config.InventoryAlertWebhook == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"text": text})
+	go func() {
+		client := http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(cs.config.InventoryAlertWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			cs.log.Error("Unable to send low stock alert: ", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			cs.log.Error("Low stock alert webhook returned ", resp.Status)
+		}
+	}()
+}
+
+// unavailableDrinks returns the drinks whose recipes cannot currently be made,
+// mapped to the first ingredient they are short of.
+func (cs *coffeeserver) unavailableDrinks(ctx context.Context) (map[string]string, error) {
+	ingredients, err := cs.listIngredients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stock := map[string]float64{}
+	for _, i := range ingredients {
+		stock[i.Name] = i.Stock
+	}
+
+	unavailable := map[string]string{}
+	err = cs.withCollection(ctx, cs.config.RecipesCollectionName, "list_recipes", func(ctx context.Context, recipes *mongo.Collection) error {
+		cur, err := recipes.Find(ctx, bson.NewDocument())
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var r recipe
+			if err := cur.Decode(&r); err != nil {
+				return err
+			}
+			for _, item := range r.Ingredients {
+				if stock[item.Ingredient] < item.Quantity {
+					unavailable[r.Drink] = item.Ingredient
+					break
+				}
+			}
+		}
+		return cur.Err()
+	})
+	return unavailable, err
+}
+
+type menuItem struct {
+	Drink       string  `json:"drink"`
+	Price       float64 `json:"price"`
+	Available   bool    `json:"available"`
+	Unavailable string  `json:"unavailableReason,omitempty"`
+}
+
+// menuHandler lists the drinks served at the caller's site with their prices
+// and whether they can be made.
+func (cs *coffeeserver) menuHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	site, err := cs.getSite(ctx, siteFromContext(ctx))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	unavailable, err := cs.unavailableDrinks(ctx)
+	if err != nil {
+		cs.logger(ctx).Error("Unable to check stock: ", err)
+	}
+
+	drinks := siteMenu(site)
+	menu := make([]menuItem, 0, len(drinks))
+	for drink, price := range drinks {
+		item := menuItem{Drink: drink, Price: price, Available: true}
+		if ingredient, ok := unavailable[drink]; ok {
+			item.Available = false
+			item.Unavailable = "Out of " + ingredient
+		}
+		menu = append(menu, item)
+	}
+	sort.Slice(menu, func(i, j int) bool { return menu[i].Drink < menu[j].Drink })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"site":     siteFromContext(ctx),
+		"open":     cs.siteOpen(site, cs.storeTime(time.Now())),
+		"currency": cs.config.Currency,
+		"drinks":   menu,
+	})
+}
+
+// inventoryHandler lists the ingredients and their stock.
+func (cs *coffeeserver) inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	ingredients, err := cs.listIngredients(r.Context())
+	if err != nil {
+		cs.logger(r.Context()).Error("Unable to list ingredients: ", err)
+		http.Error(w, "Unable to list ingredients", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, ingredients)
+}
+
+func (cs *coffeeserver) getIngredient(ctx context.Context, name string) (*ingredient, error) {
+	var i ingredient
+	err := cs.withCollection(ctx, cs.config.IngredientsCollectionName, "find_ingredient", func(ctx context.Context, ingredients *mongo.Collection) error {
+		return ingredients.FindOne(ctx, bson.NewDocument(bson.EC.String("name", name))).Decode(&i)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("Unknown ingredient %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+// ingredientHandler shows (GET) or creates and updates (PUT) an ingredient,
+// including its stock level.
+func (cs *coffeeserver) ingredientHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["ingredient"]
+
+	if r.Method == http.MethodPut {
+		var req ingredient
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Stock < 0 || req.LowStockThreshold < 0 {
+			http.Error(w, "stock and lowStockThreshold must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		err := cs.withCollection(ctx, cs.config.IngredientsCollectionName, "set_ingredient", func(ctx context.Context, ingredients *mongo.Collection) error {
+			_, err := ingredients.UpdateOne(ctx,
+				bson.NewDocument(bson.EC.String("name", name)),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$set",
+					bson.EC.String("unit", req.Unit),
+					bson.EC.Double("stock", req.Stock),
+					bson.EC.Double("lowStockThreshold", req.LowStockThreshold),
+				)),
+				updateopt.Upsert(true),
+			)
+			return err
+		})
+		if err != nil {
+			cs.logger(ctx).Error("Unable to set ingredient: ", err)
+			http.Error(w, "Unable to set ingredient", http.StatusInternalServerError)
+			return
+		}
+		recordIngredientStock(name, req.Stock)
+		cs.audit(ctx, auditInventoryChanged, "", map[string]interface{}{"ingredient": name, "stock": req.Stock})
+	}
+
+	i, err := cs.getIngredient(ctx, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, i)
+}
+
+type restockRequest struct {
+	Quantity float64 `json:"quantity"`
+}
+
+// restockHandler adds a delivery to an ingredient's stock.
+func (cs *coffeeserver) restockHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["ingredient"]
+
+	var req restockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Quantity <= 0 {
+		http.Error(w, "A positive quantity is required", http.StatusBadRequest)
+		return
+	}
+
+	var updated ingredient
+	err := cs.withCollection(ctx, cs.config.IngredientsCollectionName, "restock", func(ctx context.Context, ingredients *mongo.Collection) error {
+		return ingredients.FindOneAndUpdate(ctx,
+			bson.NewDocument(bson.EC.String("name", name)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Double("stock", req.Quantity))),
+			findopt.ReturnDocument(mongoopt.After),
+		).Decode(&updated)
+	})
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, fmt.Sprintf("Unknown ingredient %s", name), http.StatusNotFound)
+		return
+	} else if err != nil {
+		cs.logger(ctx).Error("Unable to restock: ", err)
+		http.Error(w, "Unable to restock", http.StatusInternalServerError)
+		return
+	}
+	recordIngredientStock(updated.Name, updated.Stock)
+	cs.audit(ctx, auditInventoryChanged, "", map[string]interface{}{"ingredient": name, "restocked": req.Quantity})
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// recipesHandler lists the recipes.
+func (cs *coffeeserver) recipesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var recipes []recipe
+	err := cs.withCollection(ctx, cs.config.RecipesCollectionName, "list_recipes", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, bson.NewDocument())
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var r recipe
+			if err := cur.Decode(&r); err != nil {
+				return err
+			}
+			recipes = append(recipes, r)
+		}
+		return cur.Err()
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to list recipes: ", err)
+		http.Error(w, "Unable to list recipes", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, recipes)
+}
+
+// recipeHandler creates or replaces (PUT) or removes (DELETE) a drink's
+// recipe.
+func (cs *coffeeserver) recipeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	drink := mux.Vars(r)["drink"]
+
+	if r.Method == http.MethodDelete {
+		cs.deleteDocument(w, r, cs.config.RecipesCollectionName, "drink", drink, auditInventoryChanged)
+		return
+	}
+
+	var req recipe
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Drink = drink
+	if known, err := cs.knownDrink(ctx, drink); err != nil {
+		cs.logger(ctx).Error("Unable to list sites: ", err)
+		http.Error(w, "Unable to set recipe", http.StatusInternalServerError)
+		return
+	} else if !known {
+		http.Error(w, "Unknown coffee type", http.StatusBadRequest)
+		return
+	}
+	for _, item := range req.Ingredients {
+		if item.Quantity <= 0 {
+			http.Error(w, "Ingredient quantities must be positive", http.StatusBadRequest)
+			return
+		}
+		if _, err := cs.getIngredient(ctx, item.Ingredient); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := cs.withCollection(ctx, cs.config.RecipesCollectionName, "set_recipe", func(ctx context.Context, recipes *mongo.Collection) error {
+		_, err := recipes.ReplaceOne(ctx, bson.NewDocument(bson.EC.String("drink", drink)), &req, replaceopt.Upsert(true))
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to set recipe: ", err)
+		http.Error(w, "Unable to set recipe", http.StatusInternalServerError)
+		return
+	}
+	cs.audit(ctx, auditInventoryChanged, "", map[string]interface{}{"recipe": drink})
+	writeJSON(w, http.StatusOK, req)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type logEntryKey struct{}
+
+type requestIDKey struct{}
+
+// logger returns the request-scoped log entry stored in ctx by
+// loggingHandler, or an entry on the server's logger if there is none.
+func (cs *coffeeserver) logger(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(logEntryKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(cs.log)
+}
+
+// requestID returns the caller-supplied X-Request-ID if it looks sane, or a
+// newly generated one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 128 {
+		valid := true
+		for _, c := range id {
+			if c < 0x21 || c > 0x7e {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return id
+		}
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func (cs *coffeeserver) loggingHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+
+		fields := logrus.Fields{"requestID": id, "Method": r.Method, "URI": r.RequestURI}
+		if span := trace.FromContext(r.Context()); span != nil {
+			fields["traceID"] = span.SpanContext().TraceID.String()
+		}
+		entry := cs.log.WithFields(fields)
+
+		entry.Info("Handling request")
+		sr := &statusRecorder{ResponseWriter: w}
+		ctx := context.WithValue(r.Context(), logEntryKey{}, entry)
+		ctx = context.WithValue(ctx, requestIDKey{}, id)
+		handler(sr, r.WithContext(ctx))
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		entry.WithFields(logrus.Fields{
+			"status":     sr.status,
+			"bytes":      sr.bytes,
+			"durationMs": milliseconds(start),
+		}).Info("Finished handling request")
+	}
+}
+
+// setLogFormat switches the logger to the given output format.
+func setLogFormat(log *logrus.Logger, format string) {
+	if format == "json" {
+		log.Formatter = &logrus.JSONFormatter{}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+// Loyalty stamps: every drink paid for earns a stamp, and once an employee has
+// collected loyalty.free_drink_every - 1 stamps their next drink is free and
+// uses them up. So with the default of 10, every 10th drink is free.
+
+func (cs *coffeeserver) stampsPerReward() int {
+	return cs.config.LoyaltyFreeDrinkEvery - 1
+}
+
+func (cs *coffeeserver) loyaltyEnabled() bool {
+	return cs.config.LoyaltyFreeDrinkEvery > 1
+}
+
+// loyaltyStamps is the effect of an order on an employee's stamp card.
+type loyaltyStamps struct {
+	FreeDrinks int
+	Earned     int
+	Redeemed   int
+	Before     int
+	After      int
+}
+
+// planStamps works through an order of drinks one at a time, giving a free
+// drink whenever a full card's worth of stamps has been collected.
+func planStamps(stamps, drinks, perReward int) loyaltyStamps {
+	l := loyaltyStamps{Before: stamps}
+	for i := 0; i < drinks; i++ {
+		if stamps >= perReward {
+			stamps -= perReward
+			l.FreeDrinks++
+			l.Redeemed += perReward
+		} else {
+			stamps++
+			l.Earned++
+		}
+	}
+	l.After = stamps
+	return l
+}
+
+// applyLoyalty updates the employee's stamp card for an order and discounts
+// any free drinks from quote. The card update is conditional on the stamps
+// read, so concurrent orders cannot redeem the same stamps. It returns nil if
+// loyalty is disabled or the card could not be updated, in which case the
+// order is priced without it.
+func (cs *coffeeserver) applyLoyalty(ctx context.Context, employeeID string, qty int, quote *priceQuote) *loyaltyStamps {
+	if !cs.loyaltyEnabled() {
+		return nil
+	}
+	log := cs.logger(ctx).WithField("employeeID", employeeID)
+
+	for attempt := 0; attempt < chargeAttempts; attempt++ {
+		account, err := cs.getAccount(ctx, employeeID)
+		if err != nil {
+			return nil
+		}
+		l := planStamps(account.Stamps, qty, cs.stampsPerReward())
+
+		// Accounts created before loyalty stamps have no stamps field.
+		filter := bson.NewDocument(bson.EC.String("employeeId", employeeID))
+		if account.Stamps == 0 {
+			filter.Append(bson.EC.SubDocumentFromElements("stamps",
+				bson.EC.Array("$in", bson.NewArray(bson.VC.Int32(0), bson.VC.Null()))))
+		} else {
+			filter.Append(bson.EC.Int32("stamps", int32(account.Stamps)))
+		}
+
+		var modified int64
+		err = cs.withCollection(ctx, cs.config.AccountsCollectionName, "update_stamps", func(ctx context.Context, accounts *mongo.Collection) error {
+			res, err := accounts.UpdateOne(ctx, filter, bson.NewDocument(
+				bson.EC.SubDocumentFromElements("$set", bson.EC.Int32("stamps", int32(l.After))),
+			))
+			if err == nil {
+				modified = res.ModifiedCount
+			}
+			return err
+		})
+		if err != nil {
+			log.Error("Unable to update loyalty stamps: ", err)
+			return nil
+		}
+		if modified != 1 {
+			continue
+		}
+
+		if l.FreeDrinks > 0 {
+			amount := roundMoney(math.Min(float64(l.FreeDrinks)*quote.UnitPrice, quote.Total))
+			quote.Discounts = append(quote.Discounts, orderDiscount{Name: "Loyalty reward", Kind: "loyalty", Amount: amount})
+			quote.Total = roundMoney(quote.Total - amount)
+		}
+		log.WithFields(logrus.Fields{"stamps": l.After, "freeDrinks": l.FreeDrinks}).Info("Updated loyalty stamps")
+		return &l
+	}
+
+	log.Warn("Unable to update loyalty stamps: too many concurrent updates")
+	return nil
+}
+
+// reverseStamps undoes an order's effect on the employee's stamp card, when
+// the order fails or is refunded. Stamps earned are taken back and stamps
+// redeemed are returned. Stamps earned may already have been spent, so the
+// card is clamped at zero rather than going negative.
+func (cs *coffeeserver) reverseStamps(ctx context.Context, employeeID string, earned, redeemed int) {
+	if earned == redeemed {
+		return
+	}
+	err := cs.updateAccount(ctx, employeeID, "reverse_stamps", bson.NewDocument(
+		bson.EC.SubDocumentFromElements("$inc", bson.EC.Int32("stamps", int32(redeemed-earned))),
+	))
+	if err == nil && earned > redeemed {
+		cs.updateAccount(ctx, employeeID, "clamp_stamps", bson.NewDocument(
+			bson.EC.SubDocumentFromElements("$max", bson.EC.Int32("stamps", 0)),
+		))
+	}
+}
+
+// describeStamps tells the employee how far they are from a free drink.
+func (cs *coffeeserver) describeStamps(stamps int) string {
+	toGo := cs.stampsPerReward() - stamps
+	switch {
+	case toGo <= 0:
+		return "Your next drink is free!"
+	case toGo == 1:
+		return "You have 1 stamp to go until your free drink."
+	}
+	return fmt.Sprintf("You have %d stamps to go until your free drink.", toGo)
+}
@@ -6,51 +6,48 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/mongodb/mongo-go-driver/bson"
-
 	dialogflow "cloud.google.com/go/dialogflow/apiv2"
 	"github.com/Sirupsen/logrus"
 	structpb "github.com/golang/protobuf/ptypes/struct"
 	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
 	"github.com/mongodb/mongo-go-driver/mongo"
 	"google.golang.org/api/option"
 	dialogflowpb "google.golang.org/genproto/googleapis/cloud/dialogflow/v2"
 )
 
-var (
-	verbose         bool
-	tls             bool
-	certFilename    string
-	certKeyFilename string
-	listenAddr      string
-	mongoConnString string
-)
-
-const (
-	dbName                 = "coffee-demo"
-	ordersCollectionName   = "orders"
-	accountsCollectionName = "employeeAccounts"
-	dbTimeout              = 5 * time.Second
-)
-
 type coffeeserver struct {
-	log *logrus.Logger
+	log    *logrus.Logger
+	config *config
 
 	// Dialogflow-related
+	dialogflowMu             sync.Mutex
 	dialogflowSessionsClient *dialogflow.SessionsClient
 	ctx                      context.Context
-	languageCode             string
-	projectID                string
-	sessionID                string
 
 	// MongoDB
 	mongo *mongo.Client
+
+	// Authentication
+	jwks          *jwksCache
+	testIssuer    *testIssuer
+	badgeSessions *badgeSessions
+
+	// Wait time estimation
+	prepModels *prepModels
 }
 
 func (cs *coffeeserver) getDialogFlowSessionsClient() (*dialogflow.SessionsClient, error) {
+	cs.dialogflowMu.Lock()
+	defer cs.dialogflowMu.Unlock()
+
 	if cs.dialogflowSessionsClient != nil {
 		cs.log.Debug("Using existing dialogdlow sessionClient")
 		return cs.dialogflowSessionsClient, nil
@@ -60,7 +57,7 @@ func (cs *coffeeserver) getDialogFlowSessionsClient() (*dialogflow.SessionsClien
 
 	cs.ctx = context.Background()
 
-	dialogflowSessionsClient, err := dialogflow.NewSessionsClient(cs.ctx, option.WithCredentialsFile("keys/dialogflowclient-key.json"))
+	dialogflowSessionsClient, err := dialogflow.NewSessionsClient(cs.ctx, option.WithCredentialsFile(cs.config.DialogflowKeyFile))
 	if err != nil {
 		cs.log.Error("Error creating dialogflow sessionClient: ", err)
 		return nil, fmt.Errorf("Error creating dialogflow sessionClient: %s", err)
@@ -68,140 +65,295 @@ func (cs *coffeeserver) getDialogFlowSessionsClient() (*dialogflow.SessionsClien
 
 	cs.dialogflowSessionsClient = dialogflowSessionsClient
 	return cs.dialogflowSessionsClient, nil
-	// defer sessionClient.Close()
 }
 
+// coffeeOrder is a document in the orders collection. Amount is the order
+// total after Discounts, of which the employee pays EmployeeAmount and any
+// subsidy is charged to a cost centre.
 type coffeeOrder struct {
-	ID         string  `bson:"_id,omitempty" json:"_id,omitempty"`
-	CoffeeType string  `bson:"coffeetype" json:"coffeetype"`
-	CoffeeQty  int     `bson:"coffeeqty" json:"coffeeqty"`
-	EmployeeID string  `bson:"employeeId" json:"employeeId"`
-	Amount     float32 `bson:"amount" json:"amount"`
+	ID             objectid.ObjectID `bson:"_id" json:"-"`
+	Site           string            `bson:"site,omitempty" json:"site,omitempty"`
+	CoffeeType     string            `bson:"coffeetype" json:"coffeetype"`
+	CoffeeQty      int               `bson:"coffeeqty" json:"coffeeqty"`
+	EmployeeID     string            `bson:"employeeId" json:"employeeId"`
+	Group          string            `bson:"group,omitempty" json:"group,omitempty"`
+	For            string            `bson:"for,omitempty" json:"for,omitempty"`
+	UnitPrice      float64           `bson:"unitPrice" json:"unitPrice"`
+	Subtotal       float64           `bson:"subtotal" json:"subtotal"`
+	Discounts      []orderDiscount   `bson:"discounts,omitempty" json:"discounts,omitempty"`
+	Coupon         string            `bson:"coupon,omitempty" json:"coupon,omitempty"`
+	Amount         float32           `bson:"amount" json:"amount"`
+	EmployeeAmount float64           `bson:"employeeAmount" json:"employeeAmount"`
+	Subsidy        *orderSubsidy     `bson:"subsidy,omitempty" json:"subsidy,omitempty"`
+	Charge         *accountCharge    `bson:"charge,omitempty" json:"charge,omitempty"`
+	StampsEarned   int               `bson:"stampsEarned,omitempty" json:"stampsEarned,omitempty"`
+	StampsRedeemed int               `bson:"stampsRedeemed,omitempty" json:"stampsRedeemed,omitempty"`
+	Time           int64             `bson:"time" json:"time"`
+	Refunded       bool              `bson:"refunded,omitempty" json:"refunded,omitempty"`
+	RefundedAt     int64             `bson:"refundedAt,omitempty" json:"refundedAt,omitempty"`
+	Status         string            `bson:"status,omitempty" json:"status,omitempty"`
+	PreparingAt    int64             `bson:"preparingAt,omitempty" json:"preparingAt,omitempty"`
+	ReadyAt        int64             `bson:"readyAt,omitempty" json:"readyAt,omitempty"`
+	CollectedAt    int64             `bson:"collectedAt,omitempty" json:"collectedAt,omitempty"`
+	PickupAt       int64             `bson:"pickupAt,omitempty" json:"pickupAt,omitempty"`
+	ReleaseAt      int64             `bson:"releaseAt,omitempty" json:"releaseAt,omitempty"`
+	PickupCode     string            `bson:"pickupCode,omitempty" json:"pickupCode,omitempty"`
+
+	loyalty *loyaltyStamps
 }
 
-func (cs *coffeeserver) getCoffeePrice(coffeeType string) (float32, error) {
-	prices := map[string]float32{
-		"latte":      3.50,
-		"espresso":   3.0,
-		"long black": 3.50,
-	}
+// coffeePrices is the standard menu: the drinks we make and their prices at
+// sites without a menu of their own.
+var coffeePrices = map[string]float32{
+	"latte":      3.50,
+	"espresso":   3.0,
+	"long black": 3.50,
+}
 
-	if price, ok := prices[coffeeType]; ok {
-		return price, nil
-	}
-	return 0, fmt.Errorf("Unknown coffee type")
+// orderRequest is what an employee has asked for.
+type orderRequest struct {
+	Site       string
+	CoffeeType string
+	CoffeeQty  int
+	EmployeeID string
+	Coupon     string
+	PickupAt   time.Time // zero for as soon as possible
+
+	// For group orders: the group's code and pickup number, who the drink is
+	// for and, if the group is paid for by a cost centre, its code.
+	Group      string
+	PickupCode string
+	For        string
+	CostCentre string
 }
 
-func (cs *coffeeserver) chargeAccount(employeeID string, amount float32) error {
-	cs.log.WithFields(logrus.Fields{"employeeID": employeeID, "amount": amount}).Info("Charging account")
+func (cs *coffeeserver) saveOrder(ctx context.Context, req orderRequest) (*coffeeOrder, error) {
+	coffeeType, coffeeQty, employeeID, siteCode := req.CoffeeType, req.CoffeeQty, req.EmployeeID, req.Site
+	log := cs.logger(ctx)
+	log.WithFields(logrus.Fields{"coffeeType": coffeeType, "coffeeQty": coffeeQty, "employeeID": employeeID, "coupon": req.Coupon}).Info("Saving order")
 
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-	accountsCollection := cs.mongo.Database(dbName).Collection(accountsCollectionName)
+	site, err := cs.getSite(ctx, siteCode)
+	if err != nil {
+		log.Error("Unable to find site: ", err)
+		return nil, fmt.Errorf("Saving order failed: %s", err)
+	}
+	if _, err := drinkPrice(site, coffeeType); err != nil {
+		recordOrderDeclined(siteCode, coffeeType)
+		return nil, err
+	}
+	if err := cs.checkQuantity(coffeeQty); err != nil {
+		recordOrderDeclined(siteCode, coffeeType)
+		return nil, err
+	}
+	pickup, err := cs.schedulePickup(site, req.PickupAt)
+	if err != nil {
+		recordOrderDeclined(siteCode, coffeeType)
+		return nil, err
+	}
 
-	res, err := accountsCollection.UpdateOne(ctx,
-		bson.NewDocument(
-			bson.EC.String("employeeId", employeeID),
-			bson.EC.SubDocumentFromElements("balance", bson.EC.Double("$gt", float64(amount))),
-		),
-		bson.NewDocument(
-			bson.EC.SubDocumentFromElements("$inc", bson.EC.Double("balance", -float64(amount))),
-		),
-	)
+	stock, err := cs.reserveStock(ctx, coffeeType, coffeeQty)
+	if unavailable, ok := err.(*unavailableError); ok {
+		recordOrderDeclined(siteCode, coffeeType)
+		return nil, unavailable
+	} else if err != nil {
+		log.Error("Unable to check stock: ", err)
+		return nil, fmt.Errorf("Saving order failed: %s", err)
+	}
 
-	if err != nil || res.ModifiedCount != 1 {
-		cs.log.Error("Unable to charge account: ", err)
-		return fmt.Errorf("Unable to charge account %s %f: %v", employeeID, amount, err)
+	quote, err := cs.priceOrder(ctx, site, coffeeType, coffeeQty, req.Coupon)
+	if err != nil {
+		cs.restoreStock(ctx, stock)
+		log.Error("Saving order failed: ", err)
+		return nil, fmt.Errorf("Saving order failed: %s", err)
 	}
 
-	return nil
-}
+	var loyalty *loyaltyStamps
+	var subsidy *orderSubsidy
+	if req.CostCentre != "" {
+		// Orders paid for in full by a cost centre leave the employee's
+		// account and stamp card alone.
+		if err := cs.debitCostCentre(ctx, req.CostCentre, quote.Total); err != nil {
+			cs.releaseCoupon(ctx, quote.Coupon)
+			cs.restoreStock(ctx, stock)
+			recordOrderDeclined(siteCode, coffeeType)
+			return nil, fmt.Errorf("Payment declined - %s", err)
+		}
+		subsidy = &orderSubsidy{CostCentre: req.CostCentre, Rule: "group " + req.Group, Amount: quote.Total}
+	} else {
+		loyalty = cs.applyLoyalty(ctx, employeeID, coffeeQty, quote)
+		subsidy = cs.applySubsidy(ctx, employeeID, coffeeQty, quote.Total)
+	}
 
-func (cs *coffeeserver) saveOrder(coffeeType string, coffeeQty int, employeeID string) error {
-	cs.log.WithFields(logrus.Fields{"coffeeType": coffeeType, "coffeeQty": coffeeQty, "employeeID": employeeID}).Info("Saving order")
+	amount := float32(quote.Total)
+	employeeAmount := quote.Total
+	if subsidy != nil {
+		employeeAmount -= subsidy.Amount
+	}
 
-	price, err := cs.getCoffeePrice(coffeeType)
-	if err != nil {
-		cs.log.Error("Saving order failed: ", err)
-		return fmt.Errorf("Saving order failed: %s", err)
+	var charge *accountCharge
+	// unwind gives back everything taken for the order when it cannot be
+	// completed.
+	unwind := func() {
+		if charge != nil {
+			cs.refundCharge(ctx, employeeID, charge)
+		}
+		if loyalty != nil {
+			cs.reverseStamps(ctx, employeeID, loyalty.Earned, loyalty.Redeemed)
+		}
+		cs.refundSubsidy(ctx, subsidy)
+		cs.releaseCoupon(ctx, quote.Coupon)
+		cs.restoreStock(ctx, stock)
 	}
 
-	amount := price * float32(coffeeQty)
-	err = cs.chargeAccount(employeeID, amount)
+	if req.CostCentre == "" {
+		charge, err = cs.chargeAccount(ctx, employeeID, coffeeQty, float32(employeeAmount))
+	}
 	if err != nil {
-		cs.log.Error("Saving order failed: ", err)
-		return fmt.Errorf("Payment declined - insufficient funds")
+		unwind()
+	}
+	if declined, ok := err.(*declineError); ok {
+		recordOrderDeclined(siteCode, coffeeType)
+		return nil, fmt.Errorf("Payment declined - %s", declined)
+	} else if err == errAccountNotFound {
+		recordOrderDeclined(siteCode, coffeeType)
+		return nil, err
+	} else if err != nil {
+		log.Error("Saving order failed: ", err)
+		return nil, fmt.Errorf("Unable to charge account, please try again")
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-	ordersCollection := cs.mongo.Database(dbName).Collection(ordersCollectionName)
 
 	order := coffeeOrder{
-		CoffeeType: coffeeType,
-		CoffeeQty:  coffeeQty,
-		Amount:     amount,
+		ID:             objectid.New(),
+		Site:           siteCode,
+		CoffeeType:     coffeeType,
+		CoffeeQty:      coffeeQty,
+		EmployeeID:     employeeID,
+		Group:          req.Group,
+		For:            req.For,
+		UnitPrice:      quote.UnitPrice,
+		Subtotal:       quote.Subtotal,
+		Discounts:      quote.Discounts,
+		Coupon:         quote.Coupon,
+		Amount:         amount,
+		EmployeeAmount: employeeAmount,
+		Subsidy:        subsidy,
+		Charge:         charge,
+		Time:           time.Now().Unix(),
+		Status:         statusQueued,
+		loyalty:        loyalty,
+	}
+	if loyalty != nil {
+		order.StampsEarned, order.StampsRedeemed = loyalty.Earned, loyalty.Redeemed
+	}
+	if !pickup.IsZero() {
+		order.Status = statusScheduled
+		order.PickupAt = pickup.Unix()
+		order.ReleaseAt = pickup.Add(-cs.config.OrdersScheduleLead).Unix()
+	}
+	if req.Group != "" {
+		// Held until the group is submitted, then made together.
+		order.Status = statusHeld
+	}
+	order.PickupCode = req.PickupCode
+	if order.PickupCode == "" {
+		day := cs.storeTime(time.Now())
+		if !pickup.IsZero() {
+			day = pickup
+		}
+		// An order without a pickup number can still be called out by name.
+		if order.PickupCode, err = cs.nextPickupCode(ctx, siteCode, day); err != nil {
+			log.Error("Unable to allocate pickup code: ", err)
+		}
 	}
 
-	if _, err := ordersCollection.InsertOne(ctx, &order); err != nil {
-		cs.log.Error("Saving order failed: ", err)
-		return fmt.Errorf("Saving order failed: %s", err)
+	err = cs.withCollection(ctx, cs.config.OrdersCollectionName, "insert_order", func(ctx context.Context, orders *mongo.Collection) error {
+		_, err := orders.InsertOne(ctx, &order)
+		return err
+	})
+	if err != nil {
+		log.Error("Saving order failed: ", err)
+		unwind()
+		return nil, fmt.Errorf("Saving order failed: %s", err)
 	}
 
-	return nil
+	recordOrderPlaced(siteCode, coffeeType, amount)
+	if subsidy != nil {
+		recordSubsidy(subsidy.CostCentre, subsidy.Amount)
+	}
+	if order.Status == statusQueued {
+		cs.printTicket(site, cs.orderTicket(site, &order))
+	}
+	return &order, nil
 
 }
 
 func (cs *coffeeserver) orderHandlerAudio(r *http.Request) *dialogflowpb.DetectIntentRequest {
+	log := cs.logger(r.Context())
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		cs.log.Error("Unable to get audio bytes")
+		log.Error("Unable to get audio bytes")
 		return nil
 	}
+	if turn := turnFromContext(r.Context()); turn != nil {
+		turn.Audio = body
+	}
 
-	cs.log.Debug("Sending audio samples to dialogflow to detect intent")
+	log.Debug("Sending audio samples to dialogflow to detect intent")
 
-	sessionPath := fmt.Sprintf("projects/%s/agent/sessions/%s", cs.projectID, cs.sessionID)
+	sessionPath := fmt.Sprintf("projects/%s/agent/sessions/%s", cs.config.DialogflowProjectID, cs.dialogflowSessionID(r.Context()))
 
 	// In this example, we hard code the encoding and sample rate for simplicity.
-	audioConfig := dialogflowpb.InputAudioConfig{AudioEncoding: dialogflowpb.AudioEncoding_AUDIO_ENCODING_LINEAR_16, LanguageCode: cs.languageCode}
+	audioConfig := dialogflowpb.InputAudioConfig{AudioEncoding: dialogflowpb.AudioEncoding_AUDIO_ENCODING_LINEAR_16, LanguageCode: cs.config.DialogflowLanguageCode}
 
 	queryAudioInput := dialogflowpb.QueryInput_AudioConfig{AudioConfig: &audioConfig}
 
 	queryInput := dialogflowpb.QueryInput{Input: &queryAudioInput}
-	request := dialogflowpb.DetectIntentRequest{Session: sessionPath, QueryInput: &queryInput, InputAudio: body}
+	request := dialogflowpb.DetectIntentRequest{Session: sessionPath, QueryInput: &queryInput, InputAudio: body, QueryParams: cs.dialogflowQueryParams(r.Context(), sessionPath)}
 
 	return &request
 }
 
 func (cs *coffeeserver) orderHandlerText(r *http.Request) *dialogflowpb.DetectIntentRequest {
+	log := cs.logger(r.Context())
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		cs.log.Error("Unable to get audio bytes")
+		log.Error("Unable to get audio bytes")
 		return nil
 	}
 
-	cs.log.Debug("Sending text to dialogflow to detect intent")
+	log.Debug("Sending text to dialogflow to detect intent")
 
-	sessionPath := fmt.Sprintf("projects/%s/agent/sessions/%s", cs.projectID, cs.sessionID)
+	sessionPath := fmt.Sprintf("projects/%s/agent/sessions/%s", cs.config.DialogflowProjectID, cs.dialogflowSessionID(r.Context()))
 
-	textInput := dialogflowpb.TextInput{Text: string(body), LanguageCode: cs.languageCode}
+	textInput := dialogflowpb.TextInput{Text: string(body), LanguageCode: cs.config.DialogflowLanguageCode}
 	queryTextInput := dialogflowpb.QueryInput_Text{Text: &textInput}
 	queryInput := dialogflowpb.QueryInput{Input: &queryTextInput}
-	request := dialogflowpb.DetectIntentRequest{Session: sessionPath, QueryInput: &queryInput}
+	request := dialogflowpb.DetectIntentRequest{Session: sessionPath, QueryInput: &queryInput, QueryParams: cs.dialogflowQueryParams(r.Context(), sessionPath)}
 
 	return &request
 }
 
 func (cs *coffeeserver) orderHandler(w http.ResponseWriter, r *http.Request) {
+	log := cs.logger(r.Context())
 	var request *dialogflowpb.DetectIntentRequest
 
 	contentType := r.Header.Get("Content-Type")
+	input := "text"
+	if contentType == "audio/wav" {
+		input = "audio"
+	}
+	w, r, saveTurn := cs.startTurn(w, r, input)
+	defer saveTurn()
+
 	if contentType == "audio/wav" {
 		request = cs.orderHandlerAudio(r)
 	} else if contentType == "text/plain" {
 		request = cs.orderHandlerText(r)
 	}
+	if request == nil {
+		http.Error(w, "Orders must be audio/wav or text/plain", http.StatusBadRequest)
+		return
+	}
 
 	sessionClient, err := cs.getDialogFlowSessionsClient()
 	if err != nil {
@@ -209,83 +361,264 @@ func (cs *coffeeserver) orderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := sessionClient.DetectIntent(cs.ctx, request)
+	// The Google API transport installs the ocgrpc client handler, so passing
+	// the request context makes the DetectIntent RPC a child of the server span.
+	start := time.Now()
+	response, err := sessionClient.DetectIntent(r.Context(), request)
+	recordDialogflowCall(start, err)
 	if err != nil {
 		http.Error(w, "Error calling dialogflow service", http.StatusInternalServerError)
-		cs.log.Error("Error calling dialogflow service: ", err)
+		log.Error("Error calling dialogflow service: ", err)
 		return
 	}
 
 	queryResult := response.GetQueryResult()
 	fulfillmentText := queryResult.GetFulfillmentText()
 	parameters := queryResult.GetParameters()
+	turnFromContext(r.Context()).recordQueryResult(queryResult)
+
+	log.Info("Fulfillment text from dialogflow: ", fulfillmentText)
+	log.Info("Parameters from dialogflow: ", withoutPIN(parameters))
 
-	cs.log.Info("Fulfillment text from dialogflow: ", fulfillmentText)
-	cs.log.Info("Parameters from dialogflow: ", parameters)
+	if !cs.checkIntent(w, r, queryResult) {
+		return
+	}
 
 	if fulfillmentText == "" && queryResult.AllRequiredParamsPresent {
-		coffeeType := parameters.Fields["coffee"].GetStringValue()
-		employeeID := parameters.Fields["employeeId"].GetStringValue()
-		qtyField := parameters.Fields["quantity"]
-
-		var coffeeQty int
-
-		switch qtyField.GetKind().(type) {
-		case *structpb.Value_NumberValue:
-			coffeeQty = int(parameters.Fields["quantity"].GetNumberValue())
-		case *structpb.Value_StringValue:
-			coffeeQty, _ = strconv.Atoi(parameters.Fields["quantity"].GetStringValue())
-		default:
-			cs.log.Error("Unrecognised type for quantity field", qtyField.GetKind())
-			http.Error(w, "Unrecognised type for quantity field", http.StatusInternalServerError)
+		employeeID, ok := cs.confirmEmployee(w, r, parameters)
+		if !ok {
+			return
+		}
+		if intent, ok := cs.intentHandlers()[queryResult.GetIntent().GetDisplayName()]; ok {
+			intent(w, r, employeeID, parameters)
 			return
 		}
 
-		if err := cs.saveOrder(coffeeType, coffeeQty, employeeID); err != nil {
-			fmt.Fprintf(w, "Error processing order: %s", err)
+		// checkIntent has made sure anything else is the order intent.
+		coffeeType, err := cs.drinkParameter(r.Context(), siteFromContext(r.Context()), parameters.Fields["coffee"])
+		if err != nil {
+			fmt.Fprint(w, err)
+			return
+		}
+		coffeeQty, err := cs.quantityParameter(parameters.Fields["quantity"])
+		if err != nil {
+			fmt.Fprint(w, err)
 			return
 		}
 
-		cs.log.Info("Coffee type: ", coffeeType, " quantity: ", coffeeQty, " employeeID: ", employeeID)
-		fmt.Fprintf(w, "OK, submitting your order for %d %s charging account %s", coffeeQty, coffeeType, employeeID)
+		req := orderRequest{
+			Site:       siteFromContext(r.Context()),
+			CoffeeType: coffeeType,
+			CoffeeQty:  coffeeQty,
+			EmployeeID: employeeID,
+			Coupon:     normalizeCouponCode(parameters.Fields["coupon"].GetStringValue()),
+		}
+		if pickup := parameters.Fields["time"].GetStringValue(); pickup != "" {
+			req.PickupAt, err = parsePickupTime(pickup, cs.storeTime(time.Now()))
+			if err != nil {
+				fmt.Fprintf(w, "Error processing order: %s", err)
+				return
+			}
+		}
+		cs.placeOrder(w, r, req)
 	} else {
-		fmt.Fprintf(w, fulfillmentText)
+		fmt.Fprint(w, fulfillmentText)
 	}
 }
 
-func (cs *coffeeserver) indexHandler(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "static/index.html")
+// placeOrder saves an order and replies with what was ordered, how it was
+// charged and any discounts and loyalty progress.
+func (cs *coffeeserver) placeOrder(w http.ResponseWriter, r *http.Request, req orderRequest) {
+	order, err := cs.saveOrder(r.Context(), req)
+	if err != nil {
+		fmt.Fprintf(w, "Error processing order: %s", err)
+		return
+	}
+	recordTurnOrder(r.Context(), order)
+
+	cs.endBadgeSession(r.Context())
+	cs.logger(r.Context()).Info("Coffee type: ", req.CoffeeType, " quantity: ", req.CoffeeQty, " employeeID: ", req.EmployeeID)
+	if order.PickupCode != "" {
+		w.Header().Set(pickupCodeHeader, order.PickupCode)
+	}
+	if order.Status == statusScheduled {
+		pickup := cs.storeTime(time.Unix(order.PickupAt, 0))
+		fmt.Fprintf(w, "OK, scheduling your order for %d %s %s charging account %s", req.CoffeeQty, req.CoffeeType, describePickup(pickup, cs.storeTime(time.Now())), req.EmployeeID)
+	} else {
+		fmt.Fprintf(w, "OK, submitting your order for %d %s charging account %s", req.CoffeeQty, req.CoffeeType, req.EmployeeID)
+	}
+	if len(order.Discounts) > 0 {
+		fmt.Fprintf(w, " (%s)", cs.describeDiscounts(order.Discounts))
+	}
+	if order.loyalty != nil {
+		fmt.Fprintf(w, ". %s", cs.describeStamps(order.loyalty.After))
+	}
+	if order.PickupCode != "" {
+		fmt.Fprintf(w, ". Your pickup number is %s", order.PickupCode)
+	}
+	if order.Status == statusQueued {
+		if estimate, err := cs.estimateWait(r.Context(), order); err != nil {
+			cs.logger(r.Context()).Error("Unable to estimate wait: ", err)
+		} else if estimate != nil {
+			fmt.Fprintf(w, ". It should be ready in %s", describeWait(estimate))
+		}
+	}
 }
 
-func (cs *coffeeserver) loggingHandler(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// intentHandlers are the Dialogflow intents handled other than ordering a
+// drink, by intent display name. They are called once the employee has been
+// identified and has confirmed their PIN.
+func (cs *coffeeserver) intentHandlers() map[string]func(http.ResponseWriter, *http.Request, string, *structpb.Struct) {
+	return map[string]func(http.ResponseWriter, *http.Request, string, *structpb.Struct){
+		cs.config.DialogflowStandingOrderIntent:       cs.standingOrderIntent,
+		cs.config.DialogflowCancelStandingOrderIntent: cs.cancelStandingOrderIntent,
+		cs.config.DialogflowUsualOrderIntent:          cs.usualOrderIntent,
+		cs.config.DialogflowJoinGroupIntent:           cs.joinGroupIntent,
+	}
+}
 
-		cs.log.WithFields(logrus.Fields{"Method": r.Method, "URI": r.RequestURI}).Info("Handling request")
-		handler(w, r)
-		cs.log.Debug("Finished handling request")
+// confirmEmployee works out whose account a voice request is for and, if
+// pin.required is set and they have not authenticated, checks their PIN. If
+// it returns false it has already replied.
+func (cs *coffeeserver) confirmEmployee(w http.ResponseWriter, r *http.Request, parameters *structpb.Struct) (string, bool) {
+	spokenID, err := cs.employeeIDParameter(parameters.Fields["employeeId"])
+	if err != nil {
+		fmt.Fprint(w, err)
+		return "", false
 	}
+	employeeID, err := resolveEmployeeID(r.Context(), spokenID)
+	if err != nil {
+		cs.logger(r.Context()).Warn("Employee ID mismatch: ", err)
+		fmt.Fprintf(w, "Error processing order: %s", err)
+		return "", false
+	}
+	if _, authed := authenticatedEmployee(r.Context()); cs.config.PINRequired && !authed {
+		pin := pinParameter(parameters.Fields["pin"])
+		if pin == "" {
+			fmt.Fprint(w, "Please say your 4-digit PIN to confirm the order")
+			return "", false
+		}
+		if err := cs.verifyPIN(r.Context(), employeeID, pin); err != nil {
+			fmt.Fprintf(w, "Error processing order: %s", err)
+			return "", false
+		}
+	}
+	return employeeID, true
+}
+
+// pinParameter returns the PIN captured by Dialogflow, which arrives as a
+// digit string or, if the agent uses @sys.number, as a number.
+func pinParameter(v *structpb.Value) string {
+	switch kind := v.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return strings.Replace(kind.StringValue, " ", "", -1)
+	case *structpb.Value_NumberValue:
+		return fmt.Sprintf("%04d", int(kind.NumberValue))
+	}
+	return ""
+}
+
+// withoutPIN returns Dialogflow parameters as plain values with the spoken
+// PIN removed, for logging and storing.
+func withoutPIN(parameters *structpb.Struct) map[string]interface{} {
+	m := structToMap(parameters)
+	delete(m, "pin")
+	return m
+}
+
+func (cs *coffeeserver) indexHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "static/index.html")
 }
 
 func (cs *coffeeserver) getRouter() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/order", cs.loggingHandler(cs.orderHandler)).Methods("POST")
+	r.Use(cs.metricsMiddleware)
+	r.HandleFunc("/metrics", cs.metricsHandler).Methods("GET")
+	r.HandleFunc("/healthz", cs.healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", cs.readyzHandler).Methods("GET")
+	r.HandleFunc("/order", cs.loggingHandler(cs.authHandler(cs.orderHandler))).Methods("POST").Name("order")
+	r.HandleFunc("/accounts/{employeeId}", cs.loggingHandler(cs.authHandler(cs.accountHandler))).Methods("GET").Name("account")
+	r.HandleFunc("/accounts/{employeeId}/pin", cs.loggingHandler(cs.authHandler(cs.pinHandler))).Methods("PUT", "DELETE").Name("account-pin")
+	r.HandleFunc("/me/orders", cs.loggingHandler(cs.authHandler(cs.myOrdersHandler))).Methods("GET").Name("my-orders")
+	r.HandleFunc("/me/orders/{id}", cs.loggingHandler(cs.authHandler(cs.myOrderHandler))).Methods("GET").Name("my-order")
+	r.HandleFunc("/me/statements/{month}", cs.loggingHandler(cs.authHandler(cs.statementHandler))).Methods("GET").Name("statement")
+	r.HandleFunc("/me/statements/{month}/email", cs.loggingHandler(cs.authHandler(cs.emailStatementHandler))).Methods("POST").Name("statement-email")
+	r.HandleFunc("/me/favourites", cs.loggingHandler(cs.authHandler(cs.favouritesHandler))).Methods("GET").Name("favourites")
+	r.HandleFunc("/me/favourites/{name}", cs.loggingHandler(cs.authHandler(cs.favouriteHandler))).Methods("PUT", "DELETE").Name("favourite")
+	r.HandleFunc("/me/favourites/{name}/order", cs.loggingHandler(cs.authHandler(cs.reorderHandler))).Methods("POST").Name("reorder")
+	r.HandleFunc("/groups", cs.loggingHandler(cs.authHandler(cs.groupsHandler))).Methods("POST").Name("groups")
+	r.HandleFunc("/groups/{code}", cs.loggingHandler(cs.authHandler(cs.groupHandler))).Methods("GET", "DELETE").Name("group")
+	r.HandleFunc("/groups/{code}/items", cs.loggingHandler(cs.authHandler(cs.groupItemsHandler))).Methods("POST", "DELETE").Name("group-items")
+	r.HandleFunc("/groups/{code}/submit", cs.loggingHandler(cs.authHandler(cs.submitGroupHandler))).Methods("POST").Name("group-submit")
+	r.HandleFunc("/groups/{code}/status", cs.loggingHandler(cs.authHandler(cs.groupStatusHandler))).Methods("PUT").Name("group-status")
+	r.HandleFunc("/accounts/{employeeId}/standing-orders", cs.loggingHandler(cs.authHandler(cs.standingOrdersHandler))).Methods("GET", "POST").Name("standing-orders")
+	r.HandleFunc("/accounts/{employeeId}/standing-orders/{id}", cs.loggingHandler(cs.authHandler(cs.standingOrderHandler))).Methods("PUT", "DELETE").Name("standing-order")
+	r.HandleFunc("/accounts/{employeeId}/policy", cs.loggingHandler(cs.authHandler(cs.accountPolicyHandler))).Methods("PUT").Name("account-policy")
+	r.HandleFunc("/admin/policies/{group}", cs.loggingHandler(cs.authHandler(cs.policiesHandler))).Methods("GET", "PUT").Name("policies")
+	r.HandleFunc("/admin/costcentres/{code}", cs.loggingHandler(cs.authHandler(cs.costCentresHandler))).Methods("GET", "PUT").Name("cost-centres")
+	r.HandleFunc("/admin/subsidies", cs.loggingHandler(cs.authHandler(cs.subsidyRulesHandler))).Methods("GET").Name("subsidies")
+	r.HandleFunc("/admin/subsidies/{name}", cs.loggingHandler(cs.authHandler(cs.subsidyRuleHandler))).Methods("PUT", "DELETE").Name("subsidy")
+	r.HandleFunc("/reports/subsidies", cs.loggingHandler(cs.authHandler(cs.subsidyReportHandler))).Methods("GET").Name("subsidy-report")
+	r.HandleFunc("/admin/promotions", cs.loggingHandler(cs.authHandler(cs.promotionsHandler))).Methods("GET").Name("promotions")
+	r.HandleFunc("/admin/promotions/{name}", cs.loggingHandler(cs.authHandler(cs.promotionHandler))).Methods("PUT", "DELETE").Name("promotion")
+	r.HandleFunc("/admin/coupons", cs.loggingHandler(cs.authHandler(cs.couponsHandler))).Methods("GET").Name("coupons")
+	r.HandleFunc("/admin/coupons/{code}", cs.loggingHandler(cs.authHandler(cs.couponHandler))).Methods("PUT", "DELETE").Name("coupon")
+	r.HandleFunc("/orders/{id}/refund", cs.loggingHandler(cs.authHandler(cs.refundOrderHandler))).Methods("POST").Name("order-refund")
+	r.HandleFunc("/admin/sites", cs.loggingHandler(cs.authHandler(cs.sitesHandler))).Methods("GET").Name("sites")
+	r.HandleFunc("/admin/sites/{code}", cs.loggingHandler(cs.authHandler(cs.siteHandler))).Methods("GET", "PUT", "DELETE").Name("site")
+	r.HandleFunc("/queue", cs.loggingHandler(cs.authHandler(cs.queueHandler))).Methods("GET").Name("queue")
+	r.HandleFunc("/orders/{id}/status", cs.loggingHandler(cs.authHandler(cs.orderStatusHandler))).Methods("PUT").Name("order-status")
+	r.HandleFunc("/orders/{id}/status", cs.loggingHandler(cs.authHandler(cs.orderProgressHandler))).Methods("GET").Name("order-progress")
+	r.HandleFunc("/orders/{id}/ticket", cs.loggingHandler(cs.authHandler(cs.ticketHandler))).Methods("GET", "POST").Name("order-ticket")
+	r.HandleFunc("/reports/sites", cs.loggingHandler(cs.authHandler(cs.siteReportHandler))).Methods("GET").Name("site-report")
+	r.HandleFunc("/menu", cs.loggingHandler(cs.authHandler(cs.menuHandler))).Methods("GET").Name("menu")
+	r.HandleFunc("/admin/inventory", cs.loggingHandler(cs.authHandler(cs.inventoryHandler))).Methods("GET").Name("inventory")
+	r.HandleFunc("/admin/inventory/{ingredient}", cs.loggingHandler(cs.authHandler(cs.ingredientHandler))).Methods("GET", "PUT").Name("ingredient")
+	r.HandleFunc("/admin/inventory/{ingredient}/restock", cs.loggingHandler(cs.authHandler(cs.restockHandler))).Methods("POST").Name("restock")
+	r.HandleFunc("/admin/recipes", cs.loggingHandler(cs.authHandler(cs.recipesHandler))).Methods("GET").Name("recipes")
+	r.HandleFunc("/admin/recipes/{drink}", cs.loggingHandler(cs.authHandler(cs.recipeHandler))).Methods("PUT", "DELETE").Name("recipe")
+	r.HandleFunc("/admin/conversations", cs.loggingHandler(cs.authHandler(cs.conversationsHandler))).Methods("GET").Name("conversations")
+	r.HandleFunc("/admin/conversations/{id}", cs.loggingHandler(cs.authHandler(cs.conversationHandler))).Methods("GET").Name("conversation")
+	r.HandleFunc("/admin/conversations/{id}/audio", cs.loggingHandler(cs.authHandler(cs.conversationAudioHandler))).Methods("GET").Name("conversation-audio")
+	r.HandleFunc("/admin/conversations/{id}/replay", cs.loggingHandler(cs.authHandler(cs.replayConversationHandler))).Methods("POST").Name("conversation-replay")
+	r.HandleFunc("/admin/roles/{employeeId}", cs.loggingHandler(cs.authHandler(cs.rolesHandler))).Methods("GET", "PUT").Name("roles")
+	r.HandleFunc("/admin/apikeys", cs.loggingHandler(cs.authHandler(cs.apiKeysHandler))).Methods("GET", "POST").Name("apikeys")
+	r.HandleFunc("/admin/apikeys/{id}", cs.loggingHandler(cs.authHandler(cs.revokeAPIKeyHandler))).Methods("DELETE").Name("apikey-revoke")
+	r.HandleFunc("/admin/badges/{cardUid}", cs.loggingHandler(cs.authHandler(cs.badgesHandler))).Methods("PUT", "DELETE").Name("badges")
+	r.HandleFunc("/badge/tap", cs.loggingHandler(cs.authHandler(cs.badgeTapHandler))).Methods("POST").Name("badge-tap")
+	r.HandleFunc("/badge/session", cs.loggingHandler(cs.authHandler(cs.badgeSessionHandler))).Methods("DELETE").Name("badge-session")
+	if cs.testIssuer != nil {
+		r.HandleFunc(testIssuerJWKSPath, cs.testIssuer.jwksHandler).Methods("GET")
+		r.HandleFunc(testIssuerTokenPath, cs.loggingHandler(cs.testIssuer.tokenHandler)).Methods("GET", "POST")
+	}
 	r.HandleFunc("/", cs.loggingHandler(cs.indexHandler))
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 
 	return r
 }
 
-func newCoffeeServer(log *logrus.Logger) *coffeeserver {
+func newCoffeeServer(log *logrus.Logger, cfg *config) *coffeeserver {
 	cs := coffeeserver{
-		log: log,
+		log:           log,
+		config:        cfg,
+		jwks:          newJWKSCache(cfg.AuthJWKSURL, cfg.AuthJWKSCacheTTL),
+		badgeSessions: newBadgeSessions(cfg.BadgeSessionTTL),
+		prepModels:    newPrepModels(),
 	}
 
-	cs.projectID = "test1-61c87"
-	cs.sessionID = "24e636f5-c721-5517-3538-fcf612ca9b33"
-	cs.languageCode = "en"
+	if cfg.AuthTestIssuer {
+		ti, err := newTestIssuer(cfg)
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+		cs.jwks.static[ti.kid] = &ti.key.PublicKey
+		cs.testIssuer = ti
+		log.Warn("Local test token issuer enabled at ", testIssuerTokenPath, " - do not use in production")
+	}
 
-	if mongoConnString != "" {
-		db, err := mongo.NewClient(mongoConnString)
+	if cfg.MongoURI != "" {
+		db, err := mongo.NewClient(cfg.MongoURI)
 		if err != nil {
 			log.Error("Error creating mongodb connection: ", err)
 			return nil
@@ -296,7 +629,7 @@ func newCoffeeServer(log *logrus.Logger) *coffeeserver {
 			return nil
 		}
 
-		log.Info("Created mongodb connection for ", mongoConnString)
+		log.Info("Created mongodb connection for ", redact(cfg.MongoURI))
 
 		cs.mongo = db
 	}
@@ -304,37 +637,106 @@ func newCoffeeServer(log *logrus.Logger) *coffeeserver {
 	return &cs
 }
 
-func run(log *logrus.Logger) {
-	cs := newCoffeeServer(log)
-	r := cs.getRouter()
+func run(log *logrus.Logger, cfg *config) {
+	if cfg.AuthMode == "none" && !cfg.PINRequired {
+		log.Warn("INSECURE: auth.mode is none and pin.required is false, so anyone can place orders charged to any employee ID. Set auth.mode = \"jwt\" or pin.required = true outside of demos.")
+	}
+	if err := registerMetricsViews(); err != nil {
+		log.Error("Error registering metrics views: ", err)
+	}
 
-	if tls {
-		log.Info("Starting HTTPS server on ", listenAddr)
-		log.Error("HTTP server shutdown: ", http.ListenAndServeTLS(listenAddr, certFilename, certKeyFilename, r))
-	} else {
-		log.Info("Starting HTTP server on ", listenAddr)
-		log.Error("HTTP server shutdown: ", http.ListenAndServe(listenAddr, r))
+	cs := newCoffeeServer(log, cfg)
+	r, flushTraces, err := setupTracing(log, cfg, cs.getRouter())
+	if err != nil {
+		log.Error("Error configuring tracing: ", err)
+		return
+	}
+
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: r}
+
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	go cs.runScheduler(schedulerCtx)
+
+	go func() {
+		var err error
+		if cfg.TLS {
+			log.Info("Starting HTTPS server on ", cfg.ListenAddr)
+			err = srv.ListenAndServeTLS(cfg.CertFile, cfg.CertKeyFile)
+		} else {
+			log.Info("Starting HTTP server on ", cfg.ListenAddr)
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Error("HTTP server shutdown: ", err)
+			os.Exit(1)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+
+	log.WithFields(logrus.Fields{"signal": sig, "timeout": cfg.ShutdownTimeout}).Info("Shutting down, draining in-flight requests")
+
+	stopScheduler()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Error("Error draining HTTP server: ", err)
 	}
+	cs.close(ctx)
+	flushTraces()
 
+	log.Info("HTTP server shutdown complete")
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [config print]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	log := logrus.New()
-	if verbose {
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	setLogFormat(log, cfg.LogFormat)
+
+	if flag.Arg(0) == "config" {
+		if flag.Arg(1) != "print" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		cfg.print(os.Stdout)
+		return
+	}
+
+	if cfg.Verbose {
 		log.Level = logrus.DebugLevel
 		log.Debug("Logging level set to debug")
 	}
-	run(log)
+	run(log, cfg)
 }
 
 func init() {
-	flag.BoolVar(&verbose, "verbose", false, "Verbose logging")
-	flag.StringVar(&listenAddr, "addr", ":5000", "Address to listen on")
-	flag.StringVar(&mongoConnString, "mongo", "mongodb://localhost:27017", "Connection string for mondodb server")
-
-	flag.BoolVar(&tls, "tls", false, "Enable TLS")
-	flag.StringVar(&certFilename, "cert", "", "Filename for certificate file (e.g. cert.pem)")
-	flag.StringVar(&certKeyFilename, "certkey", "", "Filename for certificate private key file (e.g. key.pem)")
+	flag.StringVar(&flagConfig.ConfigFile, "config", "", "Path to config file (also COFFEE_CONFIG)")
+	flag.BoolVar(&flagConfig.Verbose, "verbose", flagConfig.Verbose, "Verbose logging")
+	flag.StringVar(&flagConfig.LogFormat, "log-format", flagConfig.LogFormat, "Log output format (text or json)")
+	flag.StringVar(&flagConfig.ListenAddr, "addr", flagConfig.ListenAddr, "Address to listen on")
+	flag.StringVar(&flagConfig.MongoURI, "mongo", flagConfig.MongoURI, "Connection string for mondodb server")
+	flag.DurationVar(&flagConfig.ShutdownTimeout, "shutdown-timeout", flagConfig.ShutdownTimeout, "Time to wait for in-flight requests to finish on shutdown")
+
+	flag.BoolVar(&flagConfig.TLS, "tls", flagConfig.TLS, "Enable TLS")
+	flag.StringVar(&flagConfig.CertFile, "cert", flagConfig.CertFile, "Filename for certificate file (e.g. cert.pem)")
+	flag.StringVar(&flagConfig.CertKeyFile, "certkey", flagConfig.CertKeyFile, "Filename for certificate private key file (e.g. key.pem)")
+
+	flag.StringVar(&flagConfig.AuthMode, "auth", flagConfig.AuthMode, "Authentication mode for orders (none or jwt)")
+
+	flag.StringVar(&flagConfig.TraceExporter, "trace-exporter", flagConfig.TraceExporter, "Trace exporter to use (none, log or stackdriver)")
+	flag.StringVar(&flagConfig.TracePropagation, "trace-propagation", flagConfig.TracePropagation, "Comma-separated trace header formats to accept and propagate (w3c, b3, stackdriver)")
+	flag.Float64Var(&flagConfig.TraceSampleRate, "trace-sample-rate", flagConfig.TraceSampleRate, "Fraction of requests to trace")
 }
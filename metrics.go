@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+const metricsNamespace = "coffee"
+
+var (
+	keyRoute, _      = tag.NewKey("route")
+	keyMethod, _     = tag.NewKey("method")
+	keyStatus, _     = tag.NewKey("status")
+	keyResult, _     = tag.NewKey("result")
+	keyOperation, _  = tag.NewKey("operation")
+	keyDrink, _      = tag.NewKey("drink")
+	keyCostCentre, _ = tag.NewKey("cost_centre")
+	keyIngredient, _ = tag.NewKey("ingredient")
+	keySite, _       = tag.NewKey("site")
+	keyIntent, _     = tag.NewKey("intent")
+)
+
+var (
+	httpLatencyMeasure       = stats.Float64("coffee/http/latency", "HTTP request latency", stats.UnitMilliseconds)
+	dialogflowLatencyMeasure = stats.Float64("coffee/dialogflow/latency", "Dialogflow DetectIntent latency", stats.UnitMilliseconds)
+	mongoLatencyMeasure      = stats.Float64("coffee/mongo/latency", "MongoDB operation latency", stats.UnitMilliseconds)
+	ordersMeasure            = stats.Int64("coffee/orders", "Orders placed or declined", stats.UnitDimensionless)
+	revenueMeasure           = stats.Float64("coffee/revenue", "Amount charged for placed orders", "1")
+	subsidyMeasure           = stats.Float64("coffee/subsidy", "Amount of placed orders charged to cost centres", "1")
+	stockMeasure             = stats.Float64("coffee/stock", "Ingredient stock level", "1")
+	ticketsMeasure           = stats.Int64("coffee/tickets", "Tickets sent to printers", stats.UnitDimensionless)
+	intentsMeasure           = stats.Int64("coffee/intents", "Intents matched by Dialogflow", stats.UnitDimensionless)
+)
+
+var latencyDistribution = view.Distribution(1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000)
+
+var metricsViews = []*view.View{
+	{
+		Name:        "http_requests_total",
+		Description: "HTTP requests handled, by route, method and status",
+		Measure:     httpLatencyMeasure,
+		TagKeys:     []tag.Key{keyRoute, keyMethod, keyStatus},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "http_request_duration_milliseconds",
+		Description: "HTTP request latency, by route and method",
+		Measure:     httpLatencyMeasure,
+		TagKeys:     []tag.Key{keyRoute, keyMethod},
+		Aggregation: latencyDistribution,
+	},
+	{
+		Name:        "dialogflow_requests_total",
+		Description: "Dialogflow DetectIntent calls, by result",
+		Measure:     dialogflowLatencyMeasure,
+		TagKeys:     []tag.Key{keyResult},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "dialogflow_request_duration_milliseconds",
+		Description: "Dialogflow DetectIntent latency",
+		Measure:     dialogflowLatencyMeasure,
+		TagKeys:     []tag.Key{keyResult},
+		Aggregation: latencyDistribution,
+	},
+	{
+		Name:        "mongo_operation_duration_milliseconds",
+		Description: "MongoDB operation latency, by operation and result",
+		Measure:     mongoLatencyMeasure,
+		TagKeys:     []tag.Key{keyOperation, keyResult},
+		Aggregation: latencyDistribution,
+	},
+	{
+		Name:        "orders_total",
+		Description: "Orders by site, drink and result (placed or declined)",
+		Measure:     ordersMeasure,
+		TagKeys:     []tag.Key{keySite, keyDrink, keyResult},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "revenue_total",
+		Description: "Order totals for placed orders, including subsidies, by site and drink",
+		Measure:     revenueMeasure,
+		TagKeys:     []tag.Key{keySite, keyDrink},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "subsidy_total",
+		Description: "Amount of placed orders charged to cost centres, by cost centre",
+		Measure:     subsidyMeasure,
+		TagKeys:     []tag.Key{keyCostCentre},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "ingredient_stock",
+		Description: "Ingredient stock level when last changed, by ingredient",
+		Measure:     stockMeasure,
+		TagKeys:     []tag.Key{keyIngredient},
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "tickets_printed_total",
+		Description: "Tickets sent to printers, by site and result",
+		Measure:     ticketsMeasure,
+		TagKeys:     []tag.Key{keySite, keyResult},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "dialogflow_intents_total",
+		Description: "Intents matched by Dialogflow, by intent and whether they were acted on",
+		Measure:     intentsMeasure,
+		TagKeys:     []tag.Key{keyIntent, keyResult},
+		Aggregation: view.Count(),
+	},
+}
+
+func registerMetricsViews() error {
+	return view.Register(metricsViews...)
+}
+
+// milliseconds returns the time elapsed since start in fractional milliseconds.
+func milliseconds(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+func resultTag(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func recordWithTags(mutators []tag.Mutator, ms ...stats.Measurement) {
+	ctx, err := tag.New(context.Background(), mutators...)
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, ms...)
+}
+
+func recordDialogflowCall(start time.Time, err error) {
+	recordWithTags([]tag.Mutator{tag.Upsert(keyResult, resultTag(err))},
+		dialogflowLatencyMeasure.M(milliseconds(start)))
+}
+
+func recordMongoOperation(operation string, start time.Time, err error) {
+	recordWithTags([]tag.Mutator{tag.Upsert(keyOperation, operation), tag.Upsert(keyResult, resultTag(err))},
+		mongoLatencyMeasure.M(milliseconds(start)))
+}
+
+func recordOrderPlaced(site, coffeeType string, amount float32) {
+	recordWithTags([]tag.Mutator{tag.Upsert(keySite, site), tag.Upsert(keyDrink, coffeeType), tag.Upsert(keyResult, "placed")},
+		ordersMeasure.M(1))
+	recordWithTags([]tag.Mutator{tag.Upsert(keySite, site), tag.Upsert(keyDrink, coffeeType)},
+		revenueMeasure.M(float64(amount)))
+}
+
+func recordSubsidy(costCentre string, amount float64) {
+	recordWithTags([]tag.Mutator{tag.Upsert(keyCostCentre, costCentre)},
+		subsidyMeasure.M(amount))
+}
+
+func recordIngredientStock(ingredient string, stock float64) {
+	recordWithTags([]tag.Mutator{tag.Upsert(keyIngredient, ingredient)},
+		stockMeasure.M(stock))
+}
+
+func recordTicketPrinted(site string, err error) {
+	recordWithTags([]tag.Mutator{tag.Upsert(keySite, site), tag.Upsert(keyResult, resultTag(err))},
+		ticketsMeasure.M(1))
+}
+
+func recordIntent(intent, result string) {
+	recordWithTags([]tag.Mutator{tag.Upsert(keyIntent, intent), tag.Upsert(keyResult, result)},
+		intentsMeasure.M(1))
+}
+
+func recordOrderDeclined(site, coffeeType string) {
+	recordWithTags([]tag.Mutator{tag.Upsert(keySite, site), tag.Upsert(keyDrink, coffeeType), tag.Upsert(keyResult, "declined")},
+		ordersMeasure.M(1))
+}
+
+// statusRecorder captures the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+func (cs *coffeeserver) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		recordWithTags([]tag.Mutator{
+			tag.Upsert(keyRoute, route),
+			tag.Upsert(keyMethod, r.Method),
+			tag.Upsert(keyStatus, strconv.Itoa(sr.status)),
+		}, httpLatencyMeasure.M(milliseconds(start)))
+	})
+}
+
+// metricsHandler renders the registered views in the Prometheus text
+// exposition format.
+func (cs *coffeeserver) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, v := range metricsViews {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			cs.log.Error("Unable to retrieve metrics for view ", v.Name, ": ", err)
+			continue
+		}
+
+		name := metricsNamespace + "_" + v.Name
+		metricType := "counter"
+		switch v.Aggregation.Type {
+		case view.AggTypeDistribution:
+			metricType = "histogram"
+		case view.AggTypeLastValue:
+			metricType = "gauge"
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", name, v.Description)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+
+		for _, row := range rows {
+			labels := make([]string, 0, len(row.Tags)+1)
+			for _, t := range row.Tags {
+				labels = append(labels, fmt.Sprintf("%s=%q", t.Key.Name(), t.Value))
+			}
+			sort.Strings(labels)
+
+			switch data := row.Data.(type) {
+			case *view.CountData:
+				fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(labels), data.Value)
+			case *view.SumData:
+				fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels), formatFloat(data.Value))
+			case *view.LastValueData:
+				fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels), formatFloat(data.Value))
+			case *view.DistributionData:
+				var cumulative int64
+				for i, bound := range v.Aggregation.Buckets {
+					cumulative += data.CountPerBucket[i]
+					le := append(labels, fmt.Sprintf("le=%q", formatFloat(bound)))
+					fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(le), cumulative)
+				}
+				le := append(labels, `le="+Inf"`)
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(le), data.Count)
+				fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labels), formatFloat(data.Sum()))
+				fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(labels), data.Count)
+			}
+		}
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+var errNoMongo = fmt.Errorf("No mongodb connection configured")
+
+// withCollection runs f against the named collection with the configured
+// database timeout, recording a trace span and latency metric for operation.
+func (cs *coffeeserver) withCollection(ctx context.Context, collection, operation string, f func(ctx context.Context, coll *mongo.Collection) error) error {
+	if cs.mongo == nil {
+		return errNoMongo
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cs.config.DBTimeout)
+	defer cancel()
+
+	ctx, span := cs.startMongoSpan(ctx, collection, operation)
+	start := time.Now()
+	err := f(ctx, cs.mongo.Database(cs.config.DBName).Collection(collection))
+	recordMongoOperation(operation, start, err)
+	endSpan(span, err)
+
+	return err
+}
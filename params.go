@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+// Dialogflow passes parameters on as it heard them: numbers as words or
+// digits, a range when someone hesitates, a list when they ask for several
+// things, and drink names and employee IDs however they were transcribed.
+// The functions here turn them into what an order needs, or into a question
+// to ask back.
+
+// quantityWords are the ways of saying a quantity that Dialogflow does not
+// turn into a number.
+var quantityWords = map[string]int{
+	"a": 1, "an": 1, "one": 1, "single": 1, "a single": 1, "just one": 1,
+	"two": 2, "a couple": 2, "couple": 2, "a pair": 2, "pair": 2,
+	"three": 3, "four": 4, "five": 5, "six": 6, "seven": 7, "eight": 8,
+	"nine": 9, "ten": 10, "eleven": 11, "twelve": 12, "a dozen": 12, "dozen": 12,
+	"thirteen": 13, "fourteen": 14, "fifteen": 15, "sixteen": 16,
+	"seventeen": 17, "eighteen": 18, "nineteen": 19, "twenty": 20,
+}
+
+// vagueQuantities are quantities we have to ask about.
+var vagueQuantities = map[string]bool{
+	"a few": true, "few": true, "some": true, "several": true, "a bunch": true, "lots": true, "a lot": true,
+}
+
+var quantityRange = regexp.MustCompile(`^(.+?)\s*(?:-|to|or)\s*(.+)$`)
+
+// parseQuantity reads a quantity said as digits or words. A missing quantity
+// is one drink.
+func parseQuantity(s string) (int, error) {
+	s = strings.ToLower(strings.Join(strings.Fields(s), " "))
+	s = strings.TrimSuffix(s, " of")
+	if s == "" {
+		return 1, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, nil
+	}
+	if n, ok := quantityWords[s]; ok {
+		return n, nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return 0, fmt.Errorf("Sorry, how many drinks would you like?")
+	}
+	if vagueQuantities[s] {
+		return 0, fmt.Errorf("Sorry, how many exactly?")
+	}
+	if m := quantityRange.FindStringSubmatch(s); m != nil {
+		low, lowErr := parseQuantity(m[1])
+		high, highErr := parseQuantity(m[2])
+		if lowErr == nil && highErr == nil {
+			return 0, fmt.Errorf("Sorry, did you want %d or %d?", low, high)
+		}
+	}
+	return 0, fmt.Errorf("Sorry, I didn't understand how many you want")
+}
+
+// quantityParameter returns the quantity captured by Dialogflow, which
+// arrives as a number, as a string of digits or words, or as a list if more
+// than one was heard, and checks it is within orders.min_quantity and
+// orders.max_quantity.
+func (cs *coffeeserver) quantityParameter(v *structpb.Value) (int, error) {
+	var qty int
+	switch kind := v.GetKind().(type) {
+	case nil:
+		qty = 1
+	case *structpb.Value_NumberValue:
+		if kind.NumberValue != math.Trunc(kind.NumberValue) {
+			return 0, fmt.Errorf("Sorry, how many drinks would you like?")
+		}
+		qty = int(kind.NumberValue)
+	case *structpb.Value_StringValue:
+		n, err := parseQuantity(kind.StringValue)
+		if err != nil {
+			return 0, err
+		}
+		qty = n
+	case *structpb.Value_ListValue:
+		values := kind.ListValue.GetValues()
+		switch len(values) {
+		case 0:
+			qty = 1
+		case 1:
+			return cs.quantityParameter(values[0])
+		case 2:
+			low, lowErr := cs.quantityParameter(values[0])
+			high, highErr := cs.quantityParameter(values[1])
+			if lowErr == nil && highErr == nil && low != high {
+				return 0, fmt.Errorf("Sorry, did you want %d or %d?", low, high)
+			}
+			if lowErr != nil {
+				return 0, lowErr
+			}
+			if highErr != nil {
+				return 0, highErr
+			}
+			qty = low
+		default:
+			return 0, fmt.Errorf("Sorry, how many drinks would you like?")
+		}
+	default:
+		return 0, fmt.Errorf("Unrecognised type for quantity field")
+	}
+	return qty, cs.checkQuantity(qty)
+}
+
+// checkQuantity checks the number of drinks in an order is within
+// orders.min_quantity and orders.max_quantity.
+func (cs *coffeeserver) checkQuantity(qty int) error {
+	min, max := cs.config.OrdersMinQuantity, cs.config.OrdersMaxQuantity
+	if qty < min || qty > max {
+		if min == max {
+			return fmt.Errorf("Sorry, you can only order %d at a time", min)
+		}
+		return fmt.Errorf("Sorry, you can order between %d and %d drinks at a time", min, max)
+	}
+	return nil
+}
+
+// drinkParameter returns the drink on the menu at siteCode that the coffee
+// parameter names, asking which one was meant if it is ambiguous. Only one
+// kind of drink can be ordered at a time.
+func (cs *coffeeserver) drinkParameter(ctx context.Context, siteCode string, v *structpb.Value) (string, error) {
+	var spoken []string
+	switch kind := v.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		spoken = []string{kind.StringValue}
+	case *structpb.Value_ListValue:
+		for _, item := range kind.ListValue.GetValues() {
+			spoken = append(spoken, item.GetStringValue())
+		}
+	}
+	var drinks []string
+	seen := map[string]bool{}
+	for _, s := range spoken {
+		if s = strings.TrimSpace(s); s != "" && !seen[normalizeDrink(s)] {
+			seen[normalizeDrink(s)] = true
+			drinks = append(drinks, s)
+		}
+	}
+	switch len(drinks) {
+	case 0:
+		return "", fmt.Errorf("Sorry, which drink would you like?")
+	case 1:
+	default:
+		return "", fmt.Errorf("Sorry, I can only take one kind of drink per order. Would you like %s?", orList(drinks))
+	}
+
+	s, err := cs.getSite(ctx, siteCode)
+	if err != nil {
+		return "", err
+	}
+	return matchDrink(siteMenu(s), drinks[0])
+}
+
+// drinkFillers are words said around a drink's name that are not part of it.
+var drinkFillers = map[string]bool{"a": true, "an": true, "the": true, "of": true, "cup": true, "cups": true, "please": true}
+
+// normalizeDrink reduces a drink name to lower case words without
+// punctuation, fillers or plurals, so "Two cups of Long-Blacks" and "long
+// black" compare equal.
+func normalizeDrink(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var kept []string
+	for _, word := range words {
+		if drinkFillers[word] {
+			continue
+		}
+		if len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") {
+			word = strings.TrimSuffix(word, "s")
+		}
+		kept = append(kept, word)
+	}
+	return strings.Join(kept, " ")
+}
+
+// matchDrink finds the drink on menu that spoken names. Names that are not
+// an exact match are matched allowing for a transcription error in about
+// one letter in four, or when one name is part of the other ("black" for
+// "long black"); if more than one drink matches equally well it asks which.
+func matchDrink(menu map[string]float64, spoken string) (string, error) {
+	want := normalizeDrink(spoken)
+	best, matches := -1, []string(nil)
+	for drink := range menu {
+		name := normalizeDrink(drink)
+		if name == want {
+			return drink, nil
+		}
+		score := editDistance(want, name)
+		if score > len(name)/4 {
+			score = -1
+		}
+		if containsWords(name, want) || containsWords(want, name) {
+			if score < 0 || score > 1 {
+				score = 1
+			}
+		}
+		switch {
+		case score < 0:
+		case best < 0 || score < best:
+			best, matches = score, []string{drink}
+		case score == best:
+			matches = append(matches, drink)
+		}
+	}
+	sort.Strings(matches)
+	switch len(matches) {
+	case 0:
+		drinks := make([]string, 0, len(menu))
+		for drink := range menu {
+			drinks = append(drinks, drink)
+		}
+		sort.Strings(drinks)
+		return "", fmt.Errorf("Sorry, %s isn't on the menu. Would you like %s?", spoken, orList(drinks))
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("Sorry, did you mean %s?", orList(matches))
+}
+
+// containsWords reports whether the words of part appear together in s.
+func containsWords(s, part string) bool {
+	return part != "" && strings.Contains(" "+s+" ", " "+part+" ")
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur := make([]int, len(br)+1)
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev = cur
+	}
+	return prev[len(br)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// orList joins choices as "a, b or c".
+func orList(choices []string) string {
+	if len(choices) < 2 {
+		return strings.Join(choices, "")
+	}
+	return strings.Join(choices[:len(choices)-1], ", ") + " or " + choices[len(choices)-1]
+}
+
+// digitWords are spoken digits, as they come through in employee IDs read
+// out one character at a time.
+var digitWords = map[string]string{
+	"zero": "0", "oh": "0", "one": "1", "two": "2", "three": "3", "four": "4",
+	"five": "5", "six": "6", "seven": "7", "eight": "8", "nine": "9",
+}
+
+// employeeIDParameter returns the employee ID captured by Dialogflow in the
+// form accounts use: spoken digits become digits, the spaces and hyphens
+// between characters are dropped and the case set by employees.id_case is
+// applied. It returns "" if no ID was given and asks again if the ID does
+// not match employees.id_pattern.
+func (cs *coffeeserver) employeeIDParameter(v *structpb.Value) (string, error) {
+	var spoken string
+	switch kind := v.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		spoken = kind.StringValue
+	case *structpb.Value_NumberValue:
+		spoken = strconv.FormatFloat(kind.NumberValue, 'f', -1, 64)
+	}
+	words := strings.FieldsFunc(spoken, func(r rune) bool { return unicode.IsSpace(r) || r == '-' })
+	for i, word := range words {
+		if digit, ok := digitWords[strings.ToLower(word)]; ok {
+			words[i] = digit
+		}
+	}
+	id := strings.Join(words, "")
+	switch cs.config.EmployeeIDCase {
+	case "upper":
+		id = strings.ToUpper(id)
+	case "lower":
+		id = strings.ToLower(id)
+	}
+	if id != "" && cs.config.employeeIDPattern != nil && !cs.config.employeeIDPattern.MatchString(id) {
+		return "", fmt.Errorf("Sorry, I didn't catch your employee ID. Could you say it again?")
+	}
+	return id, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+func stringValue(s string) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: s}}
+}
+
+func numberValue(n float64) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: n}}
+}
+
+func listValue(values ...*structpb.Value) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_ListValue{ListValue: &structpb.ListValue{Values: values}}}
+}
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		spoken string
+		qty    int
+		err    string
+	}{
+		{"", 1, ""},
+		{"3", 3, ""},
+		{"two", 2, ""},
+		{"a couple", 2, ""},
+		{"A  Couple of", 2, ""},
+		{"a dozen", 12, ""},
+		{"1.5", 0, "Sorry, how many drinks would you like?"},
+		{"a few", 0, "Sorry, how many exactly?"},
+		{"two or three", 0, "Sorry, did you want 2 or 3?"},
+		{"2-3", 0, "Sorry, did you want 2 or 3?"},
+		{"four to five", 0, "Sorry, did you want 4 or 5?"},
+		{"umpteen", 0, "Sorry, I didn't understand how many you want"},
+	}
+	for _, tt := range tests {
+		qty, err := parseQuantity(tt.spoken)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseQuantity(%q) = %d, %v; want error %q", tt.spoken, qty, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || qty != tt.qty {
+			t.Errorf("parseQuantity(%q) = %d, %v; want %d", tt.spoken, qty, err, tt.qty)
+		}
+	}
+}
+
+func TestQuantityParameter(t *testing.T) {
+	cs := &coffeeserver{config: &config{OrdersMinQuantity: 1, OrdersMaxQuantity: 10}}
+	tests := []struct {
+		name  string
+		value *structpb.Value
+		qty   int
+		err   string
+	}{
+		{"missing", nil, 1, ""},
+		{"number", numberValue(2), 2, ""},
+		{"fraction", numberValue(1.5), 0, "Sorry, how many drinks would you like?"},
+		{"words", stringValue("a couple"), 2, ""},
+		{"range", stringValue("two or three"), 0, "Sorry, did you want 2 or 3?"},
+		{"empty list", listValue(), 1, ""},
+		{"list of one", listValue(numberValue(3)), 3, ""},
+		{"list of two", listValue(numberValue(2), stringValue("three")), 0, "Sorry, did you want 2 or 3?"},
+		{"list repeated", listValue(numberValue(2), stringValue("two")), 2, ""},
+		{"list of three", listValue(numberValue(1), numberValue(2), numberValue(3)), 0, "Sorry, how many drinks would you like?"},
+		{"too many", numberValue(11), 0, "Sorry, you can order between 1 and 10 drinks at a time"},
+		{"none", numberValue(0), 0, "Sorry, you can order between 1 and 10 drinks at a time"},
+	}
+	for _, tt := range tests {
+		qty, err := cs.quantityParameter(tt.value)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got %d, %v; want error %q", tt.name, qty, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || qty != tt.qty {
+			t.Errorf("%s: got %d, %v; want %d", tt.name, qty, err, tt.qty)
+		}
+	}
+}
+
+func TestMatchDrink(t *testing.T) {
+	menu := map[string]float64{
+		"latte": 4, "flat white": 4, "long black": 3.5, "short black": 3, "cappuccino": 4, "hot chocolate": 4.5,
+	}
+	tests := []struct {
+		spoken string
+		drink  string
+		err    string
+	}{
+		{"latte", "latte", ""},
+		{"Lattes", "latte", ""},
+		{"two cups of Long-Blacks", "long black", ""},
+		{"flat whites please", "flat white", ""},
+		{"capuccino", "cappuccino", ""},
+		{"chocolate", "hot chocolate", ""},
+		{"black", "", "Sorry, did you mean long black or short black?"},
+		{"mocha", "", "Sorry, mocha isn't on the menu. Would you like cappuccino, flat white, hot chocolate, latte, long black or short black?"},
+	}
+	for _, tt := range tests {
+		drink, err := matchDrink(menu, tt.spoken)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("matchDrink(%q) = %q, %v; want error %q", tt.spoken, drink, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || drink != tt.drink {
+			t.Errorf("matchDrink(%q) = %q, %v; want %q", tt.spoken, drink, err, tt.drink)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"latte", "latte", 0},
+		{"latte", "late", 1},
+		{"cappuccino", "capuccino", 1},
+		{"flat white", "flat wite", 1},
+		{"mocha", "", 5},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestEmployeeIDParameter(t *testing.T) {
+	tests := []struct {
+		name    string
+		idCase  string
+		pattern string
+		value   *structpb.Value
+		id      string
+		err     bool
+	}{
+		{name: "missing", value: nil, id: ""},
+		{name: "digits", value: stringValue("123"), id: "123"},
+		{name: "number", value: numberValue(123), id: "123"},
+		{name: "spoken digits", value: stringValue("one two three"), id: "123"},
+		{name: "oh for zero", value: stringValue("four oh Seven"), id: "407"},
+		{name: "spaced and hyphenated", value: stringValue("AB-12 34"), id: "AB1234"},
+		{name: "upper case", idCase: "upper", value: stringValue("ab 1 two"), id: "AB12"},
+		{name: "lower case", idCase: "lower", value: stringValue("AB12"), id: "ab12"},
+		{name: "matches pattern", pattern: `^\d{3}$`, value: stringValue("one 2 three"), id: "123"},
+		{name: "does not match pattern", pattern: `^\d{3}$`, value: stringValue("one two"), err: true},
+	}
+	for _, tt := range tests {
+		cfg := &config{EmployeeIDCase: tt.idCase}
+		if tt.pattern != "" {
+			cfg.employeeIDPattern = regexp.MustCompile(tt.pattern)
+		}
+		cs := &coffeeserver{config: cfg}
+		id, err := cs.employeeIDParameter(tt.value)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: got %q, want an error", tt.name, id)
+			}
+			continue
+		}
+		if err != nil || id != tt.id {
+			t.Errorf("%s: got %q, %v; want %q", tt.name, id, err, tt.id)
+		}
+	}
+}
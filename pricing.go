@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/replaceopt"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+)
+
+// Promotion kinds.
+const (
+	promoPercent    = "percent"       // Percent off each drink
+	promoFixedPrice = "fixed_price"   // drinks cost Price each
+	promoBuyNGetOne = "buy_n_get_one" // every (BuyN+1)th drink in an order is free
+)
+
+// promotion is a document in the promotions collection. The most generous
+// matching promotion applies to each order; promotions do not stack.
+type promotion struct {
+	Name       string   `bson:"name" json:"name"`
+	Kind       string   `bson:"kind" json:"kind"`
+	Drinks     []string `bson:"drinks" json:"drinks,omitempty"` // empty matches all drinks
+	Percent    float64  `bson:"percent" json:"percent,omitempty"`
+	Price      float64  `bson:"price" json:"price,omitempty"`
+	BuyN       int      `bson:"buyN" json:"buyN,omitempty"`
+	Days       []int    `bson:"days" json:"days,omitempty"`
+	From       string   `bson:"from" json:"from,omitempty"`
+	Until      string   `bson:"until" json:"until,omitempty"`
+	ValidFrom  string   `bson:"validFrom" json:"validFrom,omitempty"`
+	ValidUntil string   `bson:"validUntil" json:"validUntil,omitempty"`
+	Disabled   bool     `bson:"disabled" json:"disabled"`
+}
+
+func (p *promotion) window() timeWindow {
+	return timeWindow{Days: p.Days, From: p.From, Until: p.Until, ValidFrom: p.ValidFrom, ValidUntil: p.ValidUntil}
+}
+
+func (p *promotion) validate() error {
+	switch p.Kind {
+	case promoPercent:
+		if p.Percent <= 0 || p.Percent > 100 {
+			return fmt.Errorf("percent must be between 0 and 100")
+		}
+	case promoFixedPrice:
+		if p.Price < 0 {
+			return fmt.Errorf("price must not be negative")
+		}
+	case promoBuyNGetOne:
+		if p.BuyN < 1 {
+			return fmt.Errorf("buyN must be at least 1")
+		}
+	default:
+		return fmt.Errorf("kind must be %s, %s or %s", promoPercent, promoFixedPrice, promoBuyNGetOne)
+	}
+	return p.window().validate()
+}
+
+// discount returns the promotion's discount on qty drinks of coffeeType at
+// unitPrice each, ordered at t in store time.
+func (p *promotion) discount(coffeeType string, qty int, unitPrice float64, t time.Time) float64 {
+	if p.Disabled || !matchesDrink(p.Drinks, coffeeType) || !p.window().matches(t) {
+		return 0
+	}
+	switch p.Kind {
+	case promoPercent:
+		return float64(qty) * unitPrice * p.Percent / 100
+	case promoFixedPrice:
+		if p.Price < unitPrice {
+			return float64(qty) * (unitPrice - p.Price)
+		}
+	case promoBuyNGetOne:
+		return float64(qty/(p.BuyN+1)) * unitPrice
+	}
+	return 0
+}
+
+func matchesDrink(drinks []string, coffeeType string) bool {
+	if len(drinks) == 0 {
+		return true
+	}
+	for _, drink := range drinks {
+		if drink == coffeeType {
+			return true
+		}
+	}
+	return false
+}
+
+// coupon is a document in the coupons collection. A coupon takes Percent off
+// the order after promotions, then AmountOff. MaxUses of zero means unlimited.
+type coupon struct {
+	Code        string   `bson:"code" json:"code"`
+	Description string   `bson:"description" json:"description,omitempty"`
+	Percent     float64  `bson:"percent" json:"percent,omitempty"`
+	AmountOff   float64  `bson:"amountOff" json:"amountOff,omitempty"`
+	Drinks      []string `bson:"drinks" json:"drinks,omitempty"`
+	MaxUses     int      `bson:"maxUses" json:"maxUses"`
+	Uses        int      `bson:"uses" json:"uses"`
+	ValidFrom   string   `bson:"validFrom" json:"validFrom,omitempty"`
+	ValidUntil  string   `bson:"validUntil" json:"validUntil,omitempty"`
+	Disabled    bool     `bson:"disabled" json:"disabled"`
+}
+
+func (c *coupon) validate() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	if c.AmountOff < 0 {
+		return fmt.Errorf("amountOff must not be negative")
+	}
+	if c.Percent == 0 && c.AmountOff == 0 {
+		return fmt.Errorf("One of percent or amountOff is required")
+	}
+	if c.MaxUses < 0 {
+		return fmt.Errorf("maxUses must not be negative")
+	}
+	return timeWindow{ValidFrom: c.ValidFrom, ValidUntil: c.ValidUntil}.validate()
+}
+
+// normalizeCouponCode turns a spoken or typed code such as "summer 20" or
+// "summer-20" into its stored form, "SUMMER20".
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// redeemCoupon checks that a coupon can be used for the drink now and counts
+// the use. The use is counted conditionally on the number of uses read, so a
+// single-use coupon cannot be redeemed twice concurrently.
+func (cs *coffeeserver) redeemCoupon(ctx context.Context, code, coffeeType string, t time.Time) (*coupon, error) {
+	invalid := fmt.Errorf("Coupon %s is not valid", code)
+	for attempt := 0; attempt < chargeAttempts; attempt++ {
+		var c coupon
+		err := cs.withCollection(ctx, cs.config.CouponsCollectionName, "find_coupon", func(ctx context.Context, coupons *mongo.Collection) error {
+			return coupons.FindOne(ctx, bson.NewDocument(bson.EC.String("code", code))).Decode(&c)
+		})
+		if err == mongo.ErrNoDocuments {
+			return nil, invalid
+		} else if err != nil {
+			return nil, err
+		}
+		if c.Disabled || !matchesDrink(c.Drinks, coffeeType) || !(timeWindow{ValidFrom: c.ValidFrom, ValidUntil: c.ValidUntil}).matches(t) {
+			return nil, invalid
+		}
+		if c.MaxUses > 0 && c.Uses >= c.MaxUses {
+			return nil, fmt.Errorf("Coupon %s has already been used", code)
+		}
+
+		var modified int64
+		err = cs.withCollection(ctx, cs.config.CouponsCollectionName, "redeem_coupon", func(ctx context.Context, coupons *mongo.Collection) error {
+			res, err := coupons.UpdateOne(ctx,
+				bson.NewDocument(bson.EC.String("code", code), bson.EC.Int32("uses", int32(c.Uses))),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Int32("uses", 1))),
+			)
+			if err == nil {
+				modified = res.ModifiedCount
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if modified == 1 {
+			return &c, nil
+		}
+	}
+	return nil, fmt.Errorf("Unable to redeem coupon %s, please try again", code)
+}
+
+// releaseCoupon gives back a coupon use when the order it was redeemed for
+// fails.
+func (cs *coffeeserver) releaseCoupon(ctx context.Context, code string) {
+	if code == "" {
+		return
+	}
+	err := cs.withCollection(ctx, cs.config.CouponsCollectionName, "release_coupon", func(ctx context.Context, coupons *mongo.Collection) error {
+		_, err := coupons.UpdateOne(ctx,
+			bson.NewDocument(bson.EC.String("code", code)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Int32("uses", -1))),
+		)
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).WithField("coupon", code).Error("Unable to release coupon: ", err)
+	}
+}
+
+// orderDiscount is a discount itemised on an order.
+type orderDiscount struct {
+	Name   string  `bson:"name" json:"name"`
+	Kind   string  `bson:"kind" json:"kind"`
+	Amount float64 `bson:"amount" json:"amount"`
+}
+
+// priceQuote is the price of an order after promotions and any coupon.
+type priceQuote struct {
+	UnitPrice float64
+	Subtotal  float64
+	Discounts []orderDiscount
+	Total     float64
+	Coupon    string
+}
+
+func roundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+func (cs *coffeeserver) listPromotions(ctx context.Context) ([]promotion, error) {
+	var promotions []promotion
+	err := cs.withCollection(ctx, cs.config.PromotionsCollectionName, "list_promotions", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, bson.NewDocument())
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var p promotion
+			if err := cur.Decode(&p); err != nil {
+				return err
+			}
+			promotions = append(promotions, p)
+		}
+		return cur.Err()
+	})
+	return promotions, err
+}
+
+// priceOrder prices qty drinks of coffeeType at site s, applying the best
+// promotion and redeeming couponCode if one is given. If the order later fails
+// the caller must release the coupon.
+func (cs *coffeeserver) priceOrder(ctx context.Context, s *site, coffeeType string, qty int, couponCode string) (*priceQuote, error) {
+	price, err := drinkPrice(s, coffeeType)
+	if err != nil {
+		return nil, err
+	}
+	now := cs.storeTime(time.Now())
+	quote := &priceQuote{UnitPrice: price, Subtotal: roundMoney(price * float64(qty))}
+	remaining := quote.Subtotal
+
+	promotions, err := cs.listPromotions(ctx)
+	if err != nil {
+		// Charge full price rather than refusing orders.
+		cs.logger(ctx).Error("Unable to list promotions: ", err)
+	}
+	if best := bestPromotion(promotions, coffeeType, qty, quote.UnitPrice, remaining, now); best.Amount > 0 {
+		quote.Discounts = append(quote.Discounts, best)
+		remaining -= best.Amount
+	}
+
+	if couponCode != "" {
+		c, err := cs.redeemCoupon(ctx, couponCode, coffeeType, now)
+		if err != nil {
+			return nil, err
+		}
+		quote.Coupon = c.Code
+		discount := couponDiscount(c, remaining)
+		quote.Discounts = append(quote.Discounts, discount)
+		remaining -= discount.Amount
+	}
+
+	quote.Total = roundMoney(remaining)
+	return quote, nil
+}
+
+// bestPromotion returns the most generous of promotions on qty drinks of
+// coffeeType at unitPrice each, ordered at t in store time, taking no more
+// than subtotal off. Its Amount is zero if none apply.
+func bestPromotion(promotions []promotion, coffeeType string, qty int, unitPrice, subtotal float64, t time.Time) orderDiscount {
+	var best orderDiscount
+	for i := range promotions {
+		if amount := roundMoney(promotions[i].discount(coffeeType, qty, unitPrice, t)); amount > best.Amount {
+			best = orderDiscount{Name: promotions[i].Name, Kind: promotions[i].Kind, Amount: math.Min(amount, subtotal)}
+		}
+	}
+	return best
+}
+
+// couponDiscount returns coupon c's discount on an order that costs remaining
+// after promotions.
+func couponDiscount(c *coupon, remaining float64) orderDiscount {
+	name := c.Description
+	if name == "" {
+		name = "Coupon " + c.Code
+	}
+	amount := roundMoney(math.Min(remaining*c.Percent/100+c.AmountOff, remaining))
+	return orderDiscount{Name: name, Kind: "coupon", Amount: amount}
+}
+
+// describeDiscounts summarises an order's discounts for the reply to the
+// employee.
+func (cs *coffeeserver) describeDiscounts(discounts []orderDiscount) string {
+	var parts []string
+	for _, d := range discounts {
+		parts = append(parts, fmt.Sprintf("%s saves %s", d.Name, cs.formatMoney(d.Amount)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// promotionsHandler lists the promotions.
+func (cs *coffeeserver) promotionsHandler(w http.ResponseWriter, r *http.Request) {
+	promotions, err := cs.listPromotions(r.Context())
+	if err != nil {
+		cs.logger(r.Context()).Error("Unable to list promotions: ", err)
+		http.Error(w, "Unable to list promotions", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, promotions)
+}
+
+// promotionHandler creates or replaces (PUT) or removes (DELETE) a promotion.
+func (cs *coffeeserver) promotionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+
+	if r.Method == http.MethodDelete {
+		cs.deleteDocument(w, r, cs.config.PromotionsCollectionName, "name", name, auditPricingChanged)
+		return
+	}
+
+	var p promotion
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	p.Name = name
+	if err := p.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := cs.withCollection(ctx, cs.config.PromotionsCollectionName, "set_promotion", func(ctx context.Context, promotions *mongo.Collection) error {
+		_, err := promotions.ReplaceOne(ctx, bson.NewDocument(bson.EC.String("name", name)), &p, replaceopt.Upsert(true))
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to set promotion: ", err)
+		http.Error(w, "Unable to set promotion", http.StatusInternalServerError)
+		return
+	}
+	cs.audit(ctx, auditPricingChanged, "", map[string]interface{}{"promotion": name})
+	writeJSON(w, http.StatusOK, p)
+}
+
+// couponsHandler lists the coupons.
+func (cs *coffeeserver) couponsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var coupons []coupon
+	err := cs.withCollection(ctx, cs.config.CouponsCollectionName, "list_coupons", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, bson.NewDocument())
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var c coupon
+			if err := cur.Decode(&c); err != nil {
+				return err
+			}
+			coupons = append(coupons, c)
+		}
+		return cur.Err()
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to list coupons: ", err)
+		http.Error(w, "Unable to list coupons", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, coupons)
+}
+
+// couponHandler creates or replaces (PUT) or removes (DELETE) a coupon.
+// Replacing a coupon keeps its use count.
+func (cs *coffeeserver) couponHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	code := normalizeCouponCode(mux.Vars(r)["code"])
+
+	if r.Method == http.MethodDelete {
+		cs.deleteDocument(w, r, cs.config.CouponsCollectionName, "code", code, auditPricingChanged)
+		return
+	}
+
+	var c coupon
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	c.Code = code
+	if err := c.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	drinks := bson.NewArray()
+	for _, drink := range c.Drinks {
+		drinks.Append(bson.VC.String(drink))
+	}
+	err := cs.withCollection(ctx, cs.config.CouponsCollectionName, "set_coupon", func(ctx context.Context, coupons *mongo.Collection) error {
+		_, err := coupons.UpdateOne(ctx,
+			bson.NewDocument(bson.EC.String("code", code)),
+			bson.NewDocument(
+				bson.EC.SubDocumentFromElements("$set",
+					bson.EC.String("description", c.Description),
+					bson.EC.Double("percent", c.Percent),
+					bson.EC.Double("amountOff", c.AmountOff),
+					bson.EC.Array("drinks", drinks),
+					bson.EC.Int32("maxUses", int32(c.MaxUses)),
+					bson.EC.String("validFrom", c.ValidFrom),
+					bson.EC.String("validUntil", c.ValidUntil),
+					bson.EC.Boolean("disabled", c.Disabled),
+				),
+				bson.EC.SubDocumentFromElements("$setOnInsert", bson.EC.Int32("uses", 0)),
+			),
+			updateopt.Upsert(true),
+		)
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to set coupon: ", err)
+		http.Error(w, "Unable to set coupon", http.StatusInternalServerError)
+		return
+	}
+	cs.audit(ctx, auditPricingChanged, "", map[string]interface{}{"coupon": code})
+	writeJSON(w, http.StatusOK, c)
+}
+
+// deleteDocument deletes the document whose key field is value and audits the
+// deletion as event.
+func (cs *coffeeserver) deleteDocument(w http.ResponseWriter, r *http.Request, collection, key, value, event string) {
+	ctx := r.Context()
+	var deleted int64
+	err := cs.withCollection(ctx, collection, "delete_"+key, func(ctx context.Context, coll *mongo.Collection) error {
+		res, err := coll.DeleteOne(ctx, bson.NewDocument(bson.EC.String(key, value)))
+		if err == nil {
+			deleted = res.DeletedCount
+		}
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to delete: ", err)
+		http.Error(w, "Unable to delete", http.StatusInternalServerError)
+		return
+	}
+	if deleted == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	cs.audit(ctx, event, "", map[string]interface{}{key: value, "deleted": true})
+	w.WriteHeader(http.StatusNoContent)
+}
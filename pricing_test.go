@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPromotionDiscount(t *testing.T) {
+	// Monday 3 September 2018, mid afternoon.
+	monday := time.Date(2018, 9, 3, 15, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		promo promotion
+		drink string
+		qty   int
+		want  float64
+	}{
+		{"percent", promotion{Kind: promoPercent, Percent: 20}, "latte", 2, 1.6},
+		{"fixed price", promotion{Kind: promoFixedPrice, Price: 3}, "latte", 2, 2},
+		{"fixed price above unit price", promotion{Kind: promoFixedPrice, Price: 5}, "latte", 2, 0},
+		{"buy two get one", promotion{Kind: promoBuyNGetOne, BuyN: 2}, "latte", 3, 4},
+		{"buy two get one, too few", promotion{Kind: promoBuyNGetOne, BuyN: 2}, "latte", 2, 0},
+		{"buy one get one, several free", promotion{Kind: promoBuyNGetOne, BuyN: 1}, "latte", 5, 8},
+		{"matching drink", promotion{Kind: promoPercent, Percent: 50, Drinks: []string{"mocha", "latte"}}, "latte", 1, 2},
+		{"other drink", promotion{Kind: promoPercent, Percent: 50, Drinks: []string{"mocha"}}, "latte", 1, 0},
+		{"disabled", promotion{Kind: promoPercent, Percent: 50, Disabled: true}, "latte", 1, 0},
+		{"happy hour", promotion{Kind: promoPercent, Percent: 50, Days: []int{1, 2}, From: "15:00", Until: "16:00"}, "latte", 1, 2},
+		{"happy hour over", promotion{Kind: promoPercent, Percent: 50, From: "14:00", Until: "15:30"}, "latte", 1, 0},
+		{"wrong day", promotion{Kind: promoPercent, Percent: 50, Days: []int{0, 6}}, "latte", 1, 0},
+		{"within validity", promotion{Kind: promoPercent, Percent: 50, ValidFrom: "2018-09-03", ValidUntil: "2018-09-03"}, "latte", 1, 2},
+		{"expired", promotion{Kind: promoPercent, Percent: 50, ValidUntil: "2018-09-02"}, "latte", 1, 0},
+		{"not started", promotion{Kind: promoPercent, Percent: 50, ValidFrom: "2018-09-04"}, "latte", 1, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.promo.discount(tt.drink, tt.qty, 4, monday); !moneyEqual(got, tt.want) {
+			t.Errorf("%s: got %.2f, want %.2f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBestPromotion(t *testing.T) {
+	now := time.Date(2018, 9, 3, 15, 30, 0, 0, time.UTC)
+	promotions := []promotion{
+		{Name: "Ten off", Kind: promoPercent, Percent: 10},
+		{Name: "Three dollar lattes", Kind: promoFixedPrice, Price: 3, Drinks: []string{"latte"}},
+		{Name: "Mocha madness", Kind: promoPercent, Percent: 90, Drinks: []string{"mocha"}},
+		{Name: "Disabled", Kind: promoPercent, Percent: 100, Disabled: true},
+	}
+
+	tests := []struct {
+		name     string
+		drink    string
+		qty      int
+		subtotal float64
+		want     orderDiscount
+	}{
+		{"most generous", "latte", 2, 8, orderDiscount{Name: "Three dollar lattes", Kind: promoFixedPrice, Amount: 2}},
+		{"only matching", "flat white", 2, 8, orderDiscount{Name: "Ten off", Kind: promoPercent, Amount: 0.8}},
+		{"no more than subtotal", "mocha", 1, 1, orderDiscount{Name: "Mocha madness", Kind: promoPercent, Amount: 1}},
+	}
+	for _, tt := range tests {
+		got := bestPromotion(promotions, tt.drink, tt.qty, 4, tt.subtotal, now)
+		if got.Name != tt.want.Name || got.Kind != tt.want.Kind || !moneyEqual(got.Amount, tt.want.Amount) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if got := bestPromotion(promotions[2:], "latte", 2, 4, 8, now); got.Amount != 0 {
+		t.Errorf("no promotion applies but got %+v", got)
+	}
+}
+
+func TestCouponDiscount(t *testing.T) {
+	tests := []struct {
+		name      string
+		coupon    coupon
+		remaining float64
+		want      orderDiscount
+	}{
+		{"percent", coupon{Code: "SAVE10", Percent: 10}, 8, orderDiscount{Name: "Coupon SAVE10", Kind: "coupon", Amount: 0.8}},
+		{"amount off", coupon{Code: "ONEOFF", Description: "A dollar off", AmountOff: 1}, 8, orderDiscount{Name: "A dollar off", Kind: "coupon", Amount: 1}},
+		{"percent then amount", coupon{Code: "BOTH", Percent: 25, AmountOff: 1}, 8, orderDiscount{Name: "Coupon BOTH", Kind: "coupon", Amount: 3}},
+		{"no more than remaining", coupon{Code: "FREE", AmountOff: 10}, 3.5, orderDiscount{Name: "Coupon FREE", Kind: "coupon", Amount: 3.5}},
+		{"rounded", coupon{Code: "THIRD", Percent: 33.333}, 4.5, orderDiscount{Name: "Coupon THIRD", Kind: "coupon", Amount: 1.5}},
+	}
+	for _, tt := range tests {
+		got := couponDiscount(&tt.coupon, tt.remaining)
+		if got.Name != tt.want.Name || got.Kind != tt.want.Kind || got.Amount != tt.want.Amount {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeCouponCode(t *testing.T) {
+	for spoken, want := range map[string]string{
+		"SUMMER20":     "SUMMER20",
+		"summer 20":    "SUMMER20",
+		"summer-20":    "SUMMER20",
+		"Summer - 2 0": "SUMMER20",
+	} {
+		if got := normalizeCouponCode(spoken); got != want {
+			t.Errorf("normalizeCouponCode(%q) = %q, want %q", spoken, got, want)
+		}
+	}
+}
+
+func TestPromotionValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		promo promotion
+		ok    bool
+	}{
+		{"percent", promotion{Kind: promoPercent, Percent: 10}, true},
+		{"percent over 100", promotion{Kind: promoPercent, Percent: 110}, false},
+		{"negative price", promotion{Kind: promoFixedPrice, Price: -1}, false},
+		{"buy none", promotion{Kind: promoBuyNGetOne}, false},
+		{"unknown kind", promotion{Kind: "bogof"}, false},
+		{"bad day", promotion{Kind: promoPercent, Percent: 10, Days: []int{7}}, false},
+		{"bad time", promotion{Kind: promoPercent, Percent: 10, From: "3pm"}, false},
+		{"bad date", promotion{Kind: promoPercent, Percent: 10, ValidUntil: "03/09/2018"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.promo.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+)
+
+// Roles. Employees, baristas, finance and admins are people; kiosks are
+// devices authenticating with an API key.
+const (
+	roleEmployee = "employee"
+	roleBarista  = "barista"
+	roleFinance  = "finance"
+	roleAdmin    = "admin"
+	roleKiosk    = "kiosk"
+)
+
+// Permissions.
+const (
+	permPlaceOrder     = "order:place"
+	permReadAccount    = "account:read"
+	permManagePIN      = "account:pin"
+	permManageAccounts = "account:manage"
+	permBaristaQueue   = "orders:queue"
+	permReadReports    = "reports:read"
+	permManageRoles    = "roles:manage"
+	permManageAPIKeys  = "apikeys:manage"
+	permTapBadge       = "badge:tap"
+	permManageBadges   = "badges:manage"
+	permManageSubsidy  = "subsidies:manage"
+	permManagePricing  = "pricing:manage"
+	permRefundOrders   = "orders:refund"
+	permManageStock    = "inventory:manage"
+	permManageSites    = "sites:manage"
+	permReviewTalk     = "conversations:review"
+	permAll            = "*"
+)
+
+var rolePermissions = map[string][]string{
+	roleEmployee: {permPlaceOrder, permReadAccount, permManagePIN},
+	roleKiosk:    {permPlaceOrder, permTapBadge},
+	roleBarista:  {permBaristaQueue, permManageStock},
+	roleFinance:  {permManageAccounts, permReadReports, permManageSubsidy, permManagePricing, permRefundOrders},
+	roleAdmin:    {permAll},
+}
+
+// routePermissions maps mux route names to the permission needed to use
+// them. Routes wrapped in authHandler that are missing from this table are
+// denied.
+var routePermissions = map[string]string{
+	"order":               permPlaceOrder,
+	"account":             permReadAccount,
+	"account-pin":         permManagePIN,
+	"roles":               permManageRoles,
+	"apikeys":             permManageAPIKeys,
+	"apikey-revoke":       permManageAPIKeys,
+	"badge-tap":           permTapBadge,
+	"badge-session":       permTapBadge,
+	"badges":              permManageBadges,
+	"policies":            permManageAccounts,
+	"account-policy":      permManageAccounts,
+	"cost-centres":        permManageSubsidy,
+	"subsidies":           permManageSubsidy,
+	"subsidy":             permManageSubsidy,
+	"subsidy-report":      permReadReports,
+	"promotions":          permManagePricing,
+	"promotion":           permManagePricing,
+	"coupons":             permManagePricing,
+	"coupon":              permManagePricing,
+	"order-refund":        permRefundOrders,
+	"menu":                permPlaceOrder,
+	"standing-orders":     permPlaceOrder,
+	"my-orders":           permReadAccount,
+	"my-order":            permReadAccount,
+	"statement":           permReadAccount,
+	"statement-email":     permReadAccount,
+	"favourites":          permPlaceOrder,
+	"favourite":           permPlaceOrder,
+	"reorder":             permPlaceOrder,
+	"standing-order":      permPlaceOrder,
+	"groups":              permPlaceOrder,
+	"group":               permPlaceOrder,
+	"group-items":         permPlaceOrder,
+	"group-submit":        permPlaceOrder,
+	"queue":               permBaristaQueue,
+	"order-status":        permBaristaQueue,
+	"order-ticket":        permBaristaQueue,
+	"order-progress":      permPlaceOrder,
+	"group-status":        permBaristaQueue,
+	"sites":               permManageSites,
+	"site":                permManageSites,
+	"site-report":         permReadReports,
+	"inventory":           permManageStock,
+	"conversations":       permReviewTalk,
+	"conversation":        permReviewTalk,
+	"conversation-audio":  permReviewTalk,
+	"conversation-replay": permReviewTalk,
+	"ingredient":          permManageStock,
+	"restock":             permManageStock,
+	"recipes":             permManageStock,
+	"recipe":              permManageStock,
+}
+
+// Principal kinds.
+const (
+	principalAnonymous = "anonymous"
+	principalEmployee  = "employee"
+	principalAPIKey    = "apikey"
+)
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	Kind       string
+	EmployeeID string // for employees
+	Name       string // for API keys
+	KeyID      string // for API keys: the key's ID, as names need not be unique
+	Site       string // for API keys bound to a site
+	Roles      []string
+}
+
+func (p *principal) can(permission string) bool {
+	for _, role := range p.Roles {
+		for _, perm := range rolePermissions[role] {
+			if perm == permission || perm == permAll {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *principal) String() string {
+	switch p.Kind {
+	case principalEmployee:
+		return "employee:" + p.EmployeeID
+	case principalAPIKey:
+		return "apikey:" + p.Name
+	}
+	return principalAnonymous
+}
+
+type principalKey struct{}
+
+func principalFromContext(ctx context.Context) *principal {
+	if p, ok := ctx.Value(principalKey{}).(*principal); ok {
+		return p
+	}
+	return &principal{Kind: principalAnonymous}
+}
+
+// routeName returns the name of the mux route that matched r.
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		return route.GetName()
+	}
+	return ""
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// employeeRoles returns the roles assigned to an employee. Every employee has
+// the employee role; employees listed in auth.admins are always admins so
+// that roles can be bootstrapped.
+func (cs *coffeeserver) employeeRoles(ctx context.Context, employeeID string) []string {
+	roles := []string{roleEmployee}
+	for _, admin := range splitList(cs.config.AuthAdmins) {
+		if admin == employeeID {
+			roles = append(roles, roleAdmin)
+		}
+	}
+
+	var assignment struct {
+		Roles []string `bson:"roles"`
+	}
+	err := cs.withCollection(ctx, cs.config.RolesCollectionName, "find_roles", func(ctx context.Context, assignments *mongo.Collection) error {
+		return assignments.FindOne(ctx, bson.NewDocument(bson.EC.String("employeeId", employeeID))).Decode(&assignment)
+	})
+	if err != nil && err != mongo.ErrNoDocuments {
+		cs.logger(ctx).Error("Unable to look up roles for ", employeeID, ": ", err)
+	}
+
+	return append(roles, assignment.Roles...)
+}
+
+type rolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// rolesHandler shows (GET) or replaces (PUT) an employee's role assignments.
+func (cs *coffeeserver) rolesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID := mux.Vars(r)["employeeId"]
+
+	if r.Method == http.MethodPut {
+		var req rolesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		roles := bson.NewArray()
+		for _, role := range req.Roles {
+			if !validRole(role) || role == roleKiosk {
+				http.Error(w, fmt.Sprintf("Unknown role %q", role), http.StatusBadRequest)
+				return
+			}
+			roles.Append(bson.VC.String(role))
+		}
+
+		err := cs.withCollection(ctx, cs.config.RolesCollectionName, "set_roles", func(ctx context.Context, assignments *mongo.Collection) error {
+			_, err := assignments.UpdateOne(ctx,
+				bson.NewDocument(bson.EC.String("employeeId", employeeID)),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.Array("roles", roles))),
+				updateopt.Upsert(true),
+			)
+			return err
+		})
+		if err != nil {
+			cs.logger(ctx).Error("Unable to set roles: ", err)
+			http.Error(w, "Unable to set roles", http.StatusInternalServerError)
+			return
+		}
+		cs.audit(ctx, auditRolesChanged, employeeID, map[string]interface{}{"roles": strings.Join(req.Roles, ",")})
+	}
+
+	roles := cs.employeeRoles(ctx, employeeID)
+	sort.Strings(roles)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"employeeId": employeeID, "roles": roles})
+}
+
+// apiKey is a document in the API keys collection. Only a SHA-256 hash of the
+// key is stored; the key itself is shown once when it is created.
+type apiKey struct {
+	ID        objectid.ObjectID `bson:"_id,omitempty" json:"-"`
+	IDHex     string            `bson:"-" json:"id"`
+	Name      string            `bson:"name" json:"name"`
+	KeyHash   string            `bson:"keyHash" json:"-"`
+	Roles     []string          `bson:"roles" json:"roles"`
+	Site      string            `bson:"site,omitempty" json:"site,omitempty"`
+	CreatedAt int64             `bson:"createdAt" json:"createdAt"`
+	Revoked   bool              `bson:"revoked" json:"revoked"`
+}
+
+const apiKeyHeader = "X-API-Key"
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (cs *coffeeserver) findAPIKey(ctx context.Context, key string) (*apiKey, error) {
+	var k apiKey
+	err := cs.withCollection(ctx, cs.config.APIKeysCollectionName, "find_apikey", func(ctx context.Context, keys *mongo.Collection) error {
+		return keys.FindOne(ctx, bson.NewDocument(
+			bson.EC.String("keyHash", hashAPIKey(key)),
+			bson.EC.Boolean("revoked", false),
+		)).Decode(&k)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("Unknown or revoked API key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+type apiKeyRequest struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+	Site  string   `json:"site"`
+}
+
+// apiKeysHandler lists (GET) or creates (POST) API keys for kiosks and other
+// devices.
+func (cs *coffeeserver) apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method == http.MethodGet {
+		var keys []apiKey
+		err := cs.withCollection(ctx, cs.config.APIKeysCollectionName, "list_apikeys", func(ctx context.Context, coll *mongo.Collection) error {
+			cur, err := coll.Find(ctx, bson.NewDocument())
+			if err != nil {
+				return err
+			}
+			defer cur.Close(ctx)
+			for cur.Next(ctx) {
+				var k apiKey
+				if err := cur.Decode(&k); err != nil {
+					return err
+				}
+				k.IDHex = k.ID.Hex()
+				keys = append(keys, k)
+			}
+			return cur.Err()
+		})
+		if err != nil {
+			cs.logger(ctx).Error("Unable to list API keys: ", err)
+			http.Error(w, "Unable to list API keys", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, keys)
+		return
+	}
+
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, "A name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Roles) == 0 {
+		req.Roles = []string{roleKiosk}
+	}
+	for _, role := range req.Roles {
+		if !validRole(role) {
+			http.Error(w, fmt.Sprintf("Unknown role %q", role), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := cs.getSite(ctx, req.Site); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "Unable to create API key", http.StatusInternalServerError)
+		return
+	}
+	key := "ck_" + base64.RawURLEncoding.EncodeToString(b)
+
+	k := apiKey{
+		ID:        objectid.New(),
+		Name:      req.Name,
+		KeyHash:   hashAPIKey(key),
+		Roles:     req.Roles,
+		Site:      req.Site,
+		CreatedAt: time.Now().Unix(),
+	}
+	err := cs.withCollection(ctx, cs.config.APIKeysCollectionName, "insert_apikey", func(ctx context.Context, keys *mongo.Collection) error {
+		_, err := keys.InsertOne(ctx, &k)
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to create API key: ", err)
+		http.Error(w, "Unable to create API key", http.StatusInternalServerError)
+		return
+	}
+	cs.audit(ctx, auditAPIKeyCreated, "", map[string]interface{}{"name": k.Name, "id": k.ID.Hex(), "roles": strings.Join(k.Roles, ","), "site": k.Site})
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": k.ID.Hex(), "name": k.Name, "roles": k.Roles, "site": k.Site, "key": key})
+}
+
+// revokeAPIKeyHandler revokes an API key by ID.
+func (cs *coffeeserver) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := objectid.FromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	var matched int64
+	err = cs.withCollection(ctx, cs.config.APIKeysCollectionName, "revoke_apikey", func(ctx context.Context, keys *mongo.Collection) error {
+		res, err := keys.UpdateOne(ctx,
+			bson.NewDocument(bson.EC.ObjectID("_id", id)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.Boolean("revoked", true))),
+		)
+		if err == nil {
+			matched = res.MatchedCount
+		}
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to revoke API key: ", err)
+		http.Error(w, "Unable to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if matched == 0 {
+		http.Error(w, "Unknown API key", http.StatusNotFound)
+		return
+	}
+	cs.audit(ctx, auditAPIKeyRevoked, "", map[string]interface{}{"id": id.Hex()})
+	w.WriteHeader(http.StatusNoContent)
+}
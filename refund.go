@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+var errAlreadyRefunded = fmt.Errorf("Unknown or already refunded order")
+
+// refundOrder refunds an order and returns the amount credited to the
+// employee: what they paid from their balance and, within the same month,
+// their allowance. The order is taken off their spending for the day and week
+// if those have not passed, any subsidy is returned to its cost centre and the
+// order's loyalty stamps are reversed. Stock used is not restored.
+func (cs *coffeeserver) refundOrder(ctx context.Context, id objectid.ObjectID) (*coffeeOrder, float64, error) {
+	// Marking the order refunded first makes concurrent refunds of the same
+	// order safe; only one of them matches.
+	var order coffeeOrder
+	err := cs.withCollection(ctx, cs.config.OrdersCollectionName, "refund_order", func(ctx context.Context, orders *mongo.Collection) error {
+		return orders.FindOneAndUpdate(ctx,
+			bson.NewDocument(
+				bson.EC.ObjectID("_id", id),
+				bson.EC.SubDocumentFromElements("refunded", bson.EC.Boolean("$ne", true)),
+			),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set",
+				bson.EC.Boolean("refunded", true),
+				bson.EC.Int64("refundedAt", time.Now().Unix()),
+			)),
+		).Decode(&order)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, 0, errAlreadyRefunded
+	} else if err != nil {
+		cs.logger(ctx).Error("Unable to refund order: ", err)
+		return nil, 0, fmt.Errorf("Unable to refund order")
+	}
+
+	var credited float64
+	if order.Charge != nil {
+		if credited, err = cs.refundCharge(ctx, order.EmployeeID, order.Charge); err != nil {
+			return nil, 0, fmt.Errorf("Order marked refunded but the account could not be credited")
+		}
+	}
+	cs.reverseStamps(ctx, order.EmployeeID, order.StampsEarned, order.StampsRedeemed)
+	cs.refundSubsidy(ctx, order.Subsidy)
+
+	cs.audit(ctx, auditOrderRefunded, order.EmployeeID, map[string]interface{}{
+		"order":  id.Hex(),
+		"amount": credited,
+	})
+	return &order, credited, nil
+}
+
+// refundOrderHandler refunds an order.
+func (cs *coffeeserver) refundOrderHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := objectid.FromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	_, credited, err := cs.refundOrder(r.Context(), id)
+	if err == errAlreadyRefunded {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":       id.Hex(),
+		"refunded": credited,
+		"currency": cs.config.Currency,
+	})
+}
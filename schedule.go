@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/mongodb/mongo-go-driver/mongo/mongoopt"
+)
+
+// holiday reports whether t, in store time, falls on a store-wide holiday
+// or one of the site's holidays.
+func (cs *coffeeserver) holiday(s *site, t time.Time) bool {
+	date := t.Format("2006-01-02")
+	holidays := splitList(cs.config.Holidays)
+	if s != nil {
+		holidays = append(holidays, s.Holidays...)
+	}
+	for _, h := range holidays {
+		if h == date {
+			return true
+		}
+	}
+	return false
+}
+
+// siteOpen reports whether site s (nil for no site) takes orders for t, which
+// must be in store time.
+func (cs *coffeeserver) siteOpen(s *site, t time.Time) bool {
+	if cs.holiday(s, t) {
+		return false
+	}
+	return s == nil || s.open(t)
+}
+
+// nextOpening returns the first time from t on when s is open, looking up to
+// two weeks ahead.
+func (cs *coffeeserver) nextOpening(s *site, t time.Time) (time.Time, bool) {
+	if cs.siteOpen(s, t) {
+		return t, true
+	}
+	for day := 0; day < 14; day++ {
+		d := t.AddDate(0, 0, day)
+		midnight := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, t.Location())
+
+		candidates := []time.Time{midnight}
+		if s != nil && len(s.Hours) > 0 {
+			candidates = nil
+			for _, h := range s.Hours {
+				opens, err := time.Parse("15:04", h.Opens)
+				if err != nil {
+					continue
+				}
+				candidates = append(candidates, midnight.Add(time.Duration(opens.Hour())*time.Hour+time.Duration(opens.Minute())*time.Minute))
+			}
+		}
+
+		var best time.Time
+		for _, c := range candidates {
+			if c.After(t) && cs.siteOpen(s, c) && (best.IsZero() || c.Before(best)) {
+				best = c
+			}
+		}
+		if !best.IsZero() {
+			return best, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// closedError is returned for orders placed or scheduled when the site is
+// closed. Its message can be read back to the employee.
+type closedError struct {
+	site string
+	next time.Time
+}
+
+func (e *closedError) Error() string {
+	msg := "Sorry, we're closed"
+	if e.site != "" {
+		msg = fmt.Sprintf("Sorry, %s is closed", e.site)
+	}
+	if e.next.IsZero() {
+		return msg
+	}
+	return fmt.Sprintf("%s. We open again %s", msg, describePickup(e.next, time.Now().In(e.next.Location())))
+}
+
+func siteName(s *site) string {
+	if s == nil {
+		return ""
+	}
+	return s.Name
+}
+
+// describePickup describes t for a voice reply: "at 09:30" if it is on the
+// same day as now, otherwise "on Tuesday at 09:30".
+func describePickup(t, now time.Time) string {
+	if t.Year() == now.Year() && t.YearDay() == now.YearDay() {
+		return t.Format("at 15:04")
+	}
+	return t.Format("on Monday at 15:04")
+}
+
+// parsePickupTime parses a Dialogflow @sys.time or @sys.date-time value,
+// either a full RFC 3339 time or a time of day. A time of day that has
+// already passed today means tomorrow.
+func parsePickupTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(now.Location()), nil
+	}
+	clock, err := time.Parse("15:04:05", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Sorry, I didn't understand the pickup time")
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, now.Location())
+	if t.Before(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// schedulePickup decides when an order for site s will be made. It returns the
+// zero time for an order to be made now, or the pickup time of a scheduled
+// order. pickup is the requested pickup time, or zero for as soon as
+// possible; orders placed when the site is closed are rejected or, if
+// orders.outside_hours is "schedule", scheduled for when it opens.
+func (cs *coffeeserver) schedulePickup(s *site, pickup time.Time) (time.Time, error) {
+	now := cs.storeTime(time.Now())
+
+	if pickup.IsZero() {
+		if cs.siteOpen(s, now) {
+			return time.Time{}, nil
+		}
+		next, ok := cs.nextOpening(s, now)
+		if ok && cs.config.OrdersOutsideHours == "schedule" {
+			return next, nil
+		}
+		return time.Time{}, &closedError{site: siteName(s), next: next}
+	}
+
+	pickup = cs.storeTime(pickup)
+	switch {
+	case pickup.Before(now):
+		return time.Time{}, fmt.Errorf("Sorry, that time has already passed")
+	case pickup.After(now.Add(cs.config.OrdersMaxScheduleAhead)):
+		return time.Time{}, fmt.Errorf("Sorry, orders can only be placed up to %s ahead", cs.config.OrdersMaxScheduleAhead)
+	case !cs.siteOpen(s, pickup):
+		next, _ := cs.nextOpening(s, pickup)
+		return time.Time{}, &closedError{site: siteName(s), next: next}
+	case pickup.Before(now.Add(cs.config.OrdersScheduleLead)) && cs.siteOpen(s, now):
+		// Too soon to be worth scheduling.
+		return time.Time{}, nil
+	}
+	return pickup, nil
+}
+
+// runScheduler runs the background jobs every scheduler.interval until ctx is
+// cancelled. The jobs are safe to run from several instances at once.
+func (cs *coffeeserver) runScheduler(ctx context.Context) {
+	if cs.mongo == nil {
+		return
+	}
+	ticker := time.NewTicker(cs.config.SchedulerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cs.placeStandingOrders(ctx)
+			cs.closeExpiredGroups(ctx)
+			cs.releaseScheduledOrders(ctx)
+			cs.sendMonthlyStatements(ctx)
+			cs.purgeConversations(ctx)
+		}
+	}
+}
+
+// releaseScheduledOrders moves scheduled orders into their site's barista
+// queue orders.schedule_lead before their pickup time, and prints their
+// tickets. Orders are claimed one at a time so that each is only printed by
+// the instance that released it.
+func (cs *coffeeserver) releaseScheduledOrders(ctx context.Context) {
+	var released []coffeeOrder
+	err := cs.withCollection(ctx, cs.config.OrdersCollectionName, "release_scheduled", func(ctx context.Context, orders *mongo.Collection) error {
+		for {
+			var order coffeeOrder
+			err := orders.FindOneAndUpdate(ctx,
+				bson.NewDocument(
+					bson.EC.String("status", statusScheduled),
+					bson.EC.SubDocumentFromElements("releaseAt", bson.EC.Int64("$lte", time.Now().Unix())),
+					// Refunding is how a scheduled order is cancelled.
+					bson.EC.SubDocumentFromElements("refunded", bson.EC.Boolean("$ne", true)),
+				),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("status", statusQueued))),
+				findopt.ReturnDocument(mongoopt.After),
+			).Decode(&order)
+			if err == mongo.ErrNoDocuments {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			released = append(released, order)
+		}
+	})
+	if err != nil {
+		cs.log.Error("Unable to release scheduled orders: ", err)
+	}
+	if len(released) > 0 {
+		cs.log.Info("Released ", len(released), " scheduled orders to the barista queue")
+		cs.printReleasedOrders(ctx, released)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePickupTime(t *testing.T) {
+	sydney := time.FixedZone("AEST", 10*60*60)
+	// Monday 3 September 2018, 10:15 in Sydney.
+	now := time.Date(2018, 9, 3, 10, 15, 0, 0, sydney)
+
+	tests := []struct {
+		value string
+		want  time.Time
+		err   bool
+	}{
+		{value: "14:30:00", want: time.Date(2018, 9, 3, 14, 30, 0, 0, sydney)},
+		{value: "10:15:00", want: time.Date(2018, 9, 3, 10, 15, 0, 0, sydney)},
+		{value: "09:00:00", want: time.Date(2018, 9, 4, 9, 0, 0, 0, sydney)},
+		{value: "2018-09-05T08:00:00+10:00", want: time.Date(2018, 9, 5, 8, 0, 0, 0, sydney)},
+		{value: "2018-09-04T22:00:00Z", want: time.Date(2018, 9, 5, 8, 0, 0, 0, sydney)},
+		{value: "", err: true},
+		{value: "half past two", err: true},
+		{value: "25:00:00", err: true},
+		{value: "2018-09-05", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePickupTime(tt.value, now)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parsePickupTime(%q) = %v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePickupTime(%q): %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.want) || got.Location() != sydney {
+			t.Errorf("parsePickupTime(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDescribePickup(t *testing.T) {
+	now := time.Date(2018, 9, 3, 10, 15, 0, 0, time.UTC)
+	tests := []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Date(2018, 9, 3, 14, 30, 0, 0, time.UTC), "at 14:30"},
+		{time.Date(2018, 9, 4, 9, 5, 0, 0, time.UTC), "on Tuesday at 09:05"},
+		{time.Date(2019, 9, 3, 14, 30, 0, 0, time.UTC), "on Tuesday at 14:30"},
+	}
+	for _, tt := range tests {
+		if got := describePickup(tt.t, now); got != tt.want {
+			t.Errorf("describePickup(%v) = %q, want %q", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestNextOpening(t *testing.T) {
+	cs := &coffeeserver{config: &config{Holidays: "2018-09-10"}}
+	s := &site{
+		Hours: []siteHours{
+			{Days: []int{1, 2, 3, 4, 5}, Opens: "07:30", Closes: "15:00"},
+			{Days: []int{6}, Opens: "09:00", Closes: "12:00"},
+		},
+		Holidays: []string{"2018-09-04"},
+	}
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2018, 9, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		site *site
+		t    time.Time
+		want time.Time
+		ok   bool
+	}{
+		{"open now", s, at(3, 10, 0), at(3, 10, 0), true},
+		{"before opening", s, at(3, 6, 0), at(3, 7, 30), true},
+		{"after closing, next day a site holiday", s, at(3, 16, 0), at(5, 7, 30), true},
+		{"friday evening", s, at(7, 16, 0), at(8, 9, 0), true},
+		{"saturday afternoon, monday a store holiday", s, at(8, 13, 0), at(11, 7, 30), true},
+		{"no site", nil, at(3, 16, 0), at(3, 16, 0), true},
+		{"no site on a holiday", nil, at(10, 12, 0), at(11, 0, 0), true},
+		{"never open", &site{Hours: []siteHours{{Days: []int{0}, Opens: "09:00", Closes: "10:00"}}, Holidays: []string{
+			"2018-09-09", "2018-09-16", "2018-09-23",
+		}}, at(3, 12, 0), time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := cs.nextOpening(tt.site, tt.t)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, %v; want %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
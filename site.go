@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/mongodb/mongo-go-driver/mongo/mongoopt"
+	"github.com/mongodb/mongo-go-driver/mongo/replaceopt"
+)
+
+// siteHeader names the site a request is for. Devices use the site of their
+// API key instead.
+const siteHeader = "X-Site"
+
+type siteDrink struct {
+	Drink string  `bson:"drink" json:"drink"`
+	Price float64 `bson:"price" json:"price"`
+}
+
+// siteHours is one set of opening hours, e.g. weekdays 07:30 to 15:00, in
+// store time.
+type siteHours struct {
+	Days   []int  `bson:"days,omitempty" json:"days,omitempty"`
+	Opens  string `bson:"opens" json:"opens"`
+	Closes string `bson:"closes" json:"closes"`
+}
+
+// site is a document in the sites collection: one coffee bar with its own
+// menu, opening hours and barista queue. A site without a menu serves the
+// standard menu at standard prices, and one without hours is always open.
+type site struct {
+	Code  string      `bson:"code" json:"code"`
+	Name  string      `bson:"name" json:"name"`
+	Menu  []siteDrink `bson:"menu" json:"menu"`
+	Hours []siteHours `bson:"hours" json:"hours"`
+	// Holidays are dates (YYYY-MM-DD) the site is closed, as well as
+	// store.holidays.
+	Holidays []string `bson:"holidays" json:"holidays"`
+	// Printer is the host:port of the site's ESC/POS ticket printer, if it
+	// has one other than printer.address.
+	Printer string `bson:"printer,omitempty" json:"printer,omitempty"`
+}
+
+func (s *site) validate() error {
+	seen := map[string]bool{}
+	for _, d := range s.Menu {
+		if d.Drink == "" || d.Price < 0 {
+			return fmt.Errorf("menu drinks need a name and a price that is not negative")
+		}
+		if seen[d.Drink] {
+			return fmt.Errorf("%s is on the menu twice", d.Drink)
+		}
+		seen[d.Drink] = true
+	}
+	for _, h := range s.Hours {
+		if h.Opens == "" || h.Closes == "" {
+			return fmt.Errorf("hours need opens and closes times")
+		}
+		w := timeWindow{Days: h.Days, From: h.Opens, Until: h.Closes}
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+	for _, d := range s.Holidays {
+		if !dateFormat.MatchString(d) {
+			return fmt.Errorf("holidays must be YYYY-MM-DD")
+		}
+	}
+	if s.Printer != "" {
+		if _, _, err := net.SplitHostPort(s.Printer); err != nil {
+			return fmt.Errorf("printer must be host:port")
+		}
+	}
+	return nil
+}
+
+// open reports whether the site is open at t, which must be in store time.
+func (s *site) open(t time.Time) bool {
+	if len(s.Hours) == 0 {
+		return true
+	}
+	for _, h := range s.Hours {
+		if (timeWindow{Days: h.Days, From: h.Opens, Until: h.Closes}).matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// siteMenu returns the drinks served at s, or the standard menu if s is nil or
+// has no menu of its own.
+func siteMenu(s *site) map[string]float64 {
+	menu := map[string]float64{}
+	if s == nil || len(s.Menu) == 0 {
+		for drink, price := range coffeePrices {
+			menu[drink] = float64(price)
+		}
+		return menu
+	}
+	for _, d := range s.Menu {
+		menu[d.Drink] = d.Price
+	}
+	return menu
+}
+
+// drinkPrice returns the price of drink at s.
+func drinkPrice(s *site, drink string) (float64, error) {
+	price, ok := siteMenu(s)[drink]
+	if !ok {
+		if s != nil {
+			return 0, fmt.Errorf("%s isn't on the menu at %s", drink, s.Name)
+		}
+		return 0, fmt.Errorf("Unknown coffee type")
+	}
+	return price, nil
+}
+
+type siteKey struct{}
+
+// siteFromContext returns the code of the site the request is for, or "" if
+// sites are not in use.
+func siteFromContext(ctx context.Context) string {
+	code, _ := ctx.Value(siteKey{}).(string)
+	return code
+}
+
+// requestSite works out which site a request is for: the site of the device's
+// API key, then the X-Site header, then site.default.
+func (cs *coffeeserver) requestSite(r *http.Request, p *principal) string {
+	if p.Site != "" {
+		return p.Site
+	}
+	if code := r.Header.Get(siteHeader); code != "" {
+		return code
+	}
+	return cs.config.DefaultSite
+}
+
+// getSite returns the site with the given code, or nil if code is "".
+func (cs *coffeeserver) getSite(ctx context.Context, code string) (*site, error) {
+	if code == "" {
+		return nil, nil
+	}
+	var s site
+	err := cs.withCollection(ctx, cs.config.SitesCollectionName, "find_site", func(ctx context.Context, sites *mongo.Collection) error {
+		return sites.FindOne(ctx, bson.NewDocument(bson.EC.String("code", code))).Decode(&s)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("Unknown site %s", code)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (cs *coffeeserver) listSites(ctx context.Context) ([]site, error) {
+	var sites []site
+	err := cs.withCollection(ctx, cs.config.SitesCollectionName, "list_sites", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, bson.NewDocument())
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var s site
+			if err := cur.Decode(&s); err != nil {
+				return err
+			}
+			sites = append(sites, s)
+		}
+		return cur.Err()
+	})
+	return sites, err
+}
+
+// knownDrink reports whether drink is on the standard menu or any site's menu.
+func (cs *coffeeserver) knownDrink(ctx context.Context, drink string) (bool, error) {
+	if _, ok := coffeePrices[drink]; ok {
+		return true, nil
+	}
+	sites, err := cs.listSites(ctx)
+	if err != nil {
+		return false, err
+	}
+	for i := range sites {
+		if _, ok := siteMenu(&sites[i])[drink]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sitesHandler lists the sites.
+func (cs *coffeeserver) sitesHandler(w http.ResponseWriter, r *http.Request) {
+	sites, err := cs.listSites(r.Context())
+	if err != nil {
+		cs.logger(r.Context()).Error("Unable to list sites: ", err)
+		http.Error(w, "Unable to list sites", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, sites)
+}
+
+// siteHandler shows (GET), creates or replaces (PUT) or removes (DELETE) a
+// site.
+func (cs *coffeeserver) siteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	code := mux.Vars(r)["code"]
+
+	switch r.Method {
+	case http.MethodDelete:
+		cs.deleteDocument(w, r, cs.config.SitesCollectionName, "code", code, auditSiteChanged)
+		return
+	case http.MethodPut:
+		var s site
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		s.Code = code
+		if s.Name == "" {
+			s.Name = code
+		}
+		if err := s.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := cs.withCollection(ctx, cs.config.SitesCollectionName, "set_site", func(ctx context.Context, sites *mongo.Collection) error {
+			_, err := sites.ReplaceOne(ctx, bson.NewDocument(bson.EC.String("code", code)), &s, replaceopt.Upsert(true))
+			return err
+		})
+		if err != nil {
+			cs.logger(ctx).Error("Unable to set site: ", err)
+			http.Error(w, "Unable to set site", http.StatusInternalServerError)
+			return
+		}
+		cs.audit(ctx, auditSiteChanged, "", map[string]interface{}{"site": code, "drinks": len(s.Menu)})
+	}
+
+	s, err := cs.getSite(ctx, code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// Order statuses, in the order a barista moves orders through them.
+// Scheduled orders are held out of the queue until shortly before pickup, and
+// group orders until the group is submitted.
+const (
+	statusHeld      = "held"
+	statusScheduled = "scheduled"
+	statusQueued    = "queued"
+	statusPreparing = "preparing"
+	statusReady     = "ready"
+	statusCollected = "collected"
+)
+
+var orderStatuses = []string{statusQueued, statusPreparing, statusReady, statusCollected}
+
+// queuedOrder is an order as shown in a barista queue. The orders of a group
+// are shown as one ticket, with an item for each order.
+type queuedOrder struct {
+	ID         string        `json:"id,omitempty"`
+	Group      string        `json:"group,omitempty"`
+	PickupCode string        `json:"pickupCode,omitempty"`
+	CoffeeType string        `json:"coffeetype,omitempty"`
+	CoffeeQty  int           `json:"coffeeqty,omitempty"`
+	EmployeeID string        `json:"employeeId,omitempty"`
+	Items      []queuedOrder `json:"items,omitempty"`
+	Status     string        `json:"status"`
+	Time       int64         `json:"time"`
+	// EstimatedReadyAt is when the ticket should be ready, until it is.
+	EstimatedReadyAt int64 `json:"estimatedReadyAt,omitempty"`
+}
+
+// siteFilter matches orders placed at the site with the given code, or
+// orders with no site if code is "".
+func siteFilter(code string) *bson.Element {
+	if code == "" {
+		return bson.EC.Null("site")
+	}
+	return bson.EC.String("site", code)
+}
+
+// queueHandler lists the orders waiting to be made or collected at the
+// caller's site, oldest first. The site can be overridden with the site
+// parameter.
+func (cs *coffeeserver) queueHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	code := siteFromContext(ctx)
+	if param := r.URL.Query().Get("site"); param != "" {
+		code = param
+	}
+
+	orders, err := cs.activeOrders(ctx, code)
+	if err != nil {
+		cs.logger(ctx).Error("Unable to list queue: ", err)
+		http.Error(w, "Unable to list queue", http.StatusInternalServerError)
+		return
+	}
+	ready := estimateReady(cs.prepModel(ctx, code), orders, time.Now())
+
+	queue := []queuedOrder{}
+	groups := map[string]int{}
+	for _, order := range orders {
+		item := queuedOrder{
+			ID:         order.ID.Hex(),
+			PickupCode: order.PickupCode,
+			CoffeeType: order.CoffeeType,
+			CoffeeQty:  order.CoffeeQty,
+			EmployeeID: order.EmployeeID,
+			Status:     order.Status,
+			Time:       order.Time,
+		}
+		if at, ok := ready[ticketKey(&order)]; ok {
+			item.EstimatedReadyAt = at.Unix()
+		}
+		if order.Group == "" {
+			queue = append(queue, item)
+			continue
+		}
+		if order.For != "" {
+			item.EmployeeID = order.For
+		}
+		i, ok := groups[order.Group]
+		if !ok {
+			i = len(queue)
+			groups[order.Group] = i
+			queue = append(queue, queuedOrder{Group: order.Group, PickupCode: order.PickupCode, Status: order.Status, Time: order.Time, EstimatedReadyAt: item.EstimatedReadyAt})
+		}
+		item.EstimatedReadyAt = 0
+		queue[i].Items = append(queue[i].Items, item)
+		if order.Time < queue[i].Time {
+			queue[i].Time = order.Time
+		}
+	}
+	sort.Slice(queue, func(i, j int) bool { return queue[i].Time < queue[j].Time })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"site": code, "orders": queue})
+}
+
+// earlierStatuses returns the statuses an order can be moved on to status
+// from.
+func earlierStatuses(status string) (*bson.Array, error) {
+	earlier := bson.NewArray()
+	for _, s := range orderStatuses {
+		if s == status {
+			break
+		}
+		earlier.Append(bson.VC.String(s))
+	}
+	if earlier.Len() == 0 || earlier.Len() == len(orderStatuses) {
+		return nil, fmt.Errorf("status must be one of %s, %s or %s", statusPreparing, statusReady, statusCollected)
+	}
+	return earlier, nil
+}
+
+type orderStatusRequest struct {
+	Status string `json:"status"`
+}
+
+// orderStatusHandler moves an order on to a later status, recording when it
+// got there in <status>At.
+func (cs *coffeeserver) orderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := objectid.FromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	var req orderStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	earlier, err := earlierStatuses(req.Status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var order coffeeOrder
+	err = cs.withCollection(ctx, cs.config.OrdersCollectionName, "set_order_status", func(ctx context.Context, orders *mongo.Collection) error {
+		return orders.FindOneAndUpdate(ctx,
+			bson.NewDocument(
+				bson.EC.ObjectID("_id", id),
+				bson.EC.SubDocumentFromElements("status", bson.EC.Array("$in", earlier)),
+			),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set",
+				bson.EC.String("status", req.Status),
+				bson.EC.Int64(req.Status+"At", time.Now().Unix()),
+			)),
+			findopt.ReturnDocument(mongoopt.After),
+		).Decode(&order)
+	})
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Unknown order or order is already "+req.Status, http.StatusConflict)
+		return
+	} else if err != nil {
+		cs.logger(ctx).Error("Unable to set order status: ", err)
+		http.Error(w, "Unable to set order status", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id.Hex(), "site": order.Site, "status": order.Status})
+}
+
+// siteTotals is one row of the site report.
+type siteTotals struct {
+	Site    string  `json:"site"`
+	Orders  int     `json:"orders"`
+	Drinks  int     `json:"drinks"`
+	Revenue float64 `json:"revenue"`
+}
+
+// siteReportHandler totals orders by site between the optional from and to
+// dates (YYYY-MM-DD, store time, inclusive). Refunded orders are left out.
+func (cs *coffeeserver) siteReportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	filter := bson.NewDocument(bson.EC.SubDocumentFromElements("refunded", bson.EC.Boolean("$ne", true)))
+	timeRange, err := cs.reportTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if timeRange != nil {
+		filter.Append(timeRange)
+	}
+
+	totals := map[string]*siteTotals{}
+	err = cs.withCollection(ctx, cs.config.OrdersCollectionName, "site_report", func(ctx context.Context, orders *mongo.Collection) error {
+		cur, err := orders.Find(ctx, filter)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var order coffeeOrder
+			if err := cur.Decode(&order); err != nil {
+				return err
+			}
+			t, ok := totals[order.Site]
+			if !ok {
+				t = &siteTotals{Site: order.Site}
+				totals[order.Site] = t
+			}
+			t.Orders++
+			t.Drinks += order.CoffeeQty
+			t.Revenue += float64(order.Amount)
+		}
+		return cur.Err()
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to build site report: ", err)
+		http.Error(w, "Unable to build site report", http.StatusInternalServerError)
+		return
+	}
+
+	report := make([]*siteTotals, 0, len(totals))
+	for _, t := range totals {
+		t.Revenue = roundMoney(t.Revenue)
+		report = append(report, t)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Site < report[j].Site })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"currency": cs.config.Currency, "sites": report})
+}
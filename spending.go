@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+)
+
+// spendingPolicy limits what an account may spend. Zero caps mean unlimited.
+// The monthly allowance is company money spent before the employee's own
+// balance and resets at the start of each month.
+type spendingPolicy struct {
+	DailyCap         float64 `json:"dailyCap"`
+	WeeklyCap        float64 `json:"weeklyCap"`
+	MaxDrinksPerDay  int     `json:"maxDrinksPerDay"`
+	OverdraftLimit   float64 `json:"overdraftLimit"`
+	MonthlyAllowance float64 `json:"monthlyAllowance"`
+}
+
+// policyOverrides holds the policy fields set on a group or an account.
+// Unset fields are inherited from the group, then the configured defaults.
+type policyOverrides struct {
+	DailyCap         *float64 `bson:"dailyCap,omitempty" json:"dailyCap,omitempty"`
+	WeeklyCap        *float64 `bson:"weeklyCap,omitempty" json:"weeklyCap,omitempty"`
+	MaxDrinksPerDay  *int     `bson:"maxDrinksPerDay,omitempty" json:"maxDrinksPerDay,omitempty"`
+	OverdraftLimit   *float64 `bson:"overdraftLimit,omitempty" json:"overdraftLimit,omitempty"`
+	MonthlyAllowance *float64 `bson:"monthlyAllowance,omitempty" json:"monthlyAllowance,omitempty"`
+}
+
+func (p *spendingPolicy) apply(o policyOverrides) {
+	if o.DailyCap != nil {
+		p.DailyCap = *o.DailyCap
+	}
+	if o.WeeklyCap != nil {
+		p.WeeklyCap = *o.WeeklyCap
+	}
+	if o.MaxDrinksPerDay != nil {
+		p.MaxDrinksPerDay = *o.MaxDrinksPerDay
+	}
+	if o.OverdraftLimit != nil {
+		p.OverdraftLimit = *o.OverdraftLimit
+	}
+	if o.MonthlyAllowance != nil {
+		p.MonthlyAllowance = *o.MonthlyAllowance
+	}
+}
+
+func (o policyOverrides) validate() error {
+	for _, v := range []*float64{o.DailyCap, o.WeeklyCap, o.OverdraftLimit, o.MonthlyAllowance} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("Policy limits must not be negative")
+		}
+	}
+	if o.MaxDrinksPerDay != nil && *o.MaxDrinksPerDay < 0 {
+		return fmt.Errorf("Policy limits must not be negative")
+	}
+	return nil
+}
+
+func (o policyOverrides) document() *bson.Document {
+	doc := bson.NewDocument()
+	for key, v := range map[string]*float64{
+		"dailyCap":         o.DailyCap,
+		"weeklyCap":        o.WeeklyCap,
+		"overdraftLimit":   o.OverdraftLimit,
+		"monthlyAllowance": o.MonthlyAllowance,
+	} {
+		if v != nil {
+			doc.Append(bson.EC.Double(key, *v))
+		}
+	}
+	if o.MaxDrinksPerDay != nil {
+		doc.Append(bson.EC.Int32("maxDrinksPerDay", int32(*o.MaxDrinksPerDay)))
+	}
+	return doc
+}
+
+// policyGroup is a document in the spending policies collection.
+type policyGroup struct {
+	Name   string          `bson:"name" json:"name"`
+	Policy policyOverrides `bson:"policy" json:"policy"`
+}
+
+func (cs *coffeeserver) defaultPolicy() spendingPolicy {
+	return spendingPolicy{
+		DailyCap:         cs.config.PolicyDailyCap,
+		WeeklyCap:        cs.config.PolicyWeeklyCap,
+		MaxDrinksPerDay:  cs.config.PolicyMaxDrinksPerDay,
+		OverdraftLimit:   cs.config.PolicyOverdraftLimit,
+		MonthlyAllowance: cs.config.PolicyMonthlyAllowance,
+	}
+}
+
+func (cs *coffeeserver) getPolicyGroup(ctx context.Context, name string) (*policyGroup, error) {
+	var group policyGroup
+	err := cs.withCollection(ctx, cs.config.PoliciesCollectionName, "find_policy", func(ctx context.Context, policies *mongo.Collection) error {
+		return policies.FindOne(ctx, bson.NewDocument(bson.EC.String("name", name))).Decode(&group)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("Unknown policy group %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// accountPolicy returns the effective spending policy for an account: the
+// configured defaults, overridden by the account's group policy and then by
+// the account's own policy.
+func (cs *coffeeserver) accountPolicy(ctx context.Context, account *employeeAccount) (spendingPolicy, error) {
+	policy := cs.defaultPolicy()
+	if account.PolicyGroup != "" {
+		group, err := cs.getPolicyGroup(ctx, account.PolicyGroup)
+		if err != nil {
+			return policy, err
+		}
+		policy.apply(group.Policy)
+	}
+	policy.apply(account.Policy)
+	return policy, nil
+}
+
+// spendingPeriods identifies the day, ISO week and month containing t in the
+// store's time zone. Usage counters on the account are reset when these
+// change.
+type spendingPeriods struct {
+	day, week, month string
+}
+
+func (cs *coffeeserver) periods(t time.Time) spendingPeriods {
+	t = cs.storeTime(t)
+	year, week := t.ISOWeek()
+	return spendingPeriods{
+		day:   t.Format("2006-01-02"),
+		week:  fmt.Sprintf("%d-W%02d", year, week),
+		month: t.Format("2006-01"),
+	}
+}
+
+// accountUsage is what an account has spent in the current periods.
+type accountUsage struct {
+	SpentToday    float64 `json:"spentToday"`
+	DrinksToday   int     `json:"drinksToday"`
+	SpentThisWeek float64 `json:"spentThisWeek"`
+	AllowanceUsed float64 `json:"allowanceUsed"`
+}
+
+func (a *employeeAccount) usage(p spendingPeriods) accountUsage {
+	var u accountUsage
+	if a.UsageDay == p.day {
+		u.SpentToday, u.DrinksToday = a.SpentToday, a.DrinksToday
+	}
+	if a.UsageWeek == p.week {
+		u.SpentThisWeek = a.SpentThisWeek
+	}
+	if a.AllowanceMonth == p.month {
+		u.AllowanceUsed = a.AllowanceUsed
+	}
+	return u
+}
+
+// declineError is a payment decline whose message can be read back to the
+// employee.
+type declineError struct {
+	reason string
+}
+
+func (e *declineError) Error() string {
+	return e.reason
+}
+
+func decline(format string, args ...interface{}) error {
+	return &declineError{reason: fmt.Sprintf(format, args...)}
+}
+
+// moneyEpsilon absorbs floating point error when comparing amounts, so that
+// spending exactly up to a limit is allowed.
+const moneyEpsilon = 0.005
+
+func (cs *coffeeserver) formatMoney(amount float64) string {
+	return fmt.Sprintf("%.2f %s", amount, cs.config.Currency)
+}
+
+// chargePlan is the result of applying an order to an account under a policy.
+type chargePlan struct {
+	fromAllowance float64
+	fromBalance   float64
+	usage         accountUsage
+}
+
+// planCharge checks an order of drinks costing amount against the account's
+// policy, returning how it will be paid or a declineError.
+func (cs *coffeeserver) planCharge(account *employeeAccount, policy spendingPolicy, p spendingPeriods, drinks int, amount float64) (*chargePlan, error) {
+	u := account.usage(p)
+
+	if policy.MaxDrinksPerDay > 0 && u.DrinksToday+drinks > policy.MaxDrinksPerDay {
+		return nil, decline("You have reached your limit of %d drinks per day", policy.MaxDrinksPerDay)
+	}
+	if policy.DailyCap > 0 && u.SpentToday+amount > policy.DailyCap+moneyEpsilon {
+		return nil, decline("This order would exceed your daily spending limit of %s", cs.formatMoney(policy.DailyCap))
+	}
+	if policy.WeeklyCap > 0 && u.SpentThisWeek+amount > policy.WeeklyCap+moneyEpsilon {
+		return nil, decline("This order would exceed your weekly spending limit of %s", cs.formatMoney(policy.WeeklyCap))
+	}
+
+	plan := &chargePlan{}
+	if remaining := policy.MonthlyAllowance - u.AllowanceUsed; remaining > 0 {
+		plan.fromAllowance = remaining
+		if amount < remaining {
+			plan.fromAllowance = amount
+		}
+	}
+	plan.fromBalance = amount - plan.fromAllowance
+
+	if plan.fromBalance > 0 && account.Balance-plan.fromBalance < -policy.OverdraftLimit-moneyEpsilon {
+		if policy.OverdraftLimit > 0 {
+			return nil, decline("This order would take you past your overdraft limit of %s", cs.formatMoney(policy.OverdraftLimit))
+		}
+		return nil, decline("Insufficient funds, your balance is %s", cs.formatMoney(account.Balance))
+	}
+
+	plan.usage = accountUsage{
+		SpentToday:    u.SpentToday + amount,
+		DrinksToday:   u.DrinksToday + drinks,
+		SpentThisWeek: u.SpentThisWeek + amount,
+		AllowanceUsed: u.AllowanceUsed + plan.fromAllowance,
+	}
+	return plan, nil
+}
+
+// accountCharge is how an order was paid from an employee's account, kept on
+// the order for its receipt.
+type accountCharge struct {
+	FromAllowance float64 `bson:"fromAllowance" json:"fromAllowance"`
+	BalanceBefore float64 `bson:"balanceBefore" json:"balanceBefore"`
+	BalanceAfter  float64 `bson:"balanceAfter" json:"balanceAfter"`
+
+	// What the charge added to the account's usage and in which periods, so
+	// that refunding it can take it off again.
+	Drinks int     `bson:"drinks" json:"-"`
+	Amount float64 `bson:"amount" json:"-"`
+	Day    string  `bson:"usageDay" json:"-"`
+	Week   string  `bson:"usageWeek" json:"-"`
+	Month  string  `bson:"allowanceMonth" json:"-"`
+}
+
+// chargeAttempts bounds the retries when an account changes between being
+// read and charged.
+const chargeAttempts = 3
+
+// chargeAccount charges an order to the employee's account, enforcing the
+// account's spending policy. The update is conditional on the account's
+// version so that concurrent orders cannot both spend the same funds.
+func (cs *coffeeserver) chargeAccount(ctx context.Context, employeeID string, drinks int, amount float32) (*accountCharge, error) {
+	log := cs.logger(ctx).WithFields(logrus.Fields{"employeeID": employeeID, "amount": amount})
+	log.Info("Charging account")
+
+	for attempt := 0; attempt < chargeAttempts; attempt++ {
+		account, err := cs.getAccount(ctx, employeeID)
+		if err != nil {
+			return nil, err
+		}
+		policy, err := cs.accountPolicy(ctx, account)
+		if err != nil {
+			return nil, err
+		}
+		p := cs.periods(time.Now())
+		plan, err := cs.planCharge(account, policy, p, drinks, float64(amount))
+		if err != nil {
+			log.Info("Charge declined: ", err)
+			return nil, err
+		}
+
+		filter := bson.NewDocument(bson.EC.String("employeeId", employeeID))
+		// Accounts created before versioning have no version field, and
+		// ones created since store 0.
+		if account.Version == 0 {
+			filter.Append(bson.EC.SubDocumentFromElements("version",
+				bson.EC.Array("$in", bson.NewArray(bson.VC.Int64(0), bson.VC.Null()))))
+		} else {
+			filter.Append(bson.EC.Int64("version", account.Version))
+		}
+		update := bson.NewDocument(
+			bson.EC.SubDocumentFromElements("$set",
+				bson.EC.Double("balance", account.Balance-plan.fromBalance),
+				bson.EC.String("usageDay", p.day),
+				bson.EC.Double("spentToday", plan.usage.SpentToday),
+				bson.EC.Int32("drinksToday", int32(plan.usage.DrinksToday)),
+				bson.EC.String("usageWeek", p.week),
+				bson.EC.Double("spentThisWeek", plan.usage.SpentThisWeek),
+				bson.EC.String("allowanceMonth", p.month),
+				bson.EC.Double("allowanceUsed", plan.usage.AllowanceUsed),
+				bson.EC.Int64("version", account.Version+1),
+			),
+		)
+
+		var res *mongo.UpdateResult
+		err = cs.withCollection(ctx, cs.config.AccountsCollectionName, "charge_account", func(ctx context.Context, accounts *mongo.Collection) error {
+			var err error
+			res, err = accounts.UpdateOne(ctx, filter, update)
+			return err
+		})
+		if err != nil {
+			log.Error("Unable to charge account: ", err)
+			return nil, fmt.Errorf("Unable to charge account %s %f: %v", employeeID, amount, err)
+		}
+		if res.ModifiedCount == 1 {
+			log.WithFields(logrus.Fields{"fromAllowance": plan.fromAllowance, "fromBalance": plan.fromBalance}).Info("Charged account")
+			return &accountCharge{
+				FromAllowance: plan.fromAllowance,
+				BalanceBefore: account.Balance,
+				BalanceAfter:  account.Balance - plan.fromBalance,
+				Drinks:        drinks,
+				Amount:        float64(amount),
+				Day:           p.day,
+				Week:          p.week,
+				Month:         p.month,
+			}, nil
+		}
+		log.Warn("Account changed while charging, retrying")
+	}
+
+	return nil, fmt.Errorf("Unable to charge account %s %f: too many concurrent updates", employeeID, amount)
+}
+
+// refundCharge reverses an account charge and returns the amount credited.
+// What was taken from the balance is always credited back. The spending
+// counters and allowance used are only reduced while the account is still in
+// the day, week or month the charge was made in, since they reset after that.
+func (cs *coffeeserver) refundCharge(ctx context.Context, employeeID string, charge *accountCharge) (float64, error) {
+	// The version is bumped because chargeAccount sets what it read.
+	err := cs.updateAccount(ctx, employeeID, "refund_account", bson.NewDocument(
+		bson.EC.SubDocumentFromElements("$inc",
+			bson.EC.Double("balance", charge.BalanceBefore-charge.BalanceAfter),
+			bson.EC.Int64("version", 1),
+		),
+	))
+	if err != nil {
+		return 0, err
+	}
+	credited := charge.BalanceBefore - charge.BalanceAfter
+
+	cs.refundUsage(ctx, employeeID, "refund_usage_day", "usageDay", charge.Day,
+		bson.EC.Double("spentToday", -charge.Amount),
+		bson.EC.Int32("drinksToday", int32(-charge.Drinks)),
+	)
+	cs.refundUsage(ctx, employeeID, "refund_usage_week", "usageWeek", charge.Week,
+		bson.EC.Double("spentThisWeek", -charge.Amount),
+	)
+	if charge.FromAllowance > 0 && cs.refundUsage(ctx, employeeID, "refund_allowance", "allowanceMonth", charge.Month,
+		bson.EC.Double("allowanceUsed", -charge.FromAllowance),
+	) {
+		credited += charge.FromAllowance
+	}
+	return credited, nil
+}
+
+// refundUsage applies inc to an account's usage counters if the account's
+// periodField is still period, reporting whether it was. The balance has
+// already been credited by then, so failures are only logged.
+func (cs *coffeeserver) refundUsage(ctx context.Context, employeeID, operation, periodField, period string, inc ...*bson.Element) bool {
+	if period == "" {
+		return false
+	}
+	var modified int64
+	err := cs.withCollection(ctx, cs.config.AccountsCollectionName, operation, func(ctx context.Context, accounts *mongo.Collection) error {
+		res, err := accounts.UpdateOne(ctx,
+			bson.NewDocument(
+				bson.EC.String("employeeId", employeeID),
+				bson.EC.String(periodField, period),
+			),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", append(inc, bson.EC.Int64("version", 1))...)),
+		)
+		if err == nil {
+			modified = res.ModifiedCount
+		}
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).WithField("employeeID", employeeID).Error("Unable to refund usage: ", err)
+	}
+	return modified == 1
+}
+
+// policiesHandler shows (GET) or replaces (PUT) a group spending policy.
+func (cs *coffeeserver) policiesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["group"]
+
+	if r.Method == http.MethodPut {
+		var overrides policyOverrides
+		if err := json.NewDecoder(r.Body).Decode(&overrides); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := overrides.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := cs.withCollection(ctx, cs.config.PoliciesCollectionName, "set_policy", func(ctx context.Context, policies *mongo.Collection) error {
+			_, err := policies.UpdateOne(ctx,
+				bson.NewDocument(bson.EC.String("name", name)),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.SubDocument("policy", overrides.document()))),
+				updateopt.Upsert(true),
+			)
+			return err
+		})
+		if err != nil {
+			cs.logger(ctx).Error("Unable to set policy: ", err)
+			http.Error(w, "Unable to set policy", http.StatusInternalServerError)
+			return
+		}
+		cs.audit(ctx, auditPolicyChanged, "", map[string]interface{}{"group": name})
+	}
+
+	group, err := cs.getPolicyGroup(ctx, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, group)
+}
+
+type accountPolicyRequest struct {
+	PolicyGroup string          `json:"policyGroup"`
+	Policy      policyOverrides `json:"policy"`
+}
+
+// accountPolicyHandler assigns an account to a policy group and sets its own
+// policy overrides.
+func (cs *coffeeserver) accountPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID := mux.Vars(r)["employeeId"]
+
+	var req accountPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.Policy.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.PolicyGroup != "" {
+		if _, err := cs.getPolicyGroup(ctx, req.PolicyGroup); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := cs.updateAccount(ctx, employeeID, "set_account_policy", bson.NewDocument(
+		bson.EC.SubDocumentFromElements("$set",
+			bson.EC.String("policyGroup", req.PolicyGroup),
+			bson.EC.SubDocument("policy", req.Policy.document()),
+		),
+	))
+	if err == errAccountNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to set policy", http.StatusInternalServerError)
+		return
+	}
+	cs.audit(ctx, auditPolicyChanged, employeeID, map[string]interface{}{"group": req.PolicyGroup})
+	w.WriteHeader(http.StatusNoContent)
+}
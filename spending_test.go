@@ -0,0 +1,184 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPlanCharge(t *testing.T) {
+	cs := &coffeeserver{config: &config{Currency: "AUD"}}
+	p := spendingPeriods{day: "2018-09-03", week: "2018-W36", month: "2018-09"}
+
+	// usedToday is an account that has already bought two drinks costing
+	// 9.00 today, 20.00 this week and used 10.00 of its allowance.
+	usedToday := employeeAccount{
+		Balance:        10,
+		UsageDay:       p.day,
+		SpentToday:     9,
+		DrinksToday:    2,
+		UsageWeek:      p.week,
+		SpentThisWeek:  20,
+		AllowanceMonth: p.month,
+		AllowanceUsed:  10,
+	}
+	// stale has usage recorded for earlier periods, which must be ignored.
+	stale := usedToday
+	stale.UsageDay, stale.UsageWeek, stale.AllowanceMonth = "2018-09-02", "2018-W35", "2018-08"
+
+	tests := []struct {
+		name    string
+		account employeeAccount
+		policy  spendingPolicy
+		drinks  int
+		amount  float64
+
+		decline       string
+		fromAllowance float64
+		fromBalance   float64
+		usage         accountUsage
+	}{
+		{
+			name:        "no limits",
+			account:     employeeAccount{Balance: 10},
+			drinks:      1,
+			amount:      4.5,
+			fromBalance: 4.5,
+			usage:       accountUsage{SpentToday: 4.5, DrinksToday: 1, SpentThisWeek: 4.5},
+		},
+		{
+			name:    "drink limit",
+			account: usedToday,
+			policy:  spendingPolicy{MaxDrinksPerDay: 2},
+			drinks:  1,
+			amount:  4.5,
+			decline: "You have reached your limit of 2 drinks per day",
+		},
+		{
+			name:    "daily cap",
+			account: usedToday,
+			policy:  spendingPolicy{DailyCap: 12},
+			drinks:  1,
+			amount:  4.5,
+			decline: "This order would exceed your daily spending limit of 12.00 AUD",
+		},
+		{
+			name:        "exactly the daily cap",
+			account:     usedToday,
+			policy:      spendingPolicy{DailyCap: 13.5},
+			drinks:      1,
+			amount:      4.5,
+			fromBalance: 4.5,
+			usage:       accountUsage{SpentToday: 13.5, DrinksToday: 3, SpentThisWeek: 24.5, AllowanceUsed: 10},
+		},
+		{
+			name:    "weekly cap",
+			account: usedToday,
+			policy:  spendingPolicy{WeeklyCap: 22},
+			drinks:  1,
+			amount:  4.5,
+			decline: "This order would exceed your weekly spending limit of 22.00 AUD",
+		},
+		{
+			name:          "usage from earlier periods",
+			account:       stale,
+			policy:        spendingPolicy{MaxDrinksPerDay: 2, DailyCap: 5, WeeklyCap: 5, MonthlyAllowance: 10},
+			drinks:        1,
+			amount:        4.5,
+			fromAllowance: 4.5,
+			usage:         accountUsage{SpentToday: 4.5, DrinksToday: 1, SpentThisWeek: 4.5, AllowanceUsed: 4.5},
+		},
+		{
+			name:          "allowance covers order",
+			account:       usedToday,
+			policy:        spendingPolicy{MonthlyAllowance: 20},
+			drinks:        1,
+			amount:        4.5,
+			fromAllowance: 4.5,
+			usage:         accountUsage{SpentToday: 13.5, DrinksToday: 3, SpentThisWeek: 24.5, AllowanceUsed: 14.5},
+		},
+		{
+			name:          "allowance split with balance",
+			account:       usedToday,
+			policy:        spendingPolicy{MonthlyAllowance: 12},
+			drinks:        1,
+			amount:        4.5,
+			fromAllowance: 2,
+			fromBalance:   2.5,
+			usage:         accountUsage{SpentToday: 13.5, DrinksToday: 3, SpentThisWeek: 24.5, AllowanceUsed: 12},
+		},
+		{
+			name:        "allowance used up",
+			account:     usedToday,
+			policy:      spendingPolicy{MonthlyAllowance: 10},
+			drinks:      1,
+			amount:      4.5,
+			fromBalance: 4.5,
+			usage:       accountUsage{SpentToday: 13.5, DrinksToday: 3, SpentThisWeek: 24.5, AllowanceUsed: 10},
+		},
+		{
+			name:    "insufficient funds",
+			account: employeeAccount{Balance: 3},
+			drinks:  1,
+			amount:  4.5,
+			decline: "Insufficient funds, your balance is 3.00 AUD",
+		},
+		{
+			name:        "within overdraft",
+			account:     employeeAccount{Balance: 3},
+			policy:      spendingPolicy{OverdraftLimit: 1.5},
+			drinks:      1,
+			amount:      4.5,
+			fromBalance: 4.5,
+			usage:       accountUsage{SpentToday: 4.5, DrinksToday: 1, SpentThisWeek: 4.5},
+		},
+		{
+			name:    "past overdraft",
+			account: employeeAccount{Balance: 3},
+			policy:  spendingPolicy{OverdraftLimit: 1},
+			drinks:  1,
+			amount:  4.5,
+			decline: "This order would take you past your overdraft limit of 1.00 AUD",
+		},
+		{
+			name:          "allowance avoids overdraft",
+			account:       employeeAccount{Balance: 0},
+			policy:        spendingPolicy{MonthlyAllowance: 5},
+			drinks:        1,
+			amount:        4.5,
+			fromAllowance: 4.5,
+			usage:         accountUsage{SpentToday: 4.5, DrinksToday: 1, SpentThisWeek: 4.5, AllowanceUsed: 4.5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			account := tt.account
+			plan, err := cs.planCharge(&account, tt.policy, p, tt.drinks, tt.amount)
+			if tt.decline != "" {
+				if _, ok := err.(*declineError); !ok {
+					t.Fatalf("got plan %+v, error %v; want decline %q", plan, err, tt.decline)
+				}
+				if err.Error() != tt.decline {
+					t.Errorf("got decline %q, want %q", err, tt.decline)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !moneyEqual(plan.fromAllowance, tt.fromAllowance) || !moneyEqual(plan.fromBalance, tt.fromBalance) {
+				t.Errorf("got %.2f from allowance and %.2f from balance, want %.2f and %.2f",
+					plan.fromAllowance, plan.fromBalance, tt.fromAllowance, tt.fromBalance)
+			}
+			got, want := plan.usage, tt.usage
+			if !moneyEqual(got.SpentToday, want.SpentToday) || got.DrinksToday != want.DrinksToday ||
+				!moneyEqual(got.SpentThisWeek, want.SpentThisWeek) || !moneyEqual(got.AllowanceUsed, want.AllowanceUsed) {
+				t.Errorf("got usage %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func moneyEqual(a, b float64) bool {
+	return math.Abs(a-b) < moneyEpsilon
+}
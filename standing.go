@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+// standingOrder is a document in the standing orders collection: a drink the
+// employee wants at the same time on the same days every week. The scheduler
+// places it as a scheduled order standing.advance before pickup.
+type standingOrder struct {
+	ID         objectid.ObjectID `bson:"_id" json:"-"`
+	IDHex      string            `bson:"-" json:"id"`
+	EmployeeID string            `bson:"employeeId" json:"employeeId"`
+	Site       string            `bson:"site,omitempty" json:"site,omitempty"`
+	CoffeeType string            `bson:"coffeetype" json:"coffeetype"`
+	CoffeeQty  int               `bson:"coffeeqty" json:"coffeeqty"`
+	Time       string            `bson:"time" json:"time"` // HH:MM, store time
+	Days       []int             `bson:"days" json:"days"` // 0 is Sunday
+	Paused     bool              `bson:"paused" json:"paused"`
+	LastPlaced string            `bson:"lastPlaced,omitempty" json:"lastPlaced,omitempty"` // YYYY-MM-DD
+	CreatedAt  int64             `bson:"createdAt" json:"createdAt"`
+}
+
+var weekdays = []int{1, 2, 3, 4, 5}
+
+func (o *standingOrder) validate() error {
+	if o.CoffeeQty < 1 {
+		return fmt.Errorf("coffeeqty must be at least 1")
+	}
+	if o.Time == "" {
+		return fmt.Errorf("time is required")
+	}
+	if len(o.Days) == 0 {
+		o.Days = weekdays
+	}
+	return timeWindow{Days: o.Days, From: o.Time}.validate()
+}
+
+// pickup returns when the standing order is due on the day of t, and whether
+// it is due that day at all.
+func (o *standingOrder) pickup(t time.Time) (time.Time, bool) {
+	clock, err := time.Parse("15:04", o.Time)
+	if err != nil || !(timeWindow{Days: o.Days}).matches(t) {
+		return time.Time{}, false
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), clock.Hour(), clock.Minute(), 0, 0, t.Location()), true
+}
+
+func (o *standingOrder) describe() string {
+	days := fmt.Sprintf("%d days a week", len(o.Days))
+	switch {
+	case len(o.Days) == 7:
+		days = "every day"
+	case fmt.Sprint(o.Days) == fmt.Sprint(weekdays):
+		days = "every weekday"
+	case len(o.Days) == 1:
+		days = "every " + time.Weekday(o.Days[0]).String()
+	}
+	return fmt.Sprintf("%d %s at %s %s", o.CoffeeQty, o.CoffeeType, o.Time, days)
+}
+
+func (cs *coffeeserver) listStandingOrders(ctx context.Context, filter *bson.Document) ([]standingOrder, error) {
+	orders := []standingOrder{}
+	err := cs.withCollection(ctx, cs.config.StandingOrdersCollectionName, "list_standing_orders", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, filter)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var o standingOrder
+			if err := cur.Decode(&o); err != nil {
+				return err
+			}
+			o.IDHex = o.ID.Hex()
+			orders = append(orders, o)
+		}
+		return cur.Err()
+	})
+	return orders, err
+}
+
+func (cs *coffeeserver) insertStandingOrder(ctx context.Context, o *standingOrder) error {
+	o.ID = objectid.New()
+	o.IDHex = o.ID.Hex()
+	o.CreatedAt = time.Now().Unix()
+	err := cs.withCollection(ctx, cs.config.StandingOrdersCollectionName, "insert_standing_order", func(ctx context.Context, orders *mongo.Collection) error {
+		_, err := orders.InsertOne(ctx, o)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cs.audit(ctx, auditStandingOrderChanged, o.EmployeeID, map[string]interface{}{"id": o.IDHex, "order": o.describe()})
+	return nil
+}
+
+// cancelStandingOrders deletes the employee's standing orders matching
+// filter and returns how many there were.
+func (cs *coffeeserver) cancelStandingOrders(ctx context.Context, employeeID string, filter *bson.Document) (int64, error) {
+	filter.Append(bson.EC.String("employeeId", employeeID))
+	var deleted int64
+	err := cs.withCollection(ctx, cs.config.StandingOrdersCollectionName, "delete_standing_orders", func(ctx context.Context, orders *mongo.Collection) error {
+		res, err := orders.DeleteMany(ctx, filter)
+		if err == nil {
+			deleted = res.DeletedCount
+		}
+		return err
+	})
+	if err == nil && deleted > 0 {
+		cs.audit(ctx, auditStandingOrderChanged, employeeID, map[string]interface{}{"cancelled": deleted})
+	}
+	return deleted, err
+}
+
+// standingOrdersHandler lists (GET) or creates (POST) an employee's standing
+// orders.
+func (cs *coffeeserver) standingOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID := mux.Vars(r)["employeeId"]
+	if !cs.authorizeAccount(w, r, employeeID) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var o standingOrder
+		if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		o.EmployeeID, o.LastPlaced, o.Paused = employeeID, "", false
+		if o.Site == "" {
+			o.Site = siteFromContext(ctx)
+		}
+		if err := cs.checkStandingOrder(ctx, &o); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := cs.insertStandingOrder(ctx, &o); err != nil {
+			cs.logger(ctx).Error("Unable to create standing order: ", err)
+			http.Error(w, "Unable to create standing order", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, o)
+		return
+	}
+
+	orders, err := cs.listStandingOrders(ctx, bson.NewDocument(bson.EC.String("employeeId", employeeID)))
+	if err != nil {
+		cs.logger(ctx).Error("Unable to list standing orders: ", err)
+		http.Error(w, "Unable to list standing orders", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, orders)
+}
+
+// checkStandingOrder validates a standing order, including that its drink is
+// served at its site.
+func (cs *coffeeserver) checkStandingOrder(ctx context.Context, o *standingOrder) error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+	s, err := cs.getSite(ctx, o.Site)
+	if err != nil {
+		return err
+	}
+	_, err = drinkPrice(s, o.CoffeeType)
+	return err
+}
+
+type standingOrderUpdate struct {
+	Paused *bool `json:"paused"`
+}
+
+// standingOrderHandler pauses or resumes (PUT {"paused": true|false}) or
+// cancels (DELETE) one of an employee's standing orders.
+func (cs *coffeeserver) standingOrderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	employeeID := mux.Vars(r)["employeeId"]
+	if !cs.authorizeAccount(w, r, employeeID) {
+		return
+	}
+	id, err := objectid.FromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid standing order ID", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		deleted, err := cs.cancelStandingOrders(ctx, employeeID, bson.NewDocument(bson.EC.ObjectID("_id", id)))
+		if err != nil {
+			cs.logger(ctx).Error("Unable to cancel standing order: ", err)
+			http.Error(w, "Unable to cancel standing order", http.StatusInternalServerError)
+			return
+		}
+		if deleted == 0 {
+			http.Error(w, "Unknown standing order", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req standingOrderUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Paused == nil {
+		http.Error(w, "paused is required", http.StatusBadRequest)
+		return
+	}
+	var matched int64
+	err = cs.withCollection(ctx, cs.config.StandingOrdersCollectionName, "pause_standing_order", func(ctx context.Context, orders *mongo.Collection) error {
+		res, err := orders.UpdateOne(ctx,
+			bson.NewDocument(bson.EC.ObjectID("_id", id), bson.EC.String("employeeId", employeeID)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.Boolean("paused", *req.Paused))),
+		)
+		if err == nil {
+			matched = res.MatchedCount
+		}
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to update standing order: ", err)
+		http.Error(w, "Unable to update standing order", http.StatusInternalServerError)
+		return
+	}
+	if matched == 0 {
+		http.Error(w, "Unknown standing order", http.StatusNotFound)
+		return
+	}
+	cs.audit(ctx, auditStandingOrderChanged, employeeID, map[string]interface{}{"id": id.Hex(), "paused": *req.Paused})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id.Hex(), "paused": *req.Paused})
+}
+
+// daysParameter reads the days a standing order is for from Dialogflow: a day
+// name, "weekdays", "weekends" or "every day", or a list of them. It returns
+// nil if none were given.
+func daysParameter(v *structpb.Value) ([]int, error) {
+	var values []string
+	switch kind := v.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		values = []string{kind.StringValue}
+	case *structpb.Value_ListValue:
+		for _, item := range kind.ListValue.GetValues() {
+			values = append(values, item.GetStringValue())
+		}
+	}
+
+	seen := map[int]bool{}
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(value))
+		switch value {
+		case "":
+			continue
+		case "weekdays", "weekday", "every weekday":
+			for _, day := range weekdays {
+				seen[day] = true
+			}
+			continue
+		case "weekends", "weekend":
+			seen[0], seen[6] = true, true
+			continue
+		case "every day", "everyday", "daily":
+			for day := 0; day < 7; day++ {
+				seen[day] = true
+			}
+			continue
+		}
+		found := false
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if strings.TrimSuffix(value, "s") == strings.ToLower(day.String()) {
+				seen[int(day)], found = true, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Sorry, I didn't understand which days you want it")
+		}
+	}
+
+	var days []int
+	for day := 0; day < 7; day++ {
+		if seen[day] {
+			days = append(days, day)
+		}
+	}
+	return days, nil
+}
+
+// standingOrderIntent creates a standing order from the voice parameters
+// coffee, quantity, time and days.
+func (cs *coffeeserver) standingOrderIntent(w http.ResponseWriter, r *http.Request, employeeID string, parameters *structpb.Struct) {
+	ctx := r.Context()
+	coffeeType, err := cs.drinkParameter(ctx, siteFromContext(ctx), parameters.Fields["coffee"])
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	qty, err := cs.quantityParameter(parameters.Fields["quantity"])
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	pickup, err := parsePickupTime(parameters.Fields["time"].GetStringValue(), cs.storeTime(time.Now()))
+	if err != nil {
+		fmt.Fprintf(w, "Error creating standing order: %s", err)
+		return
+	}
+	days, err := daysParameter(parameters.Fields["days"])
+	if err != nil {
+		fmt.Fprintf(w, "Error creating standing order: %s", err)
+		return
+	}
+
+	o := standingOrder{
+		EmployeeID: employeeID,
+		Site:       siteFromContext(ctx),
+		CoffeeType: coffeeType,
+		CoffeeQty:  qty,
+		Time:       pickup.Format("15:04"),
+		Days:       days,
+	}
+	if err := cs.checkStandingOrder(ctx, &o); err != nil {
+		fmt.Fprintf(w, "Error creating standing order: %s", err)
+		return
+	}
+	if err := cs.insertStandingOrder(ctx, &o); err != nil {
+		cs.logger(ctx).Error("Unable to create standing order: ", err)
+		fmt.Fprint(w, "Error creating standing order, please try again")
+		return
+	}
+	cs.endBadgeSession(ctx)
+	fmt.Fprintf(w, "OK, you'll get %s, charged to account %s", o.describe(), employeeID)
+}
+
+// cancelStandingOrderIntent cancels the employee's standing orders, or only
+// those for the coffee parameter if it is given.
+func (cs *coffeeserver) cancelStandingOrderIntent(w http.ResponseWriter, r *http.Request, employeeID string, parameters *structpb.Struct) {
+	ctx := r.Context()
+	filter := bson.NewDocument()
+	if coffeeType := parameters.Fields["coffee"].GetStringValue(); coffeeType != "" {
+		filter.Append(bson.EC.String("coffeetype", coffeeType))
+	}
+	deleted, err := cs.cancelStandingOrders(ctx, employeeID, filter)
+	if err != nil {
+		cs.logger(ctx).Error("Unable to cancel standing orders: ", err)
+		fmt.Fprint(w, "Error cancelling standing orders, please try again")
+		return
+	}
+	cs.endBadgeSession(ctx)
+	switch deleted {
+	case 0:
+		fmt.Fprint(w, "You don't have any standing orders to cancel")
+	case 1:
+		fmt.Fprint(w, "OK, your standing order is cancelled")
+	default:
+		fmt.Fprintf(w, "OK, your %d standing orders are cancelled", deleted)
+	}
+}
+
+// placeStandingOrders places today's standing orders that are due within
+// standing.advance as scheduled orders. Each standing order is claimed for the
+// day before it is placed, so it is placed at most once a day even with
+// several instances running. Standing orders are skipped on holidays and
+// while paused.
+func (cs *coffeeserver) placeStandingOrders(ctx context.Context) {
+	now := cs.storeTime(time.Now())
+	today := now.Format("2006-01-02")
+
+	due, err := cs.listStandingOrders(ctx, bson.NewDocument(
+		bson.EC.Boolean("paused", false),
+		bson.EC.SubDocumentFromElements("lastPlaced", bson.EC.String("$ne", today)),
+		bson.EC.Int32("days", int32(now.Weekday())),
+	))
+	if err != nil {
+		cs.log.Error("Unable to list standing orders: ", err)
+		return
+	}
+
+	for i := range due {
+		o := &due[i]
+		pickup, ok := o.pickup(now)
+		if !ok || pickup.After(now.Add(cs.config.StandingOrderAdvance)) {
+			continue
+		}
+		log := cs.log.WithFields(logrus.Fields{"standingOrder": o.IDHex, "employeeID": o.EmployeeID})
+
+		var claimed int64
+		err := cs.withCollection(ctx, cs.config.StandingOrdersCollectionName, "claim_standing_order", func(ctx context.Context, orders *mongo.Collection) error {
+			res, err := orders.UpdateOne(ctx,
+				bson.NewDocument(
+					bson.EC.ObjectID("_id", o.ID),
+					bson.EC.SubDocumentFromElements("lastPlaced", bson.EC.String("$ne", today)),
+				),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("lastPlaced", today))),
+			)
+			if err == nil {
+				claimed = res.ModifiedCount
+			}
+			return err
+		})
+		if err != nil {
+			log.Error("Unable to claim standing order: ", err)
+			continue
+		}
+		if claimed != 1 {
+			continue
+		}
+
+		if s, err := cs.getSite(ctx, o.Site); err == nil && cs.holiday(s, pickup) {
+			log.Info("Skipping standing order on a holiday")
+			continue
+		}
+		if !pickup.After(now) {
+			log.Warn("Skipping standing order that is already past its pickup time")
+			continue
+		}
+
+		order, err := cs.saveOrder(ctx, orderRequest{
+			Site:       o.Site,
+			CoffeeType: o.CoffeeType,
+			CoffeeQty:  o.CoffeeQty,
+			EmployeeID: o.EmployeeID,
+			PickupAt:   pickup,
+		})
+		if err != nil {
+			log.Warn("Unable to place standing order: ", err)
+			cs.audit(ctx, auditStandingOrderFailed, o.EmployeeID, map[string]interface{}{"id": o.IDHex, "error": err.Error()})
+			continue
+		}
+		log.WithField("order", order.ID.Hex()).Info("Placed standing order")
+	}
+}
@@ -0,0 +1,141 @@
+var search = {};
+var page = 1;
+var current = null;
+
+$(function() {
+	$("#search").submit(function(e) {
+		e.preventDefault();
+		search = {};
+		$(this).serializeArray().forEach(function(field) {
+			if (field.value) {
+				search[field.name] = field.value;
+			}
+		});
+		page = 1;
+		listTurns();
+	});
+	$("#previous").click(function() { page--; listTurns(); });
+	$("#next").click(function() { page++; listTurns(); });
+	$("#sessionLink").click(function(e) {
+		e.preventDefault();
+		search = { session: current.session };
+		page = 1;
+		listTurns();
+	});
+	$("#replay").click(replayTurn);
+	$("#signInButton").click(signIn);
+	$("#signOutButton").click(signOut);
+	showSignedIn();
+	listTurns();
+});
+
+// bearer token for the signed-in user, shared with the ordering page
+function authHeaders() {
+	var token = window.localStorage.getItem("coffeeToken");
+	return token ? { "Authorization": "Bearer " + token } : {};
+}
+
+function signIn() {
+	var token = $("#tokenInput").val().trim();
+	if (!token) {
+		return;
+	}
+	window.localStorage.setItem("coffeeToken", token);
+	$("#tokenInput").val("");
+	showSignedIn();
+	listTurns();
+}
+
+function signOut() {
+	window.localStorage.removeItem("coffeeToken");
+	showSignedIn();
+	$("#turns").empty();
+	$("#detail").hide();
+}
+
+function showSignedIn() {
+	var signedIn = !!window.localStorage.getItem("coffeeToken");
+	$("#tokenInput").toggle(!signedIn);
+	$("#signInButton").toggle(!signedIn);
+	$("#signOutButton").toggle(signedIn);
+}
+
+function showError(xhr) {
+	if (xhr.status == 401) {
+		$("#error").text("Sign in to see conversations.");
+		return;
+	}
+	$("#error").text(xhr.responseText || xhr.statusText);
+}
+
+function listTurns() {
+	$("#error").text("");
+	$.ajax({
+		url: "/admin/conversations",
+		data: $.extend({ page: page }, search),
+		headers: authHeaders()
+	}).done(function(data) {
+		$("#turns").empty();
+		data.turns.forEach(function(turn) {
+			var row = $("<tr>").css("cursor", "pointer").click(function() { showTurn(turn.id); });
+			row.append($("<td>").text(new Date(turn.time * 1000).toLocaleString()));
+			row.append($("<td>").text(turn.employeeId || ""));
+			row.append($("<td>").text(turn.pinRedacted ? "(not kept, a PIN was spoken)" : turn.queryText));
+			row.append($("<td>").text(turn.intent || ""));
+			row.append($("<td>").text(turn.confidence.toFixed(2)));
+			row.append($("<td>").text(turn.reply));
+			row.append($("<td>").text(turn.order || ""));
+			$("#turns").append(row);
+		});
+		$("#previous").prop("disabled", page <= 1);
+		$("#next").prop("disabled", !data.more);
+	})
+	.fail(showError);
+}
+
+function showTurn(id) {
+	$.ajax({
+		url: "/admin/conversations/" + id,
+		headers: authHeaders()
+	}).done(function(turn) {
+		current = turn;
+		$("#detailId").text(turn.id);
+		$("#detailJson").text(JSON.stringify(turn, null, 2));
+		$("#replayJson").text("");
+		$("#audio").hide();
+		if (turn.hasAudio) {
+			loadAudio(turn.id);
+		}
+		$("#detail").show();
+	})
+	.fail(showError);
+}
+
+// The audio needs the auth header, so it is fetched here rather than by the
+// audio element.
+function loadAudio(id) {
+	var xhr = new XMLHttpRequest();
+	xhr.open("GET", "/admin/conversations/" + id + "/audio");
+	$.each(authHeaders(), function(name, value) { xhr.setRequestHeader(name, value); });
+	xhr.responseType = "blob";
+	xhr.onload = function() {
+		if (xhr.status == 200) {
+			$("#audio").attr("src", URL.createObjectURL(xhr.response)).show();
+		}
+	};
+	xhr.send();
+}
+
+function replayTurn() {
+	$("#replayJson").text("Replaying...");
+	$.ajax({
+		url: "/admin/conversations/" + current.id + "/replay",
+		type: "POST",
+		headers: authHeaders()
+	}).done(function(data) {
+		$("#replayJson").text(JSON.stringify(data, null, 2));
+	})
+	.fail(function(xhr) {
+		$("#replayJson").text(xhr.responseText);
+	});
+}
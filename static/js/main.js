@@ -75,6 +75,7 @@ function startRecording() {
         url: 'order',
         data: blob,
         contentType: 'audio/wav', // set accordingly
+        headers: authHeaders(),
         processData: false
       }).done(function(data) {
 					console.log(data);
@@ -120,6 +121,37 @@ function stopRecording() {
 	console.log('Recording stopped');
 }
 
+// bearer token for the signed-in employee, if the server requires one
+function authHeaders() {
+	var token = window.localStorage.getItem("coffeeToken");
+	return token ? { "Authorization": "Bearer " + token } : {};
+}
+
+// keep the token issued by the identity provider for later requests
+function signIn() {
+	var token = $("#tokenInput").val().trim();
+	if (!token) {
+		return;
+	}
+	window.localStorage.setItem("coffeeToken", token);
+	$("#tokenInput").val("");
+	showSignedIn();
+	loadFavourites();
+}
+
+function signOut() {
+	window.localStorage.removeItem("coffeeToken");
+	showSignedIn();
+	$("#favourites").empty();
+}
+
+function showSignedIn() {
+	var signedIn = !!window.localStorage.getItem("coffeeToken");
+	$("#tokenInput").toggle(!signedIn);
+	$("#signInButton").toggle(!signedIn);
+	$("#signOutButton").toggle(signedIn);
+}
+
 function sendText() {
 	console.log("sendText() called");
 
@@ -130,6 +162,7 @@ function sendText() {
 		url: 'order',
 		data: "can I have a latte for employee ID 123",
 		contentType: 'text/plain', // set accordingly
+		headers: authHeaders(),
 		processData: false
 	}).done(function(data) {
 			console.log(data);
@@ -140,6 +173,50 @@ function sendText() {
 	});
 }
 
+// one button per favourite (and the usual) to reorder it with one tap
+function loadFavourites() {
+	$.ajax({
+		type: 'GET',
+		url: 'me/favourites',
+		headers: authHeaders()
+	}).done(function(data) {
+		var favourites = data.favourites.slice();
+		if (data.usual && !favourites.some(function(f) { return f.name == "usual"; })) {
+			favourites.unshift(data.usual);
+		}
+		$("#favourites").empty();
+		favourites.forEach(function(f) {
+			$("<button>")
+				.text(f.name + ": " + f.coffeeqty + " " + f.coffeetype)
+				.click(function() { reorder(f.name); })
+				.appendTo("#favourites");
+		});
+	})
+	.fail(function(xhr) {
+		$("#favourites").text(xhr.responseText || "Unable to load favourites");
+	});
+}
+
+function reorder(name) {
+	console.log("reorder() called for " + name);
+
+	$("#spinner").show("slow");
+
+	$.ajax({
+		type: 'POST',
+		url: 'me/favourites/' + encodeURIComponent(name) + '/order',
+		headers: authHeaders()
+	}).done(function(data) {
+			console.log(data);
+			$("#response").text(data);
+	})
+	.fail(function(xhr) {
+			$("#response").text(xhr.responseText);
+	})
+	.always(function(data) {
+		$("#spinner").hide("slow");
+	});
+}
 
 $(function() {
   console.log( "ready!" );
@@ -151,5 +228,9 @@ $(function() {
 	$("#recordButton").mouseup(stopRecording);
 	$("#recordButton").mouseleave(stopRecording);
 	$("#sendTextButton").click(sendText);
+	$("#signInButton").click(signIn);
+	$("#signOutButton").click(signOut);
+	showSignedIn();
+	loadFavourites();
 
 });
\ No newline at end of file
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/replaceopt"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+)
+
+// costCentre is a document in the cost centres collection. Subsidies are
+// charged to a cost centre until its budget is spent.
+type costCentre struct {
+	Code   string  `bson:"code" json:"code"`
+	Name   string  `bson:"name" json:"name"`
+	Budget float64 `bson:"budget" json:"budget"`
+	Spent  float64 `bson:"spent" json:"spent"`
+}
+
+// subsidyRule is a document in the subsidy rules collection. A rule pays
+// Percent of an order plus FixedPerDrink for each drink, up to the order
+// amount, from its cost centre. Empty Teams and Days and unset times and
+// dates match everything.
+type subsidyRule struct {
+	Name          string   `bson:"name" json:"name"`
+	CostCentre    string   `bson:"costCentre" json:"costCentre"`
+	Percent       float64  `bson:"percent" json:"percent"`
+	FixedPerDrink float64  `bson:"fixedPerDrink" json:"fixedPerDrink"`
+	Teams         []string `bson:"teams" json:"teams,omitempty"`
+	Days          []int    `bson:"days" json:"days,omitempty"`             // 0 is Sunday
+	From          string   `bson:"from" json:"from,omitempty"`             // HH:MM, store time
+	Until         string   `bson:"until" json:"until,omitempty"`           // HH:MM, store time
+	ValidFrom     string   `bson:"validFrom" json:"validFrom,omitempty"`   // YYYY-MM-DD
+	ValidUntil    string   `bson:"validUntil" json:"validUntil,omitempty"` // YYYY-MM-DD
+}
+
+func (rule *subsidyRule) validate() error {
+	if rule.CostCentre == "" {
+		return fmt.Errorf("A costCentre is required")
+	}
+	if rule.Percent < 0 || rule.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	if rule.FixedPerDrink < 0 {
+		return fmt.Errorf("fixedPerDrink must not be negative")
+	}
+	if rule.Percent == 0 && rule.FixedPerDrink == 0 {
+		return fmt.Errorf("One of percent or fixedPerDrink is required")
+	}
+	return rule.window().validate()
+}
+
+func (rule *subsidyRule) window() timeWindow {
+	return timeWindow{Days: rule.Days, From: rule.From, Until: rule.Until, ValidFrom: rule.ValidFrom, ValidUntil: rule.ValidUntil}
+}
+
+// matches reports whether the rule applies to an order by a member of team
+// placed at t, which must be in the store's time zone.
+func (rule *subsidyRule) matches(team string, t time.Time) bool {
+	if len(rule.Teams) > 0 {
+		found := false
+		for _, ruleTeam := range rule.Teams {
+			if ruleTeam == team {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return rule.window().matches(t)
+}
+
+// amount returns the subsidy the rule pays towards an order.
+func (rule *subsidyRule) amount(drinks int, total float64) float64 {
+	subsidy := total*rule.Percent/100 + rule.FixedPerDrink*float64(drinks)
+	if subsidy > total {
+		return total
+	}
+	return subsidy
+}
+
+// orderSubsidy is the cost-centre leg of an order.
+type orderSubsidy struct {
+	CostCentre string  `bson:"costCentre" json:"costCentre"`
+	Rule       string  `bson:"rule" json:"rule"`
+	Amount     float64 `bson:"amount" json:"amount"`
+}
+
+func (cs *coffeeserver) listSubsidyRules(ctx context.Context) ([]subsidyRule, error) {
+	var rules []subsidyRule
+	err := cs.withCollection(ctx, cs.config.SubsidyRulesCollectionName, "list_subsidy_rules", func(ctx context.Context, coll *mongo.Collection) error {
+		cur, err := coll.Find(ctx, bson.NewDocument())
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var rule subsidyRule
+			if err := cur.Decode(&rule); err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+		return cur.Err()
+	})
+	return rules, err
+}
+
+// applySubsidy finds the most generous subsidy rule for an order and charges
+// it to the rule's cost centre. It returns nil if no rule applies or the cost
+// centre's budget cannot cover it, in which case the employee pays in full.
+func (cs *coffeeserver) applySubsidy(ctx context.Context, employeeID string, drinks int, total float64) *orderSubsidy {
+	log := cs.logger(ctx).WithField("employeeID", employeeID)
+
+	account, err := cs.getAccount(ctx, employeeID)
+	if err != nil {
+		return nil
+	}
+	rules, err := cs.listSubsidyRules(ctx)
+	if err != nil {
+		log.Error("Unable to list subsidy rules: ", err)
+		return nil
+	}
+
+	now := cs.storeTime(time.Now())
+	var candidates []orderSubsidy
+	for i := range rules {
+		if rules[i].matches(account.Team, now) {
+			candidates = append(candidates, orderSubsidy{
+				CostCentre: rules[i].CostCentre,
+				Rule:       rules[i].Name,
+				Amount:     rules[i].amount(drinks, total),
+			})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Amount > candidates[j].Amount })
+
+	for _, subsidy := range candidates {
+		if subsidy.Amount <= 0 {
+			break
+		}
+		if err := cs.debitCostCentre(ctx, subsidy.CostCentre, subsidy.Amount); err != nil {
+			log.WithFields(logrus.Fields{"costCentre": subsidy.CostCentre, "rule": subsidy.Rule}).Info("Subsidy not applied: ", err)
+			continue
+		}
+		return &subsidy
+	}
+	return nil
+}
+
+var errBudgetExhausted = fmt.Errorf("Cost centre budget exhausted")
+
+// debitCostCentre charges amount to a cost centre if its remaining budget
+// covers it. The update is conditional on the budget and spend read so that
+// concurrent orders cannot overspend.
+func (cs *coffeeserver) debitCostCentre(ctx context.Context, code string, amount float64) error {
+	for attempt := 0; attempt < chargeAttempts; attempt++ {
+		centre, err := cs.getCostCentre(ctx, code)
+		if err != nil {
+			return err
+		}
+		if centre.Spent+amount > centre.Budget+moneyEpsilon {
+			return errBudgetExhausted
+		}
+
+		var modified int64
+		err = cs.withCollection(ctx, cs.config.CostCentresCollectionName, "debit_cost_centre", func(ctx context.Context, centres *mongo.Collection) error {
+			res, err := centres.UpdateOne(ctx,
+				bson.NewDocument(
+					bson.EC.String("code", code),
+					bson.EC.Double("budget", centre.Budget),
+					bson.EC.Double("spent", centre.Spent),
+				),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Double("spent", amount))),
+			)
+			if err == nil {
+				modified = res.ModifiedCount
+			}
+			return err
+		})
+		if err != nil || modified == 1 {
+			return err
+		}
+	}
+	return fmt.Errorf("Unable to debit cost centre %s: too many concurrent updates", code)
+}
+
+// refundSubsidy returns a subsidy to its cost centre when the employee's leg
+// of the order fails.
+func (cs *coffeeserver) refundSubsidy(ctx context.Context, subsidy *orderSubsidy) {
+	if subsidy == nil {
+		return
+	}
+	err := cs.withCollection(ctx, cs.config.CostCentresCollectionName, "refund_cost_centre", func(ctx context.Context, centres *mongo.Collection) error {
+		_, err := centres.UpdateOne(ctx,
+			bson.NewDocument(bson.EC.String("code", subsidy.CostCentre)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Double("spent", -subsidy.Amount))),
+		)
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).WithField("costCentre", subsidy.CostCentre).Error("Unable to refund subsidy: ", err)
+	}
+}
+
+func (cs *coffeeserver) getCostCentre(ctx context.Context, code string) (*costCentre, error) {
+	var centre costCentre
+	err := cs.withCollection(ctx, cs.config.CostCentresCollectionName, "find_cost_centre", func(ctx context.Context, centres *mongo.Collection) error {
+		return centres.FindOne(ctx, bson.NewDocument(bson.EC.String("code", code))).Decode(&centre)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("Unknown cost centre %s", code)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &centre, nil
+}
+
+type costCentreRequest struct {
+	Name   string  `json:"name"`
+	Budget float64 `json:"budget"`
+}
+
+// costCentresHandler shows (GET) or creates and updates (PUT) a cost centre.
+// Updating a cost centre sets its budget but keeps what has been spent.
+func (cs *coffeeserver) costCentresHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	code := mux.Vars(r)["code"]
+
+	if r.Method == http.MethodPut {
+		var req costCentreRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Budget < 0 {
+			http.Error(w, "budget must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		err := cs.withCollection(ctx, cs.config.CostCentresCollectionName, "set_cost_centre", func(ctx context.Context, centres *mongo.Collection) error {
+			_, err := centres.UpdateOne(ctx,
+				bson.NewDocument(bson.EC.String("code", code)),
+				bson.NewDocument(
+					bson.EC.SubDocumentFromElements("$set",
+						bson.EC.String("name", req.Name),
+						bson.EC.Double("budget", req.Budget),
+					),
+					bson.EC.SubDocumentFromElements("$setOnInsert", bson.EC.Double("spent", 0)),
+				),
+				updateopt.Upsert(true),
+			)
+			return err
+		})
+		if err != nil {
+			cs.logger(ctx).Error("Unable to set cost centre: ", err)
+			http.Error(w, "Unable to set cost centre", http.StatusInternalServerError)
+			return
+		}
+		cs.audit(ctx, auditCostCentreChanged, "", map[string]interface{}{"costCentre": code, "budget": req.Budget})
+	}
+
+	centre, err := cs.getCostCentre(ctx, code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, centre)
+}
+
+// subsidyRulesHandler lists the subsidy rules.
+func (cs *coffeeserver) subsidyRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := cs.listSubsidyRules(r.Context())
+	if err != nil {
+		cs.logger(r.Context()).Error("Unable to list subsidy rules: ", err)
+		http.Error(w, "Unable to list subsidy rules", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// subsidyRuleHandler creates or replaces (PUT) or removes (DELETE) a subsidy
+// rule.
+func (cs *coffeeserver) subsidyRuleHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+
+	if r.Method == http.MethodDelete {
+		var deleted int64
+		err := cs.withCollection(ctx, cs.config.SubsidyRulesCollectionName, "delete_subsidy_rule", func(ctx context.Context, rules *mongo.Collection) error {
+			res, err := rules.DeleteOne(ctx, bson.NewDocument(bson.EC.String("name", name)))
+			if err == nil {
+				deleted = res.DeletedCount
+			}
+			return err
+		})
+		if err != nil {
+			cs.logger(ctx).Error("Unable to remove subsidy rule: ", err)
+			http.Error(w, "Unable to remove subsidy rule", http.StatusInternalServerError)
+			return
+		}
+		if deleted == 0 {
+			http.Error(w, "Unknown subsidy rule", http.StatusNotFound)
+			return
+		}
+		cs.audit(ctx, auditSubsidyRuleChanged, "", map[string]interface{}{"rule": name, "deleted": true})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var rule subsidyRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	rule.Name = name
+	if err := rule.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := cs.getCostCentre(ctx, rule.CostCentre); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := cs.withCollection(ctx, cs.config.SubsidyRulesCollectionName, "set_subsidy_rule", func(ctx context.Context, rules *mongo.Collection) error {
+		_, err := rules.ReplaceOne(ctx, bson.NewDocument(bson.EC.String("name", name)), &rule, replaceopt.Upsert(true))
+		return err
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to set subsidy rule: ", err)
+		http.Error(w, "Unable to set subsidy rule", http.StatusInternalServerError)
+		return
+	}
+	cs.audit(ctx, auditSubsidyRuleChanged, "", map[string]interface{}{"rule": name, "costCentre": rule.CostCentre})
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// costCentreTotals is one row of the subsidy report.
+type costCentreTotals struct {
+	CostCentre     string  `json:"costCentre"`
+	Orders         int     `json:"orders"`
+	Drinks         int     `json:"drinks"`
+	Total          float64 `json:"total"`
+	Subsidy        float64 `json:"subsidy"`
+	EmployeeAmount float64 `json:"employeeAmount"`
+}
+
+// reportTimeRange returns a filter on order time for a report's optional from
+// and to parameters (YYYY-MM-DD, store time, inclusive), or nil if neither is
+// given.
+func (cs *coffeeserver) reportTimeRange(r *http.Request) (*bson.Element, error) {
+	timeRange := bson.NewDocument()
+	for param, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		day, err := time.ParseInLocation("2006-01-02", value, cs.config.location)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be YYYY-MM-DD", param)
+		}
+		if param == "to" {
+			day = day.AddDate(0, 0, 1)
+		}
+		timeRange.Append(bson.EC.Int64(op, day.Unix()))
+	}
+	if timeRange.Len() == 0 {
+		return nil, nil
+	}
+	return bson.EC.SubDocument("time", timeRange), nil
+}
+
+// subsidyReportHandler totals subsidised orders by cost centre between the
+// optional from and to dates (YYYY-MM-DD, store time, inclusive), optionally
+// for one site. Refunded orders are left out, as their subsidy was returned.
+func (cs *coffeeserver) subsidyReportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	filter := bson.NewDocument(
+		bson.EC.SubDocumentFromElements("subsidy", bson.EC.Boolean("$exists", true)),
+		bson.EC.SubDocumentFromElements("refunded", bson.EC.Boolean("$ne", true)),
+	)
+	timeRange, err := cs.reportTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if timeRange != nil {
+		filter.Append(timeRange)
+	}
+	if code := r.URL.Query().Get("site"); code != "" {
+		filter.Append(siteFilter(code))
+	}
+
+	totals := map[string]*costCentreTotals{}
+	err = cs.withCollection(ctx, cs.config.OrdersCollectionName, "subsidy_report", func(ctx context.Context, orders *mongo.Collection) error {
+		cur, err := orders.Find(ctx, filter)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var order coffeeOrder
+			if err := cur.Decode(&order); err != nil {
+				return err
+			}
+			if order.Subsidy == nil {
+				continue
+			}
+			t, ok := totals[order.Subsidy.CostCentre]
+			if !ok {
+				t = &costCentreTotals{CostCentre: order.Subsidy.CostCentre}
+				totals[order.Subsidy.CostCentre] = t
+			}
+			t.Orders++
+			t.Drinks += order.CoffeeQty
+			t.Total += float64(order.Amount)
+			t.Subsidy += order.Subsidy.Amount
+			t.EmployeeAmount += order.EmployeeAmount
+		}
+		return cur.Err()
+	})
+	if err != nil {
+		cs.logger(ctx).Error("Unable to build subsidy report: ", err)
+		http.Error(w, "Unable to build subsidy report", http.StatusInternalServerError)
+		return
+	}
+
+	report := make([]*costCentreTotals, 0, len(totals))
+	for _, t := range totals {
+		report = append(report, t)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].CostCentre < report[j].CostCentre })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"currency": cs.config.Currency, "costCentres": report})
+}
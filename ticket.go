@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/mongodb/mongo-go-driver/mongo/mongoopt"
+)
+
+// pickupCodeHeader carries an order's pickup number in the /order response,
+// alongside the reply text.
+const pickupCodeHeader = "X-Pickup-Code"
+
+// nextPickupCode allocates the next pickup number at a site for the day of t,
+// which must be in store time. Numbers start at 1 each day so they stay short
+// enough to call out.
+func (cs *coffeeserver) nextPickupCode(ctx context.Context, siteCode string, t time.Time) (string, error) {
+	var counter struct {
+		Seq int `bson:"seq"`
+	}
+	err := cs.withCollection(ctx, cs.config.PickupCountersCollectionName, "next_pickup_code", func(ctx context.Context, counters *mongo.Collection) error {
+		return counters.FindOneAndUpdate(ctx,
+			bson.NewDocument(bson.EC.String("_id", siteCode+"/"+t.Format("2006-01-02"))),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Int32("seq", 1))),
+			findopt.Upsert(true),
+			findopt.ReturnDocument(mongoopt.After),
+		).Decode(&counter)
+	})
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(counter.Seq), nil
+}
+
+type ticketItem struct {
+	CoffeeQty  int
+	CoffeeType string
+	For        string
+}
+
+// ticket is what a barista works from: one order, or all the orders of a
+// group.
+type ticket struct {
+	SiteCode   string
+	Site       string // the site's name
+	PickupCode string
+	Name       string // who to call out: the employee or the group's name
+	Items      []ticketItem
+	PickupAt   time.Time // zero for as soon as possible
+	Time       time.Time
+}
+
+// ticketWidth is the number of characters on a line of a 58mm receipt
+// printer's standard font.
+const ticketWidth = 32
+
+// text renders the ticket as plain text, for printers without ESC/POS and for
+// viewing in a browser.
+func (t *ticket) text() string {
+	var b bytes.Buffer
+	rule := strings.Repeat("-", ticketWidth)
+	if t.Site != "" {
+		fmt.Fprintln(&b, t.Site)
+	}
+	fmt.Fprintf(&b, "Pickup #%s\n", t.PickupCode)
+	fmt.Fprintln(&b, t.Name)
+	fmt.Fprintln(&b, rule)
+	b.WriteString(t.itemLines())
+	fmt.Fprintln(&b, rule)
+	if !t.PickupAt.IsZero() {
+		fmt.Fprintf(&b, "Pickup at %s\n", t.PickupAt.Format("15:04"))
+	}
+	fmt.Fprintf(&b, "Ordered %s\n", t.Time.Format("2006-01-02 15:04"))
+	return b.String()
+}
+
+func (t *ticket) itemLines() string {
+	var b bytes.Buffer
+	for _, item := range t.Items {
+		fmt.Fprintf(&b, "%2d x %s\n", item.CoffeeQty, item.CoffeeType)
+		if item.For != "" {
+			fmt.Fprintf(&b, "     for %s\n", item.For)
+		}
+	}
+	return b.String()
+}
+
+// ESC/POS commands understood by most receipt printers.
+var (
+	escposInit       = []byte{0x1b, '@'}
+	escposCentre     = []byte{0x1b, 'a', 1}
+	escposLeft       = []byte{0x1b, 'a', 0}
+	escposDoubleSize = []byte{0x1d, '!', 0x11}
+	escposNormalSize = []byte{0x1d, '!', 0x00}
+	escposFeedAndCut = []byte{0x1b, 'd', 4, 0x1d, 'V', 'B', 0}
+	escposLineFeed   = []byte{'\n'}
+)
+
+// escpos renders the ticket for an ESC/POS receipt printer, with the pickup
+// number large enough to read from across the bar.
+func (t *ticket) escpos() []byte {
+	var b bytes.Buffer
+	b.Write(escposInit)
+	b.Write(escposCentre)
+	if t.Site != "" {
+		b.WriteString(asciiOnly(t.Site))
+		b.Write(escposLineFeed)
+	}
+	b.Write(escposDoubleSize)
+	b.WriteString("#" + t.PickupCode)
+	b.Write(escposLineFeed)
+	b.Write(escposNormalSize)
+	b.WriteString(asciiOnly(t.Name))
+	b.Write(escposLineFeed)
+	b.Write(escposLeft)
+	b.WriteString(strings.Repeat("-", ticketWidth) + "\n")
+	b.WriteString(asciiOnly(t.itemLines()))
+	b.WriteString(strings.Repeat("-", ticketWidth) + "\n")
+	if !t.PickupAt.IsZero() {
+		b.Write(escposDoubleSize)
+		b.WriteString("Pickup " + t.PickupAt.Format("15:04"))
+		b.Write(escposLineFeed)
+		b.Write(escposNormalSize)
+	}
+	b.WriteString("Ordered " + t.Time.Format("2006-01-02 15:04") + "\n")
+	b.Write(escposFeedAndCut)
+	return b.Bytes()
+}
+
+// asciiOnly replaces characters outside printable ASCII, which receipt
+// printers would print from whatever code page they are set to.
+func asciiOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || (r >= ' ' && r <= '~') {
+			return r
+		}
+		return '?'
+	}, s)
+}
+
+// Ticket PDFs are sized for 58mm receipt paper, in points.
+const (
+	pdfTicketWidth   = 164
+	pdfTicketMargin  = 6
+	pdfTicketFont    = 8
+	pdfTicketLeading = 10
+)
+
+// pdf renders the plain text ticket as a single page PDF, for sites that
+// print tickets from a browser on an ordinary printer. Courier is one of the
+// standard PDF fonts, so nothing needs embedding.
+func (t *ticket) pdf() []byte {
+	lines := strings.Split(strings.TrimSuffix(asciiOnly(t.text()), "\n"), "\n")
+	height := 2*pdfTicketMargin + len(lines)*pdfTicketLeading
+
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", pdfTicketFont, pdfTicketLeading, pdfTicketMargin, height-pdfTicketMargin-pdfTicketFont)
+	for _, line := range lines {
+		fmt.Fprintf(&content, "(%s) Tj T*\n", pdfEscaper.Replace(line))
+	}
+	content.WriteString("ET\n")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>", pdfTicketWidth, height),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+	}
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return b.Bytes()
+}
+
+// pdfEscaper escapes the characters that are special in a PDF string.
+var pdfEscaper = strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
+
+// orderTicket returns the ticket for a single order.
+func (cs *coffeeserver) orderTicket(s *site, order *coffeeOrder) *ticket {
+	t := &ticket{
+		SiteCode:   siteCodeOf(s),
+		Site:       siteName(s),
+		PickupCode: order.PickupCode,
+		Name:       order.EmployeeID,
+		Items:      []ticketItem{{CoffeeQty: order.CoffeeQty, CoffeeType: order.CoffeeType}},
+		Time:       cs.storeTime(time.Unix(order.Time, 0)),
+	}
+	if order.PickupAt != 0 {
+		t.PickupAt = cs.storeTime(time.Unix(order.PickupAt, 0))
+	}
+	return t
+}
+
+// groupTicket returns one ticket for the orders of group g.
+func (cs *coffeeserver) groupTicket(s *site, g *groupOrder, orders []coffeeOrder) *ticket {
+	t := &ticket{
+		SiteCode:   siteCodeOf(s),
+		Site:       siteName(s),
+		PickupCode: g.PickupCode,
+		Name:       g.Name,
+		Time:       cs.storeTime(time.Unix(g.CreatedAt, 0)),
+	}
+	if t.Name == "" {
+		t.Name = "Group " + g.Code
+	}
+	if g.PickupAt != 0 {
+		t.PickupAt = cs.storeTime(time.Unix(g.PickupAt, 0))
+	}
+	for _, order := range orders {
+		t.Items = append(t.Items, ticketItem{CoffeeQty: order.CoffeeQty, CoffeeType: order.CoffeeType, For: order.For})
+	}
+	return t
+}
+
+// printerAddress returns the host:port of the ESC/POS printer for site s, or
+// "" if tickets are not printed there.
+func (cs *coffeeserver) printerAddress(s *site) string {
+	if s != nil && s.Printer != "" {
+		return s.Printer
+	}
+	return cs.config.PrinterAddress
+}
+
+// printTicket sends a ticket to the site's printer in the background. A
+// printer that is off or out of paper must not hold up ordering, so failures
+// are only logged; baristas can reprint from the queue.
+func (cs *coffeeserver) printTicket(s *site, t *ticket) {
+	addr := cs.printerAddress(s)
+	if addr == "" {
+		return
+	}
+	data := t.escpos()
+	go func() {
+		err := sendToPrinter(addr, data, cs.config.PrinterTimeout)
+		recordTicketPrinted(t.SiteCode, err)
+		if err != nil {
+			cs.log.WithField("pickupCode", t.PickupCode).Error("Unable to print ticket: ", err)
+		}
+	}()
+}
+
+func siteCodeOf(s *site) string {
+	if s == nil {
+		return ""
+	}
+	return s.Code
+}
+
+// sendToPrinter writes raw ESC/POS data to a network printer, which listen on
+// port 9100. Any TCP listener will do for testing, e.g. nc -l 9100 | xxd.
+func sendToPrinter(addr string, data []byte, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err = conn.Write(data)
+	return err
+}
+
+// printReleasedOrders prints tickets for orders that have just been released
+// to the queue, with one ticket for each group's orders.
+func (cs *coffeeserver) printReleasedOrders(ctx context.Context, orders []coffeeOrder) {
+	groups := map[string][]coffeeOrder{}
+	for i := range orders {
+		order := &orders[i]
+		if order.Group != "" {
+			groups[order.Group] = append(groups[order.Group], *order)
+			continue
+		}
+		s, err := cs.getSite(ctx, order.Site)
+		if err != nil {
+			cs.log.WithField("order", order.ID.Hex()).Error("Unable to find site to print ticket: ", err)
+			continue
+		}
+		cs.printTicket(s, cs.orderTicket(s, order))
+	}
+	for code, items := range groups {
+		g, err := cs.findGroup(ctx, code)
+		if err != nil {
+			cs.log.WithField("group", code).Error("Unable to find group to print ticket: ", err)
+			continue
+		}
+		s, err := cs.getSite(ctx, g.Site)
+		if err != nil {
+			cs.log.WithField("group", code).Error("Unable to find site to print ticket: ", err)
+			continue
+		}
+		cs.printTicket(s, cs.groupTicket(s, g, items))
+	}
+}
+
+// ticketHandler shows an order's ticket as plain text, or as a PDF with
+// ?format=pdf (GET), for sites without a receipt printer, or sends it to the
+// site's printer again (POST). The ticket for an order in a group covers the
+// whole group.
+func (cs *coffeeserver) ticketHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := objectid.FromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Unknown order", http.StatusNotFound)
+		return
+	}
+	var order coffeeOrder
+	err = cs.withCollection(ctx, cs.config.OrdersCollectionName, "find_order", func(ctx context.Context, orders *mongo.Collection) error {
+		return orders.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", id))).Decode(&order)
+	})
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Unknown order", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		cs.logger(ctx).Error("Unable to find order: ", err)
+		http.Error(w, "Unable to find order", http.StatusInternalServerError)
+		return
+	}
+	s, err := cs.getSite(ctx, order.Site)
+	if err != nil {
+		cs.logger(ctx).Error("Unable to find site: ", err)
+		http.Error(w, "Unable to find order's site", http.StatusInternalServerError)
+		return
+	}
+
+	t := cs.orderTicket(s, &order)
+	if order.Group != "" {
+		g, err := cs.findGroup(ctx, order.Group)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		orders, err := cs.groupOrders(ctx, g)
+		if err != nil {
+			cs.logger(ctx).Error("Unable to list group orders: ", err)
+			http.Error(w, "Unable to list group orders", http.StatusInternalServerError)
+			return
+		}
+		t = cs.groupTicket(s, g, orders)
+	}
+
+	if r.Method == http.MethodPost {
+		addr := cs.printerAddress(s)
+		if addr == "" {
+			http.Error(w, "No printer is set up for this site", http.StatusConflict)
+			return
+		}
+		err := sendToPrinter(addr, t.escpos(), cs.config.PrinterTimeout)
+		recordTicketPrinted(t.SiteCode, err)
+		if err != nil {
+			cs.logger(ctx).Error("Unable to print ticket: ", err)
+			http.Error(w, "Unable to print ticket: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(t.pdf())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, t.text())
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTicket() *ticket {
+	return &ticket{
+		SiteCode:   "syd",
+		Site:       "Sydney Café",
+		PickupCode: "42",
+		Name:       "Team (standup)",
+		Items: []ticketItem{
+			{CoffeeQty: 2, CoffeeType: "latte"},
+			{CoffeeQty: 1, CoffeeType: "flat white", For: "Sam"},
+		},
+		PickupAt: time.Date(2018, 9, 3, 9, 30, 0, 0, time.UTC),
+		Time:     time.Date(2018, 9, 3, 9, 10, 0, 0, time.UTC),
+	}
+}
+
+// fakePrinter listens like a network receipt printer and returns everything
+// written to it by the first connection.
+func fakePrinter(t *testing.T) (addr string, received <-chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan []byte, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			ch <- nil
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		ch <- data
+	}()
+	return l.Addr().String(), ch
+}
+
+func TestSendToPrinter(t *testing.T) {
+	addr, received := fakePrinter(t)
+	data := testTicket().escpos()
+	if err := sendToPrinter(addr, data, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) {
+			t.Errorf("printer received %q, want %q", got, data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("printer received nothing")
+	}
+}
+
+func TestSendToPrinterUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if err := sendToPrinter(addr, []byte("x"), time.Second); err == nil {
+		t.Error("expected an error sending to a closed port")
+	}
+}
+
+func TestTicketESCPOS(t *testing.T) {
+	got := testTicket().escpos()
+	for _, want := range [][]byte{
+		escposInit,
+		append(append(append([]byte{}, escposDoubleSize...), "#42"...), escposLineFeed...),
+		[]byte("Sydney Caf?\n"),
+		[]byte(" 2 x latte\n 1 x flat white\n     for Sam\n"),
+		[]byte("Pickup 09:30"),
+		[]byte("Ordered 2018-09-03 09:10\n"),
+	} {
+		if !bytes.Contains(got, want) {
+			t.Errorf("ESC/POS ticket %q does not contain %q", got, want)
+		}
+	}
+	if !bytes.HasPrefix(got, escposInit) || !bytes.HasSuffix(got, escposFeedAndCut) {
+		t.Errorf("ESC/POS ticket %q should start with init and end with a cut", got)
+	}
+	for _, c := range got {
+		if c >= 0x80 {
+			t.Fatalf("ESC/POS ticket %q contains non-ASCII byte %#x", got, c)
+		}
+	}
+}
+
+func TestTicketText(t *testing.T) {
+	rule := strings.Repeat("-", ticketWidth)
+	want := "Sydney Café\nPickup #42\nTeam (standup)\n" + rule + "\n" +
+		" 2 x latte\n 1 x flat white\n     for Sam\n" + rule + "\n" +
+		"Pickup at 09:30\nOrdered 2018-09-03 09:10\n"
+	if got := testTicket().text(); got != want {
+		t.Errorf("got ticket\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTicketPDF(t *testing.T) {
+	got := string(testTicket().pdf())
+	if !strings.HasPrefix(got, "%PDF-1.4\n") || !strings.HasSuffix(got, "%%EOF\n") {
+		t.Fatalf("not a PDF: %q", got)
+	}
+	for _, want := range []string{"(Pickup #42) Tj", `(Team \(standup\)) Tj`, "(Sydney Caf?) Tj"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("PDF does not contain %q", want)
+		}
+	}
+
+	// The cross-reference table must point at each object.
+	var xref int
+	if _, err := fmt.Sscanf(got[strings.LastIndex(got, "startxref\n"):], "startxref\n%d", &xref); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got[xref:], "xref\n") {
+		t.Fatalf("startxref %d does not point at the xref table", xref)
+	}
+	entries := strings.Split(got[xref:], "\n")[3:8]
+	for i, entry := range entries {
+		var offset int
+		fmt.Sscanf(entry, "%d", &offset)
+		if want := fmt.Sprintf("%d 0 obj", i+1); !strings.HasPrefix(got[offset:], want) {
+			t.Errorf("xref entry %d points at %q, want %q", i+1, got[offset:offset+len(want)], want)
+		}
+	}
+}
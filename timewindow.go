@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// storeTime returns t in the store's configured time zone.
+func (cs *coffeeserver) storeTime(t time.Time) time.Time {
+	if cs.config.location != nil {
+		return t.In(cs.config.location)
+	}
+	return t
+}
+
+var (
+	clockFormat = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+	dateFormat  = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+)
+
+// timeWindow restricts a rule to days of the week, a time of day and a date
+// range, all in store time. Empty days and unset times and dates match
+// everything.
+type timeWindow struct {
+	Days       []int  // 0 is Sunday
+	From       string // HH:MM, inclusive
+	Until      string // HH:MM, exclusive
+	ValidFrom  string // YYYY-MM-DD, inclusive
+	ValidUntil string // YYYY-MM-DD, inclusive
+}
+
+func (w timeWindow) validate() error {
+	for _, day := range w.Days {
+		if day < 0 || day > 6 {
+			return fmt.Errorf("days must be between 0 (Sunday) and 6 (Saturday)")
+		}
+	}
+	for _, t := range []string{w.From, w.Until} {
+		if t != "" && !clockFormat.MatchString(t) {
+			return fmt.Errorf("from and until must be HH:MM")
+		}
+	}
+	for _, d := range []string{w.ValidFrom, w.ValidUntil} {
+		if d != "" && !dateFormat.MatchString(d) {
+			return fmt.Errorf("validFrom and validUntil must be YYYY-MM-DD")
+		}
+	}
+	return nil
+}
+
+// matches reports whether t, which must be in store time, is in the window.
+func (w timeWindow) matches(t time.Time) bool {
+	if len(w.Days) > 0 {
+		found := false
+		for _, day := range w.Days {
+			if time.Weekday(day) == t.Weekday() {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	// Zero-padded times and dates compare correctly as strings.
+	clock, date := t.Format("15:04"), t.Format("2006-01-02")
+	if w.From != "" && clock < w.From || w.Until != "" && clock >= w.Until {
+		return false
+	}
+	if w.ValidFrom != "" && date < w.ValidFrom || w.ValidUntil != "" && date > w.ValidUntil {
+		return false
+	}
+	return true
+}
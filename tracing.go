@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"contrib.go.opencensus.io/exporter/stackdriver"
+	stackdriverpropagation "contrib.go.opencensus.io/exporter/stackdriver/propagation"
+	"github.com/Sirupsen/logrus"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"google.golang.org/api/option"
+)
+
+// logExporter writes finished spans to the log. It is intended for local
+// development where no tracing backend is available.
+type logExporter struct {
+	log *logrus.Logger
+}
+
+func (e *logExporter) ExportSpan(sd *trace.SpanData) {
+	fields := logrus.Fields{
+		"traceID":    sd.TraceID.String(),
+		"spanID":     sd.SpanID.String(),
+		"durationMs": float64(sd.EndTime.Sub(sd.StartTime).Nanoseconds()) / 1e6,
+	}
+	if sd.ParentSpanID != (trace.SpanID{}) {
+		fields["parentSpanID"] = sd.ParentSpanID.String()
+	}
+	if sd.Code != trace.StatusCodeOK {
+		fields["statusCode"] = sd.Code
+		fields["statusMessage"] = sd.Message
+	}
+	for k, v := range sd.Attributes {
+		fields["attr."+k] = v
+	}
+	e.log.WithFields(fields).Info("Span ", sd.Name)
+}
+
+// w3cFormat implements the W3C Trace Context "traceparent" header.
+type w3cFormat struct{}
+
+const traceparentHeader = "traceparent"
+
+func (f *w3cFormat) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	parts := strings.Split(req.Header.Get(traceparentHeader), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return trace.SpanContext{}, false
+	}
+
+	var sc trace.SpanContext
+	tid, err := hex.DecodeString(parts[1])
+	if err != nil || len(tid) != len(sc.TraceID) {
+		return trace.SpanContext{}, false
+	}
+	sid, err := hex.DecodeString(parts[2])
+	if err != nil || len(sid) != len(sc.SpanID) {
+		return trace.SpanContext{}, false
+	}
+	opts, err := hex.DecodeString(parts[3])
+	if err != nil || len(opts) != 1 {
+		return trace.SpanContext{}, false
+	}
+
+	copy(sc.TraceID[:], tid)
+	copy(sc.SpanID[:], sid)
+	sc.TraceOptions = trace.TraceOptions(opts[0] & 1)
+	return sc, true
+}
+
+func (f *w3cFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	req.Header.Set(traceparentHeader, fmt.Sprintf("00-%s-%s-%02x",
+		hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), uint32(sc.TraceOptions)&1))
+}
+
+// multiFormat accepts a span context from the first format that recognises
+// the request, and writes all formats on outgoing requests.
+type multiFormat []propagation.HTTPFormat
+
+func (m multiFormat) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	for _, f := range m {
+		if sc, ok := f.SpanContextFromRequest(req); ok {
+			return sc, true
+		}
+	}
+	return trace.SpanContext{}, false
+}
+
+func (m multiFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	for _, f := range m {
+		f.SpanContextToRequest(sc, req)
+	}
+}
+
+func propagationFormat(names string) (propagation.HTTPFormat, error) {
+	var formats multiFormat
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "w3c":
+			formats = append(formats, &w3cFormat{})
+		case "b3":
+			formats = append(formats, &b3.HTTPFormat{})
+		case "stackdriver":
+			formats = append(formats, &stackdriverpropagation.HTTPFormat{})
+		case "":
+		default:
+			return nil, fmt.Errorf("Unknown trace propagation format %q", name)
+		}
+	}
+	return formats, nil
+}
+
+// newStackdriverExporter returns an exporter that uploads spans to
+// Stackdriver Trace in trace.stackdriver_project, using the credentials in
+// trace.stackdriver_key_file. Both default to Dialogflow's.
+func newStackdriverExporter(log *logrus.Logger, cfg *config) (*stackdriver.Exporter, error) {
+	project, keyFile := cfg.TraceStackdriverProject, cfg.TraceStackdriverKeyFile
+	if project == "" {
+		project = cfg.DialogflowProjectID
+	}
+	if keyFile == "" {
+		keyFile = cfg.DialogflowKeyFile
+	}
+	credentials := []option.ClientOption{option.WithCredentialsFile(keyFile)}
+	return stackdriver.NewExporter(stackdriver.Options{
+		ProjectID:               project,
+		TraceClientOptions:      credentials,
+		MonitoringClientOptions: credentials,
+		OnError: func(err error) {
+			log.Error("Unable to upload spans to Stackdriver: ", err)
+		},
+	})
+}
+
+// setupTracing configures sampling and the span exporter, and wraps handler so
+// that a server span is started for each request. The returned function
+// uploads any buffered spans and must be called before exiting.
+func setupTracing(log *logrus.Logger, cfg *config, handler http.Handler) (http.Handler, func(), error) {
+	format, err := propagationFormat(cfg.TracePropagation)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flush := func() {}
+	switch cfg.TraceExporter {
+	case "none":
+		return handler, flush, nil
+	case "log":
+		trace.RegisterExporter(&logExporter{log: log})
+	case "stackdriver":
+		exporter, err := newStackdriverExporter(log, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		trace.RegisterExporter(exporter)
+		flush = exporter.Flush
+	default:
+		return nil, nil, fmt.Errorf("Unknown trace exporter %q", cfg.TraceExporter)
+	}
+
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(cfg.TraceSampleRate)})
+	log.WithFields(logrus.Fields{"exporter": cfg.TraceExporter, "propagation": cfg.TracePropagation, "sampleRate": cfg.TraceSampleRate}).Info("Tracing enabled")
+
+	return &ochttp.Handler{Handler: handler, Propagation: format}, flush, nil
+}
+
+// endSpan records err (if any) as the span status and ends the span.
+func endSpan(span *trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.End()
+}
+
+// startMongoSpan starts a client span for a MongoDB operation on collection.
+func (cs *coffeeserver) startMongoSpan(ctx context.Context, collection, operation string) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, "mongo."+collection+"."+operation, trace.WithSpanKind(trace.SpanKindClient))
+	span.AddAttributes(
+		trace.StringAttribute("db.type", "mongo"),
+		trace.StringAttribute("db.instance", cs.config.DBName),
+		trace.StringAttribute("db.collection", collection),
+	)
+	return ctx, span
+}
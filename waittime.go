@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// Tickets that took longer than this from preparing to ready were most
+// likely not marked ready when they were, and are left out when learning.
+const maxPrepTime = 30 * time.Minute
+
+// prepModel is what has been learned about how quickly a site makes drinks,
+// from how long tickets took to go from preparing to ready.
+type prepModel struct {
+	perDrink map[string]time.Duration // time to make one of a drink
+	typical  time.Duration            // for drinks without history of their own
+	baristas int                      // tickets made at the same time
+	learned  time.Time
+}
+
+// prepTime returns how long a ticket with these orders takes to make.
+func (m *prepModel) prepTime(orders []coffeeOrder) time.Duration {
+	var total time.Duration
+	for _, order := range orders {
+		perDrink, ok := m.perDrink[order.CoffeeType]
+		if !ok {
+			perDrink = m.typical
+		}
+		total += time.Duration(order.CoffeeQty) * perDrink
+	}
+	return total
+}
+
+// prepModels caches each site's prepModel for waittime.refresh.
+type prepModels struct {
+	mu     sync.Mutex
+	models map[string]*prepModel
+}
+
+func newPrepModels() *prepModels {
+	return &prepModels{models: map[string]*prepModel{}}
+}
+
+// prepModel returns the model for a site, learning it again if it is stale.
+// If there is no history, or it cannot be read, the configured defaults are
+// used.
+func (cs *coffeeserver) prepModel(ctx context.Context, siteCode string) *prepModel {
+	cs.prepModels.mu.Lock()
+	m, ok := cs.prepModels.models[siteCode]
+	cs.prepModels.mu.Unlock()
+	if ok && time.Since(m.learned) < cs.config.WaitTimeRefresh {
+		return m
+	}
+
+	m, err := cs.learnPrepModel(ctx, siteCode)
+	if err != nil {
+		cs.logger(ctx).WithField("site", siteCode).Error("Unable to learn preparation times: ", err)
+		return &prepModel{typical: cs.config.WaitTimeDefaultPrep, baristas: cs.config.WaitTimeBaristas}
+	}
+	cs.prepModels.mu.Lock()
+	cs.prepModels.models[siteCode] = m
+	cs.prepModels.mu.Unlock()
+	return m
+}
+
+// prepTicket is a ticket the barista made, as learned from.
+type prepTicket struct {
+	start, end int64
+	orders     []coffeeOrder
+}
+
+// learnPrepModel works out a site's preparation times and barista count from
+// the last waittime.history of orders. A drink's time is the median time per
+// drink of tickets of only that drink; the barista count is how many tickets
+// were being made at once, on average, while any were.
+func (cs *coffeeserver) learnPrepModel(ctx context.Context, siteCode string) (*prepModel, error) {
+	since := time.Now().Add(-cs.config.WaitTimeHistory).Unix()
+	tickets := map[string]*prepTicket{}
+	err := cs.withCollection(ctx, cs.config.OrdersCollectionName, "learn_prep_times", func(ctx context.Context, orders *mongo.Collection) error {
+		cur, err := orders.Find(ctx,
+			bson.NewDocument(
+				siteFilter(siteCode),
+				bson.EC.SubDocumentFromElements("preparingAt", bson.EC.Int64("$gte", since)),
+				bson.EC.SubDocumentFromElements("readyAt", bson.EC.Int64("$gt", 0)),
+			),
+			findopt.Sort(bson.NewDocument(bson.EC.Int32("readyAt", -1))),
+			findopt.Limit(1000),
+		)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var order coffeeOrder
+			if err := cur.Decode(&order); err != nil {
+				return err
+			}
+			key := ticketKey(&order)
+			t, ok := tickets[key]
+			if !ok {
+				t = &prepTicket{start: order.PreparingAt, end: order.ReadyAt}
+				tickets[key] = t
+			}
+			t.orders = append(t.orders, order)
+		}
+		return cur.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m := &prepModel{perDrink: map[string]time.Duration{}, typical: cs.config.WaitTimeDefaultPrep, baristas: cs.config.WaitTimeBaristas, learned: time.Now()}
+	byDrink := map[string][]time.Duration{}
+	var all []time.Duration
+	var intervals []prepTicket
+	for _, t := range tickets {
+		took := time.Duration(t.end-t.start) * time.Second
+		if took <= 0 || took > maxPrepTime {
+			continue
+		}
+		drinks := 0
+		for _, order := range t.orders {
+			drinks += order.CoffeeQty
+		}
+		if drinks == 0 {
+			continue
+		}
+		perDrink := took / time.Duration(drinks)
+		all = append(all, perDrink)
+		if sameDrink(t.orders) {
+			byDrink[t.orders[0].CoffeeType] = append(byDrink[t.orders[0].CoffeeType], perDrink)
+		}
+		intervals = append(intervals, *t)
+	}
+	if len(all) > 0 {
+		m.typical = medianDuration(all)
+	}
+	for drink, times := range byDrink {
+		m.perDrink[drink] = medianDuration(times)
+	}
+	if concurrency := averageConcurrency(intervals); concurrency > 0 {
+		m.baristas = int(math.Max(1, math.Floor(concurrency+0.5)))
+	}
+	return m, nil
+}
+
+func sameDrink(orders []coffeeOrder) bool {
+	for _, order := range orders[1:] {
+		if order.CoffeeType != orders[0].CoffeeType {
+			return false
+		}
+	}
+	return true
+}
+
+func medianDuration(times []time.Duration) time.Duration {
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// averageConcurrency returns the total time spent on tickets divided by the
+// time during which at least one ticket was being made.
+func averageConcurrency(tickets []prepTicket) float64 {
+	if len(tickets) == 0 {
+		return 0
+	}
+	sort.Slice(tickets, func(i, j int) bool { return tickets[i].start < tickets[j].start })
+	var busy, union int64
+	spanStart, spanEnd := tickets[0].start, tickets[0].end
+	for _, t := range tickets {
+		busy += t.end - t.start
+		if t.start > spanEnd {
+			union += spanEnd - spanStart
+			spanStart, spanEnd = t.start, t.end
+		} else if t.end > spanEnd {
+			spanEnd = t.end
+		}
+	}
+	union += spanEnd - spanStart
+	if union == 0 {
+		return 0
+	}
+	return float64(busy) / float64(union)
+}
+
+// ticketKey identifies the ticket an order is made on: the group's, or its
+// own.
+func ticketKey(order *coffeeOrder) string {
+	if order.Group != "" {
+		return "group:" + order.Group
+	}
+	return order.ID.Hex()
+}
+
+// activeOrders returns the orders at a site that are queued, being made or
+// waiting to be collected, oldest first.
+func (cs *coffeeserver) activeOrders(ctx context.Context, siteCode string) ([]coffeeOrder, error) {
+	var active []coffeeOrder
+	err := cs.withCollection(ctx, cs.config.OrdersCollectionName, "list_queue", func(ctx context.Context, orders *mongo.Collection) error {
+		cur, err := orders.Find(ctx,
+			bson.NewDocument(
+				siteFilter(siteCode),
+				bson.EC.SubDocumentFromElements("status", bson.EC.Array("$in", bson.NewArray(
+					bson.VC.String(statusQueued), bson.VC.String(statusPreparing), bson.VC.String(statusReady)))),
+				bson.EC.SubDocumentFromElements("refunded", bson.EC.Boolean("$ne", true)),
+			),
+			findopt.Sort(bson.NewDocument(bson.EC.Int32("time", 1))),
+		)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var order coffeeOrder
+			if err := cur.Decode(&order); err != nil {
+				return err
+			}
+			active = append(active, order)
+		}
+		return cur.Err()
+	})
+	return active, err
+}
+
+// estimateReady works out when each ticket in a site's queue will be ready,
+// by ticket key. Tickets are made in the order they were placed by the first
+// free barista; tickets already being made carry on from when they were
+// started.
+func estimateReady(m *prepModel, orders []coffeeOrder, now time.Time) map[string]time.Time {
+	var keys []string
+	tickets := map[string][]coffeeOrder{}
+	for _, order := range orders {
+		if order.Status != statusQueued && order.Status != statusPreparing {
+			continue
+		}
+		key := ticketKey(&order)
+		if _, ok := tickets[key]; !ok {
+			keys = append(keys, key)
+		}
+		tickets[key] = append(tickets[key], order)
+	}
+
+	baristas := m.baristas
+	if baristas < 1 {
+		baristas = 1
+	}
+	free := make([]time.Time, baristas)
+	for i := range free {
+		free[i] = now
+	}
+	// earliest returns the barista who will be free first.
+	earliest := func() int {
+		best := 0
+		for i := range free {
+			if free[i].Before(free[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+
+	ready := map[string]time.Time{}
+	// Tickets being made first, then the queue in order.
+	for _, preparing := range []bool{true, false} {
+		for _, key := range keys {
+			t := tickets[key]
+			if (t[0].Status == statusPreparing) != preparing {
+				continue
+			}
+			b := earliest()
+			start := free[b]
+			if preparing {
+				start = time.Unix(t[0].PreparingAt, 0)
+			}
+			end := start.Add(m.prepTime(t))
+			if end.Before(free[b]) {
+				// Taking longer than expected: assume it is nearly done.
+				end = free[b].Add(time.Minute)
+			}
+			ready[key] = end
+			free[b] = end
+		}
+	}
+	return ready
+}
+
+// waitEstimate is when an order should be ready, for order replies and the
+// order status API.
+type waitEstimate struct {
+	Ahead   int   `json:"ahead"` // tickets to be made before this one
+	Wait    int64 `json:"waitSeconds"`
+	ReadyAt int64 `json:"estimatedReadyAt"`
+}
+
+// estimateWait estimates when an order will be ready. It returns nil for
+// orders that are already ready or not yet in a queue.
+func (cs *coffeeserver) estimateWait(ctx context.Context, order *coffeeOrder) (*waitEstimate, error) {
+	now := time.Now()
+	switch order.Status {
+	case statusScheduled:
+		return &waitEstimate{Wait: order.PickupAt - now.Unix(), ReadyAt: order.PickupAt}, nil
+	case statusQueued, statusPreparing:
+	default:
+		return nil, nil
+	}
+
+	orders, err := cs.activeOrders(ctx, order.Site)
+	if err != nil {
+		return nil, err
+	}
+	ready := estimateReady(cs.prepModel(ctx, order.Site), orders, now)
+	at, ok := ready[ticketKey(order)]
+	if !ok {
+		return nil, nil
+	}
+	e := &waitEstimate{ReadyAt: at.Unix(), Wait: int64(at.Sub(now) / time.Second)}
+	for key, other := range ready {
+		if key != ticketKey(order) && other.Before(at) {
+			e.Ahead++
+		}
+	}
+	if e.Wait < 0 {
+		e.Wait = 0
+	}
+	return e, nil
+}
+
+// describeWait describes an estimated wait for a voice reply.
+func describeWait(e *waitEstimate) string {
+	minutes := int(math.Ceil(float64(e.Wait) / 60))
+	if minutes <= 1 {
+		return "about a minute"
+	}
+	return fmt.Sprintf("about %d minutes", minutes)
+}
+
+// orderProgressHandler reports an order's status and, until it is ready,
+// when it should be ready. Employees can only see their own orders.
+func (cs *coffeeserver) orderProgressHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := objectid.FromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Unknown order", http.StatusNotFound)
+		return
+	}
+	var order coffeeOrder
+	err = cs.withCollection(ctx, cs.config.OrdersCollectionName, "find_order", func(ctx context.Context, orders *mongo.Collection) error {
+		return orders.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", id))).Decode(&order)
+	})
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Unknown order", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		cs.logger(ctx).Error("Unable to find order: ", err)
+		http.Error(w, "Unable to find order", http.StatusInternalServerError)
+		return
+	}
+	employeeID, _ := identifiedEmployee(ctx)
+	if employeeID == "" || (employeeID != order.EmployeeID && employeeID != order.For) {
+		if !principalFromContext(ctx).can(permBaristaQueue) {
+			http.Error(w, "Unknown order", http.StatusNotFound)
+			return
+		}
+	}
+
+	resp := map[string]interface{}{
+		"id":         id.Hex(),
+		"site":       order.Site,
+		"status":     order.Status,
+		"pickupCode": order.PickupCode,
+	}
+	if order.Refunded {
+		resp["refunded"] = true
+	}
+	if order.ReadyAt != 0 {
+		resp["readyAt"] = order.ReadyAt
+	}
+	if estimate, err := cs.estimateWait(ctx, &order); err != nil {
+		cs.logger(ctx).Error("Unable to estimate wait: ", err)
+	} else if estimate != nil {
+		resp["estimate"] = estimate
+	}
+	writeJSON(w, http.StatusOK, resp)
+}